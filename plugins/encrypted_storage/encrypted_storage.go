@@ -0,0 +1,161 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/m4rs14n/go-app/shared"
+)
+
+var settings = shared.SetupSettings(shared.EncryptedStorageUUID, "EncryptedStorage", "This is a storage plugin encrypting the values")
+
+// Manifest describes the plugin to the loader
+var Manifest = shared.PluginManifest{
+	Name:         "EncryptedStorage",
+	Version:      "1.0.0",
+	APIVersion:   shared.SharedAPIVersion,
+	Author:       "Hojat Parta",
+	Capabilities: []string{shared.CapabilityStorage, shared.CapabilityEncryptedStorage},
+}
+
+// encryptedStorage is a storage plugin encrypting the values
+type encryptedStorage struct {
+	shared.SimplePlugin
+}
+
+// Make sure we implement required interfaces
+var _ shared.Endpoint = (*encryptedStorage)(nil)
+var _ shared.CallerEndpoint = (*encryptedStorage)(nil)
+var _ shared.SettingsSchema = (*encryptedStorage)(nil)
+var _ shared.SettingsChanged = (*encryptedStorage)(nil)
+
+var instance = &encryptedStorage{
+	shared.SimplePlugin{Settings: settings},
+}
+
+// NewPlugin returns an instance of the plugin
+func NewPlugin() (shared.Plugin, error) {
+	return instance, nil
+}
+
+// Schema declares the settings of the plugin
+func (s *encryptedStorage) Schema() []shared.SettingSpec {
+	return append(append([]shared.SettingSpec{}, shared.StorageBackendSchema...), shared.StorageQuotaSchema...)
+}
+
+// SettingsChanged applies the updates of the quotas, the backend cannot change
+func (s *encryptedStorage) SettingsChanged(previous shared.Settings) error {
+	return shared.StorageBackendChanged(settings, previous)
+}
+
+// The values are only accepted once Start opens an encrypted backend
+var engine = shared.NewStorageEngine(shared.EncryptedStorageUUID)
+
+// opened is closed once the engine has an encrypted backend
+var opened = make(chan struct{})
+
+func init() {
+	// The quotas are read from the settings so the host can change them
+	engine.Quota = func(owner uuid.UUID) shared.StorageQuota {
+		return shared.StorageQuotaFor(settings, owner)
+	}
+}
+
+// openBackend opens the backend selected by the settings, without a key file the values can only be kept in memory
+// and are encrypted with a key of the process
+func openBackend() (shared.StorageBackend, error) {
+	if keyFile := settings.GetString(shared.StorageSettingKeyFile, ""); keyFile != "" {
+		return shared.OpenStorageBackend(settings)
+	}
+
+	if kind := settings.GetString(shared.StorageSettingBackend, shared.StorageBackendMemory); kind != shared.StorageBackendMemory {
+		return nil, errors.New("The encrypted storage needs a key file to persist its values")
+	}
+	return memoryBackend()
+}
+
+// memoryBackend keeps the values in memory encrypted with a random key
+func memoryBackend() (shared.StorageBackend, error) {
+	key := make([]byte, shared.StorageKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return shared.NewEncryptedBackend(shared.NewMemoryBackend(), key)
+}
+
+// Start method
+func (s *encryptedStorage) Start(done <-chan struct{}) {
+	s.SimplePlugin.Start(done)
+
+	// The storage does not answer rather than losing the values written in memory
+	backend, err := openBackend()
+	if err == nil {
+		if err = engine.SetBackend(backend); err != nil {
+			backend.Close()
+		}
+	}
+
+	if err != nil {
+		log.Printf("Cannot open the storage backend: %v", err)
+		return
+	}
+
+	close(opened)
+	go engine.RunExpiry(done)
+}
+
+// Stop method
+func (s *encryptedStorage) Stop() {
+	engine.Close()
+	s.SimplePlugin.Stop()
+}
+
+// BroadcastMessage sends the message to all clients
+func (s *encryptedStorage) HandleBroadcast(message interface{}) {
+	// Do nothing
+}
+
+// SendMessage sends the message to a specific client asynchronously
+func (s *encryptedStorage) HandleMessage(message interface{}) (<-chan interface{}, error) {
+	return s.HandleMessageFrom(uuid.Nil, message)
+}
+
+// HandleMessageFrom handles the messages in the namespace of the caller or in the namespaces shared with it
+func (s *encryptedStorage) HandleMessageFrom(caller uuid.UUID, message interface{}) (<-chan interface{}, error) {
+	select {
+	case <-opened:
+		return engine.HandleMessageFrom(caller, message)
+	default:
+		return nil, errors.New("The encrypted storage is not started")
+	}
+}
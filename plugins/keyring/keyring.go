@@ -0,0 +1,755 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/m4rs14n/go-app/shared"
+)
+
+var settings = shared.SetupSettings(shared.KeyringUUID, "Keyring", "This is a plugin keeping the keys of the other plugins")
+
+// Manifest describes the plugin to the loader
+var Manifest = shared.PluginManifest{
+	Name:         "Keyring",
+	Version:      "1.0.0",
+	APIVersion:   shared.SharedAPIVersion,
+	Author:       "Hojat Parta",
+	Capabilities: []string{shared.CapabilityKeyring},
+}
+
+const (
+	// iterations is the number of PBKDF2 iterations deriving the master key from the passphrase
+	iterations = 100000
+	// saltSize is the size of the salt of the passphrase
+	saltSize = 16
+	// auditHistory is the number of audit entries kept in memory when there is no audit file
+	auditHistory = 1000
+	// rotationCheck is how often the keys are checked for rotation
+	rotationCheck = time.Minute
+)
+
+const (
+	// saltKey is the record of the salt of the passphrase, it is not sealed
+	saltKey = "#salt"
+	// checkKey is a sealed record telling a wrong master key from a corrupted file
+	checkKey = "#check"
+)
+
+// keyVersion is a version of a key
+type keyVersion struct {
+	Version  int
+	Created  time.Time
+	Material []byte
+}
+
+// keyEntry is a key with all its versions, stored sealed by the master key
+type keyEntry struct {
+	Type     string
+	Versions []keyVersion
+	Grantees []uuid.UUID
+}
+
+// current returns the current version of the key
+func (e *keyEntry) current() keyVersion {
+	return e.Versions[len(e.Versions)-1]
+}
+
+// version returns a version of a key, the current one for 0
+func (e *keyEntry) version(version int) (keyVersion, bool) {
+	if version == 0 {
+		return e.current(), true
+	}
+
+	for _, v := range e.Versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return keyVersion{}, false
+}
+
+// allowed checks if the caller can use the key
+func (e *keyEntry) allowed(caller uuid.UUID, owner uuid.UUID) bool {
+	if caller == owner {
+		return true
+	}
+
+	for _, g := range e.Grantees {
+		if g == caller {
+			return true
+		}
+	}
+	return false
+}
+
+// info describes the key
+func (e *keyEntry) info(owner uuid.UUID, name string) shared.KeyInfo {
+	current := e.current()
+	return shared.KeyInfo{
+		Owner:    owner,
+		Name:     name,
+		Type:     e.Type,
+		Version:  current.Version,
+		Created:  current.Created,
+		Grantees: e.Grantees,
+	}
+}
+
+// keyring keeps the keys, its methods are served as "Keyring"
+type keyring struct {
+	backend   shared.StorageBackend
+	audit     []shared.KeyAuditEntry
+	auditFile *os.File
+	mutex     sync.Mutex
+}
+
+// keyringPlugin is the keyring plugin
+type keyringPlugin struct {
+	shared.SimplePlugin
+	shared.RPCServer
+}
+
+// Make sure we implement required interfaces
+var _ shared.Endpoint = (*keyringPlugin)(nil)
+var _ shared.RPCService = (*keyringPlugin)(nil)
+var _ shared.SettingsSchema = (*keyringPlugin)(nil)
+var _ shared.SettingsChanged = (*keyringPlugin)(nil)
+
+var instance = &keyringPlugin{
+	SimplePlugin: shared.SimplePlugin{Settings: settings},
+}
+
+var keys = &keyring{}
+
+// NewPlugin returns an instance of the plugin
+func NewPlugin() (shared.Plugin, error) {
+	if err := instance.RegisterName("Keyring", keys); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Schema declares the settings of the plugin
+func (s *keyringPlugin) Schema() []shared.SettingSpec {
+	return []shared.SettingSpec{
+		{Key: shared.KeyringSettingMasterKeyFile, Type: "", Description: "file of the master key sealing the keys"},
+		{Key: shared.KeyringSettingPassphrase, Type: shared.Secret(""), Description: "passphrase the master key is derived from"},
+		{Key: shared.KeyringSettingPath, Type: "", Description: "file the sealed keys are kept in"},
+		{Key: shared.KeyringSettingAuditPath, Type: "", Description: "file the audit trail is kept in"},
+		{Key: shared.KeyringSettingRotation, Type: time.Duration(0), Min: time.Duration(0),
+			Description: "age after which the keys are rotated"},
+	}
+}
+
+// SettingsChanged applies the updates of the rotation, the keys are opened on start
+func (s *keyringPlugin) SettingsChanged(previous shared.Settings) error {
+	changed := settings.Changed(previous, shared.KeyringSettingMasterKeyFile, shared.KeyringSettingPassphrase,
+		shared.KeyringSettingPath, shared.KeyringSettingAuditPath)
+	if len(changed) > 0 {
+		return fmt.Errorf("The keyring is opened on start, %s cannot change", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// Start method
+func (s *keyringPlugin) Start(done <-chan struct{}) {
+	s.SimplePlugin.Start(done)
+
+	if err := keys.open(); err != nil {
+		log.Printf("Cannot open the keyring: %v", err)
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(rotationCheck)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				// The rotation is read on every check so it can be updated at runtime
+				if rotation := settings.GetDuration(shared.KeyringSettingRotation, 0); rotation > 0 {
+					keys.rotateOlder(now.Add(-rotation))
+				}
+			}
+		}
+	}()
+}
+
+// Stop method
+func (s *keyringPlugin) Stop() {
+	keys.close()
+	s.SimplePlugin.Stop()
+}
+
+// BroadcastMessage sends the message to all clients
+func (s *keyringPlugin) HandleBroadcast(message interface{}) {
+	// Do nothing
+}
+
+// SendMessage sends the message to a specific client asynchronously
+func (s *keyringPlugin) HandleMessage(message interface{}) (<-chan interface{}, error) {
+	// The keys are only served through the RPC methods
+	return nil, errors.New("Invalid message")
+}
+
+// ServeRPC only serves identified callers, the keys of uuid.Nil would be shared by all the anonymous ones
+func (s *keyringPlugin) ServeRPC(request shared.RPCRequest) shared.RPCResponse {
+	if request.Caller == uuid.Nil {
+		return shared.RPCResponse{Error: shared.ErrNoSender.Error()}
+	}
+	return s.RPCServer.ServeRPC(request)
+}
+
+// masterKey reads the master key file or derives the master key from the passphrase, a persistent keyring needs one
+// of them
+func masterKey(inner shared.StorageBackend, persistent bool) ([]byte, error) {
+	if file := settings.GetString(shared.KeyringSettingMasterKeyFile, ""); file != "" {
+		return shared.LoadStorageKey(file)
+	}
+
+	if passphrase := settings.GetString(shared.KeyringSettingPassphrase, ""); passphrase != "" {
+		record, ok, err := inner.Get(saltKey)
+		if err != nil {
+			return nil, err
+		}
+
+		salt, _ := record.Value.([]byte)
+		if !ok {
+			salt = make([]byte, saltSize)
+			if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+				return nil, err
+			}
+			if err := inner.Put(shared.StorageRecord{Key: saltKey, Value: salt, Modified: time.Now()}); err != nil {
+				return nil, err
+			}
+		}
+		return shared.PBKDF2([]byte(passphrase), salt, iterations, shared.StorageKeySize, sha256.New), nil
+	}
+
+	if persistent {
+		return nil, errors.New("The keyring needs a master key file or a passphrase to persist its keys")
+	}
+
+	key := make([]byte, shared.StorageKeySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	return key, err
+}
+
+// open opens the sealed keys and the audit trail selected by the settings
+func (k *keyring) open() error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	path := settings.GetString(shared.KeyringSettingPath, "")
+	var inner shared.StorageBackend = shared.NewMemoryBackend()
+	if path != "" {
+		file, err := shared.OpenFileBackend(path)
+		if err != nil {
+			return err
+		}
+		inner = file
+	}
+
+	master, err := masterKey(inner, path != "")
+	if err != nil {
+		inner.Close()
+		return err
+	}
+
+	backend, err := shared.NewEncryptedBackend(inner, master)
+	if err != nil {
+		inner.Close()
+		return err
+	}
+
+	_, ok, err := backend.Get(checkKey)
+	if err == nil && !ok {
+		err = backend.Put(shared.StorageRecord{Key: checkKey, Value: "keyring", Modified: time.Now()})
+	} else if err == shared.ErrStorageCorrupted {
+		err = errors.New("The master key does not open the keyring")
+	}
+	if err != nil {
+		backend.Close()
+		return err
+	}
+
+	if auditPath := settings.GetString(shared.KeyringSettingAuditPath, ""); auditPath != "" {
+		if k.auditFile, err = openAudit(auditPath); err != nil {
+			backend.Close()
+			return err
+		}
+	}
+
+	k.backend = backend
+	return nil
+}
+
+// openAudit opens the audit file for appending, a truncated last record is dropped so the next ones can be read back
+func openAudit(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var end int64
+	for {
+		var entry shared.KeyAuditEntry
+		if err = shared.ReadRecord(f, &entry); err != nil {
+			break
+		}
+		if end, err = f.Seek(0, io.SeekCurrent); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if err != io.EOF {
+		log.Printf("Key audit trail %s is truncated: %v", path, err)
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// readAudit reads back the entries of the audit file, the mutex must be held
+func (k *keyring) readAudit() ([]shared.KeyAuditEntry, error) {
+	f, err := os.Open(k.auditFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []shared.KeyAuditEntry
+	r := bufio.NewReader(f)
+	for {
+		var entry shared.KeyAuditEntry
+		if err := shared.ReadRecord(r, &entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// close closes the keys and the audit trail
+func (k *keyring) close() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.backend != nil {
+		k.backend.Close()
+		k.backend = nil
+	}
+	if k.auditFile != nil {
+		k.auditFile.Close()
+		k.auditFile = nil
+	}
+}
+
+// record appends an operation to the audit trail, the mutex must be held
+func (k *keyring) record(caller uuid.UUID, owner uuid.UUID, name string, version int, action string, allowed bool) {
+	entry := shared.KeyAuditEntry{
+		Time:    time.Now(),
+		Caller:  caller,
+		Owner:   owner,
+		Name:    name,
+		Version: version,
+		Action:  action,
+		Allowed: allowed,
+	}
+
+	if !allowed {
+		log.Printf("Denied %s of key %s of %v to %v", action, name, owner, caller)
+	}
+
+	if k.auditFile == nil {
+		k.audit = append(k.audit, entry)
+		if len(k.audit) > auditHistory {
+			k.audit = k.audit[len(k.audit)-auditHistory:]
+		}
+		return
+	}
+
+	err := shared.WriteRecord(k.auditFile, entry)
+	if err == nil {
+		err = k.auditFile.Sync()
+	}
+	if err != nil {
+		log.Printf("Cannot write the key audit trail: %v", err)
+	}
+}
+
+// entryKey returns the backend key of a key of a namespace
+func entryKey(owner uuid.UUID, name string) string {
+	return "/" + owner.String() + "/" + name
+}
+
+// load returns a key, the mutex must be held
+func (k *keyring) load(owner uuid.UUID, name string) (*keyEntry, error) {
+	if k.backend == nil {
+		return nil, errors.New("The keyring is not open")
+	}
+
+	record, ok, err := k.backend.Get(entryKey(owner, name))
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, shared.ErrKeyNotFound
+	}
+
+	entry, ok := record.Value.(keyEntry)
+	if !ok {
+		return nil, fmt.Errorf("Invalid key %s", name)
+	}
+	return &entry, nil
+}
+
+// save stores a key, the mutex must be held
+func (k *keyring) save(owner uuid.UUID, name string, entry *keyEntry) error {
+	return k.backend.Put(shared.StorageRecord{Key: entryKey(owner, name), Value: *entry, Modified: time.Now()})
+}
+
+// generate creates the material of a new key
+func generate(keyType string) ([]byte, error) {
+	switch keyType {
+	case shared.KeyTypeEncryption:
+		key := make([]byte, 32)
+		_, err := io.ReadFull(rand.Reader, key)
+		return key, err
+	case shared.KeyTypeSigning:
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalECPrivateKey(private)
+	}
+	return nil, fmt.Errorf("Unknown key type %s", keyType)
+}
+
+// rotate adds a new current version to the key, the mutex must be held
+func (k *keyring) rotate(owner uuid.UUID, name string, entry *keyEntry) error {
+	material, err := generate(entry.Type)
+	if err != nil {
+		return err
+	}
+
+	entry.Versions = append(entry.Versions, keyVersion{Version: entry.current().Version + 1, Created: time.Now(), Material: material})
+	return k.save(owner, name, entry)
+}
+
+// rotateOlder rotates the keys whose current version was created before the time
+func (k *keyring) rotateOlder(before time.Time) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.backend == nil {
+		return
+	}
+
+	type named struct {
+		owner uuid.UUID
+		name  string
+		entry keyEntry
+	}
+
+	var old []named
+	err := k.backend.Scan("/", "0", func(record shared.StorageRecord) bool {
+		entry, ok := record.Value.(keyEntry)
+		parts := strings.SplitN(record.Key[1:], "/", 2)
+		owner, err := uuid.Parse(parts[0])
+		if ok && err == nil && len(parts) == 2 && entry.current().Created.Before(before) {
+			old = append(old, named{owner, parts[1], entry})
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Cannot scan the keys: %v", err)
+		return
+	}
+
+	for _, n := range old {
+		if err := k.rotate(n.owner, n.name, &n.entry); err != nil {
+			log.Printf("Cannot rotate the key %s of %v: %v", n.name, n.owner, err)
+			continue
+		}
+		k.record(shared.KeyringUUID, n.owner, n.name, n.entry.current().Version, shared.KeyActionRotate, true)
+	}
+}
+
+// Create creates a key in the namespace of the caller
+func (k *keyring) Create(caller uuid.UUID, args shared.KeyCreate, reply *shared.KeyInfo) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if args.Name == "" || strings.Contains(args.Name, "/") {
+		return fmt.Errorf("Invalid key name %s", args.Name)
+	}
+
+	if _, err := k.load(caller, args.Name); err == nil {
+		return shared.ErrKeyExists
+	} else if err != shared.ErrKeyNotFound {
+		return err
+	}
+
+	material, err := generate(args.Type)
+	if err != nil {
+		return err
+	}
+
+	entry := &keyEntry{Type: args.Type, Versions: []keyVersion{{Version: 1, Created: time.Now(), Material: material}}}
+	if err := k.save(caller, args.Name, entry); err != nil {
+		return err
+	}
+
+	k.record(caller, caller, args.Name, 1, shared.KeyActionCreate, true)
+	*reply = entry.info(caller, args.Name)
+	return nil
+}
+
+// Rotate adds a new current version to a key of the caller
+func (k *keyring) Rotate(caller uuid.UUID, ref shared.KeyRef, reply *shared.KeyInfo) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if ref.Owner != uuid.Nil && ref.Owner != caller {
+		k.record(caller, ref.Owner, ref.Name, 0, shared.KeyActionRotate, false)
+		return shared.ErrKeyAccessDenied
+	}
+
+	entry, err := k.load(caller, ref.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := k.rotate(caller, ref.Name, entry); err != nil {
+		return err
+	}
+
+	k.record(caller, caller, ref.Name, entry.current().Version, shared.KeyActionRotate, true)
+	*reply = entry.info(caller, ref.Name)
+	return nil
+}
+
+// Get serves a version of a key owned by or shared with the caller
+func (k *keyring) Get(caller uuid.UUID, ref shared.KeyRef, reply *shared.Key) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	owner := ref.Owner
+	if owner == uuid.Nil {
+		owner = caller
+	}
+
+	entry, err := k.load(owner, ref.Name)
+	if err == shared.ErrKeyNotFound && owner != caller {
+		// Missing keys are denied too so their names are not disclosed
+		err = shared.ErrKeyAccessDenied
+	} else if err == nil && !entry.allowed(caller, owner) {
+		err = shared.ErrKeyAccessDenied
+	}
+
+	if err == shared.ErrKeyAccessDenied {
+		k.record(caller, owner, ref.Name, ref.Version, shared.KeyActionGet, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	v, ok := entry.version(ref.Version)
+	if !ok {
+		return shared.ErrKeyNotFound
+	}
+
+	k.record(caller, owner, ref.Name, v.Version, shared.KeyActionGet, true)
+	*reply = shared.Key{Owner: owner, Name: ref.Name, Type: entry.Type, Version: v.Version, Created: v.Created, Material: v.Material}
+	return nil
+}
+
+// PublicKey serves the public key of a version of a signing key owned by or shared with the caller
+func (k *keyring) PublicKey(caller uuid.UUID, ref shared.KeyRef, reply *[]byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	owner := ref.Owner
+	if owner == uuid.Nil {
+		owner = caller
+	}
+
+	entry, err := k.load(owner, ref.Name)
+	if err == shared.ErrKeyNotFound && owner != caller {
+		// Missing keys are denied too so their names are not disclosed
+		err = shared.ErrKeyAccessDenied
+	} else if err == nil && !entry.allowed(caller, owner) {
+		err = shared.ErrKeyAccessDenied
+	}
+
+	if err == shared.ErrKeyAccessDenied {
+		k.record(caller, owner, ref.Name, ref.Version, shared.KeyActionPublic, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	v, ok := entry.version(ref.Version)
+	if !ok || entry.Type != shared.KeyTypeSigning {
+		return shared.ErrKeyNotFound
+	}
+
+	private, err := x509.ParseECPrivateKey(v.Material)
+	if err != nil {
+		return err
+	}
+
+	if *reply, err = x509.MarshalPKIXPublicKey(&private.PublicKey); err != nil {
+		return err
+	}
+
+	k.record(caller, owner, ref.Name, v.Version, shared.KeyActionPublic, true)
+	return nil
+}
+
+// Share allows or forbids another plugin to use a key of the caller
+func (k *keyring) Share(caller uuid.UUID, args shared.KeyShare, reply *shared.KeyInfo) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	entry, err := k.load(caller, args.Name)
+	if err != nil {
+		return err
+	}
+
+	var grantees []uuid.UUID
+	for _, g := range entry.Grantees {
+		if g != args.Grantee {
+			grantees = append(grantees, g)
+		}
+	}
+	if args.Allow {
+		grantees = append(grantees, args.Grantee)
+	}
+	entry.Grantees = grantees
+
+	if err := k.save(caller, args.Name, entry); err != nil {
+		return err
+	}
+
+	k.record(caller, caller, args.Name, 0, shared.KeyActionShare, true)
+	*reply = entry.info(caller, args.Name)
+	return nil
+}
+
+// List returns the keys of the owner the caller can use, of all the owners if uuid.Nil
+func (k *keyring) List(caller uuid.UUID, owner uuid.UUID, reply *[]shared.KeyInfo) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.backend == nil {
+		return errors.New("The keyring is not open")
+	}
+
+	start, end := "/", "0"
+	if owner != uuid.Nil {
+		start, end = entryKey(owner, ""), entryKey(owner, "\xff")
+	}
+
+	infos := []shared.KeyInfo{}
+	err := k.backend.Scan(start, end, func(record shared.StorageRecord) bool {
+		entry, ok := record.Value.(keyEntry)
+		parts := strings.SplitN(record.Key[1:], "/", 2)
+		keyOwner, err := uuid.Parse(parts[0])
+		if ok && err == nil && len(parts) == 2 && entry.allowed(caller, keyOwner) {
+			infos = append(infos, entry.info(keyOwner, parts[1]))
+		}
+		return true
+	})
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Owner != infos[j].Owner {
+			return infos[i].Owner.String() < infos[j].Owner.String()
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	*reply = infos
+	return err
+}
+
+// Audit returns the last operations on the keys of the caller, on all the keys for the host
+func (k *keyring) Audit(caller uuid.UUID, limit int, reply *[]shared.KeyAuditEntry) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	audit := k.audit
+	if k.auditFile != nil {
+		var err error
+		if audit, err = k.readAudit(); err != nil {
+			return err
+		}
+	}
+
+	entries := []shared.KeyAuditEntry{}
+	for _, entry := range audit {
+		if caller == shared.HostUUID || entry.Owner == caller {
+			entries = append(entries, entry)
+		}
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	*reply = entries
+	return nil
+}
+
+func init() {
+	// The keys are stored in interfaces, the name must stay stable for the keyring files
+	gob.RegisterName("keyring.keyEntry", keyEntry{})
+}
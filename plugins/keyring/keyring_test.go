@@ -0,0 +1,249 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/m4rs14n/go-app/shared"
+)
+
+// configure sets the settings of the keyring, the previous ones are restored by the returned function
+func configure(values shared.Settings) func() {
+	previous := settings.Copy()
+	for key, value := range values {
+		settings[key] = value
+	}
+	return func() {
+		for key := range values {
+			delete(settings, key)
+		}
+		for key, value := range previous {
+			settings[key] = value
+		}
+	}
+}
+
+// openKeyring opens a keyring with the current settings
+func openKeyring(t *testing.T) *keyring {
+	k := &keyring{}
+	if err := k.open(); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestCreateRotateGet(t *testing.T) {
+	k := openKeyring(t)
+	defer k.close()
+
+	owner := uuid.New()
+	var info shared.KeyInfo
+	if err := k.Create(owner, shared.KeyCreate{Name: "data", Type: shared.KeyTypeEncryption}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Owner != owner || info.Version != 1 {
+		t.Fatalf("Unexpected key %+v", info)
+	}
+	if err := k.Create(owner, shared.KeyCreate{Name: "data", Type: shared.KeyTypeEncryption}, &info); err != shared.ErrKeyExists {
+		t.Fatalf("Expected %v, got %v", shared.ErrKeyExists, err)
+	}
+
+	var first shared.Key
+	if err := k.Get(owner, shared.KeyRef{Name: "data"}, &first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.Rotate(owner, shared.KeyRef{Name: "data"}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 2 {
+		t.Fatalf("Expected version 2, got %d", info.Version)
+	}
+
+	var current, old shared.Key
+	if err := k.Get(owner, shared.KeyRef{Name: "data"}, &current); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Get(owner, shared.KeyRef{Name: "data", Version: 1}, &old); err != nil {
+		t.Fatal(err)
+	}
+	if current.Version != 2 || bytes.Equal(current.Material, first.Material) {
+		t.Fatalf("The current version was not rotated: %d", current.Version)
+	}
+	if old.Version != 1 || !bytes.Equal(old.Material, first.Material) {
+		t.Fatalf("The first version was not kept: %d", old.Version)
+	}
+}
+
+func TestShareAndDeny(t *testing.T) {
+	k := openKeyring(t)
+	defer k.close()
+
+	owner, other := uuid.New(), uuid.New()
+	var info shared.KeyInfo
+	if err := k.Create(owner, shared.KeyCreate{Name: "sign", Type: shared.KeyTypeSigning}, &info); err != nil {
+		t.Fatal(err)
+	}
+
+	var key shared.Key
+	var public []byte
+	ref := shared.KeyRef{Owner: owner, Name: "sign"}
+	missing := shared.KeyRef{Owner: owner, Name: "missing"}
+	if err := k.Get(other, ref, &key); err != shared.ErrKeyAccessDenied {
+		t.Fatalf("Expected %v, got %v", shared.ErrKeyAccessDenied, err)
+	}
+	if err := k.Get(other, missing, &key); err != shared.ErrKeyAccessDenied {
+		t.Fatalf("Expected %v for a missing key, got %v", shared.ErrKeyAccessDenied, err)
+	}
+	if err := k.PublicKey(other, ref, &public); err != shared.ErrKeyAccessDenied {
+		t.Fatalf("Expected %v, got %v", shared.ErrKeyAccessDenied, err)
+	}
+	if err := k.PublicKey(other, missing, &public); err != shared.ErrKeyAccessDenied {
+		t.Fatalf("Expected %v for a missing key, got %v", shared.ErrKeyAccessDenied, err)
+	}
+	if err := k.Rotate(other, ref, &info); err != shared.ErrKeyAccessDenied {
+		t.Fatalf("Expected %v, got %v", shared.ErrKeyAccessDenied, err)
+	}
+
+	if err := k.Share(owner, shared.KeyShare{Name: "sign", Grantee: other, Allow: true}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Get(other, ref, &key); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.PublicKey(other, ref, &public); err != nil || len(public) == 0 {
+		t.Fatalf("Cannot get the public key of a shared key: %v", err)
+	}
+	if err := k.Rotate(other, ref, &info); err != shared.ErrKeyAccessDenied {
+		t.Fatalf("Expected %v, only the owner rotates, got %v", shared.ErrKeyAccessDenied, err)
+	}
+
+	if err := k.Share(owner, shared.KeyShare{Name: "sign", Grantee: other, Allow: false}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Get(other, ref, &key); err != shared.ErrKeyAccessDenied {
+		t.Fatalf("Expected %v once unshared, got %v", shared.ErrKeyAccessDenied, err)
+	}
+
+	var entries []shared.KeyAuditEntry
+	if err := k.Audit(owner, 0, &entries); err != nil {
+		t.Fatal(err)
+	}
+	denied := 0
+	for _, entry := range entries {
+		if entry.Owner != owner {
+			t.Fatalf("The audit of the owner has an entry of %v", entry.Owner)
+		}
+		if !entry.Allowed {
+			denied++
+		}
+	}
+	if denied != 7 {
+		t.Fatalf("Expected 7 denied operations, got %d", denied)
+	}
+
+	if err := k.Audit(other, 0, &entries); err != nil || len(entries) != 0 {
+		t.Fatalf("The audit of the keys of the owner is served to another plugin: %d entries, %v", len(entries), err)
+	}
+}
+
+func TestPassphraseReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	restore := configure(shared.Settings{
+		shared.KeyringSettingPath:       filepath.Join(dir, "keys"),
+		shared.KeyringSettingAuditPath:  filepath.Join(dir, "audit"),
+		shared.KeyringSettingPassphrase: shared.Secret("correct horse"),
+	})
+	defer restore()
+
+	owner := uuid.New()
+	k := openKeyring(t)
+	var info shared.KeyInfo
+	if err := k.Create(owner, shared.KeyCreate{Name: "data", Type: shared.KeyTypeEncryption}, &info); err != nil {
+		t.Fatal(err)
+	}
+	var key shared.Key
+	if err := k.Get(owner, shared.KeyRef{Name: "data"}, &key); err != nil {
+		t.Fatal(err)
+	}
+	k.close()
+
+	// A crash in the middle of an audit record leaves a truncated last record
+	f, err := os.OpenFile(filepath.Join(dir, "audit"), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1})
+	f.Close()
+
+	k = openKeyring(t)
+	var reopened shared.Key
+	if err := k.Get(owner, shared.KeyRef{Name: "data"}, &reopened); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.Material, key.Material) {
+		t.Fatal("The reopened key is not the stored one")
+	}
+
+	var entries []shared.KeyAuditEntry
+	if err := k.Audit(shared.HostUUID, 0, &entries); err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	expected := []string{shared.KeyActionCreate, shared.KeyActionGet, shared.KeyActionGet}
+	if len(actions) != len(expected) {
+		t.Fatalf("Expected the audit trail %v, got %v", expected, actions)
+	}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Fatalf("Expected the audit trail %v, got %v", expected, actions)
+		}
+	}
+	k.close()
+
+	settings[shared.KeyringSettingPassphrase] = shared.Secret("wrong horse")
+	k = &keyring{}
+	if err := k.open(); err == nil {
+		k.close()
+		t.Fatal("The keyring was opened with a wrong master key")
+	}
+}
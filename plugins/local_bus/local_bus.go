@@ -29,6 +29,8 @@ package main
 
 import (
 	"errors"
+	"log"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/m4rs14n/go-app/shared"
@@ -37,6 +39,19 @@ import (
 var id = uuid.MustParse("B49A64D6-8F06-4053-9E30-F5A237EE208A")
 var settings = shared.SetupSettings(id, "LocalBus", "This is a bus plugin")
 
+// Manifest describes the plugin to the loader
+var Manifest = shared.PluginManifest{
+	Name:         "LocalBus",
+	Version:      "1.0.0",
+	APIVersion:   shared.SharedAPIVersion,
+	Author:       "Hojat Parta",
+	Capabilities: []string{shared.CapabilityBus},
+}
+
+func init() {
+	settings[shared.BusSettingPriority] = 0
+}
+
 // bus is the Bus Plugin
 type localBus struct {
 	shared.SimplePlugin
@@ -45,6 +60,8 @@ type localBus struct {
 // Make sure we implement required interfaces
 var _ shared.PluginListener = (*localBus)(nil)
 var _ shared.BusService = (*localBus)(nil)
+var _ shared.SubscriberBus = (*localBus)(nil)
+var _ shared.SettingsSchema = (*localBus)(nil)
 
 var instance = &localBus{
 	shared.SimplePlugin{Settings: settings},
@@ -55,35 +72,187 @@ func NewPlugin() (shared.Plugin, error) {
 	return instance, nil
 }
 
-// TODO: Synchronize access to this data structure
+// Schema declares the settings of the plugin
+func (s *localBus) Schema() []shared.SettingSpec {
+	return shared.BusSchema
+}
+
 var endpoints = make(map[uuid.UUID]shared.Endpoint)
 
+// aliases are the other uuids of the endpoints
+var aliases = make(map[uuid.UUID]uuid.UUID)
+
+// deliveries keeps the broadcasts of each endpoint in order for the ordered modes
+var deliveries = make(map[uuid.UUID]*shared.DeliveryQueue)
+var endpointsMutex sync.RWMutex
+
+// sequencer hands the broadcasts to the endpoint queues one at a time in the total ordering mode, they reach every
+// endpoint queue in the same order without a lock held while a full queue makes them wait
+var sequencer = shared.NewDeliveryQueue(shared.DefaultDeliveryBuffer)
+
+// subscription buffers the publications of a subscriber
+type subscription struct {
+	subscriber shared.Subscriber
+	queue      *shared.DeliveryQueue
+}
+
+var subscriptions = make(map[uuid.UUID]subscription)
+var subscriptionsMutex sync.RWMutex
+
 // PluginLoaded allows the plugin to check if a loaded plugin is of any interest
 func (b *localBus) PluginLoaded(plugin shared.Plugin) {
 	if endpoint, ok := plugin.(shared.Endpoint); ok {
+		endpointsMutex.Lock()
 		endpoints[plugin.GetSettings().ID()] = endpoint
+		deliveries[plugin.GetSettings().ID()] = shared.NewDeliveryQueue(shared.DefaultDeliveryBuffer)
+		if aliased, ok := plugin.(shared.AliasedEndpoint); ok {
+			for _, alias := range aliased.Aliases() {
+				aliases[alias] = plugin.GetSettings().ID()
+			}
+		}
+		endpointsMutex.Unlock()
 	}
+
+	if subscriber, ok := plugin.(shared.Subscriber); ok {
+		subscriptionsMutex.Lock()
+		subscriptions[plugin.GetSettings().ID()] = subscription{
+			subscriber: subscriber,
+			queue:      shared.NewDeliveryQueue(shared.SubscriberBuffer(b.Settings)),
+		}
+		subscriptionsMutex.Unlock()
+	}
+}
+
+// Start method
+func (b *localBus) Start(done <-chan struct{}) {
+	b.SimplePlugin.Start(done)
+
+	if err := shared.OpenBusDeliveryLog(b.Settings); err != nil {
+		log.Printf("Cannot open the delivery log: %v", err)
+	}
+}
+
+// Stop method
+func (b *localBus) Stop() {
+	sequencer.Close()
+
+	endpointsMutex.Lock()
+	for _, queue := range deliveries {
+		queue.Close()
+	}
+	endpointsMutex.Unlock()
+
+	subscriptionsMutex.Lock()
+	for _, s := range subscriptions {
+		s.queue.Close()
+	}
+	subscriptionsMutex.Unlock()
+	b.SimplePlugin.Stop()
 }
 
 // GetPriority returns the priority of the bus
 func (b *localBus) Priority() int {
-	return 0
+	return b.Settings.GetInt(shared.BusSettingPriority, 0)
 }
 
 // BroadcastMessage sends the message to all clients
 func (b *localBus) HandleBroadcast(message interface{}) {
-	for _, endpoint := range endpoints {
-		go func(endpoint shared.Endpoint, message interface{}) {
-			endpoint.HandleBroadcast(message)
-		}(endpoint, message)
+	ordering := shared.BusOrdering(b.Settings)
+
+	// A full queue blocks the push, the endpoints must not stay locked meanwhile
+	type target struct {
+		endpoint shared.Endpoint
+		queue    *shared.DeliveryQueue
+	}
+	endpointsMutex.RLock()
+	targets := make([]target, 0, len(endpoints))
+	for id, endpoint := range endpoints {
+		targets = append(targets, target{endpoint, deliveries[id]})
+	}
+	endpointsMutex.RUnlock()
+
+	if ordering == shared.BusOrderingNone {
+		for _, t := range targets {
+			go t.endpoint.HandleBroadcast(message)
+		}
+		return
+	}
+
+	push := func() {
+		for _, t := range targets {
+			endpoint := t.endpoint
+			t.queue.PushWait(func() { endpoint.HandleBroadcast(message) })
+		}
+	}
+
+	if ordering == shared.BusOrderingTotal {
+		sequencer.PushWait(push)
+	} else {
+		push()
+	}
+}
+
+// HandlePublish sends the message to the subscribers of the topic
+func (b *localBus) HandlePublish(topic string, message interface{}) {
+	b.HandlePublishTo(b.Subscribers(topic), topic, message)
+}
+
+// Subscribers returns the subscribers of the topic
+func (b *localBus) Subscribers(topic string) []uuid.UUID {
+	subscriptionsMutex.RLock()
+	defer subscriptionsMutex.RUnlock()
+
+	var ids []uuid.UUID
+	for id, s := range subscriptions {
+		if shared.MatchAnyTopic(s.subscriber.Subscriptions(), topic) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// HandlePublishTo sends the message to some subscribers of the topic
+func (b *localBus) HandlePublishTo(subscribers []uuid.UUID, topic string, message interface{}) {
+	subscriptionsMutex.RLock()
+	defer subscriptionsMutex.RUnlock()
+
+	for _, id := range subscribers {
+		s, ok := subscriptions[id]
+		if !ok {
+			continue
+		}
+
+		subscriber := s.subscriber
+		if !s.queue.Push(func() { subscriber.HandlePublish(topic, message) }) {
+			log.Printf("Subscriber %v is full, dropping message on %s", id, topic)
+		}
 	}
 }
 
 // SendMessage sends the message to a specific client asynchronously
 func (b *localBus) HandleMessage(uuid uuid.UUID, message interface{}) (<-chan interface{}, error) {
-	if endpoint, ok := endpoints[uuid]; ok {
-		return endpoint.HandleMessage(message)
+	endpointsMutex.RLock()
+	endpoint, ok := endpoints[uuid]
+	if id, aliased := aliases[uuid]; aliased && !ok {
+		endpoint, ok = endpoints[id]
+	}
+	endpointsMutex.RUnlock()
+
+	if ok {
+		return shared.DispatchMessage(endpoint, message)
 	}
 
 	return nil, errors.New("Invalid endpoint")
 }
+
+// Endpoints returns the endpoints reachable through the bus
+func (b *localBus) Endpoints() []uuid.UUID {
+	endpointsMutex.RLock()
+	defer endpointsMutex.RUnlock()
+
+	ids := make([]uuid.UUID, 0, len(endpoints))
+	for id := range endpoints {
+		ids = append(ids, id)
+	}
+	return ids
+}
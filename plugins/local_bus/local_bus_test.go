@@ -0,0 +1,405 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/m4rs14n/go-app/shared"
+)
+
+const orderedBroadcasts = 5000
+
+// recorder is an endpoint remembering the broadcasts it received
+type recorder struct {
+	shared.SimplePlugin
+	mutex    sync.Mutex
+	received []int
+}
+
+func newRecorder() *recorder {
+	return &recorder{SimplePlugin: shared.SimplePlugin{Settings: shared.SetupSettings(uuid.New(), "Recorder", "")}}
+}
+
+func (r *recorder) HandleBroadcast(message interface{}) {
+	r.mutex.Lock()
+	r.received = append(r.received, message.(int))
+	r.mutex.Unlock()
+}
+
+func (r *recorder) HandleMessage(message interface{}) (<-chan interface{}, error) {
+	return nil, nil
+}
+
+func (r *recorder) wait(t *testing.T, count int) []int {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mutex.Lock()
+		n := len(r.received)
+		r.mutex.Unlock()
+		if n >= count {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.received) != count {
+		t.Fatalf("Received %d broadcasts out of %d", len(r.received), count)
+	}
+	return append([]int(nil), r.received...)
+}
+
+// withOrdering sets the ordering of the bus and returns a function restoring the previous one
+func withOrdering(ordering string) func() {
+	previous, had := settings[shared.BusSettingOrdering]
+	settings[shared.BusSettingOrdering] = ordering
+	return func() {
+		if had {
+			settings[shared.BusSettingOrdering] = previous
+		} else {
+			delete(settings, shared.BusSettingOrdering)
+		}
+	}
+}
+
+func unload(p shared.Plugin) {
+	endpointsMutex.Lock()
+	defer endpointsMutex.Unlock()
+
+	id := p.GetSettings().ID()
+	deliveries[id].Close()
+	delete(deliveries, id)
+	delete(endpoints, id)
+}
+
+func TestBroadcastFIFO(t *testing.T) {
+	defer withOrdering(shared.BusOrderingFIFO)()
+
+	r := newRecorder()
+	instance.PluginLoaded(r)
+	defer unload(r)
+
+	for i := 0; i < orderedBroadcasts; i++ {
+		instance.HandleBroadcast(i)
+	}
+
+	for i, n := range r.wait(t, orderedBroadcasts) {
+		if n != i {
+			t.Fatalf("Broadcast %d delivered at position %d", n, i)
+		}
+	}
+}
+
+func TestBroadcastTotal(t *testing.T) {
+	defer withOrdering(shared.BusOrderingTotal)()
+
+	a, b := newRecorder(), newRecorder()
+	instance.PluginLoaded(a)
+	instance.PluginLoaded(b)
+	defer unload(a)
+	defer unload(b)
+
+	// Concurrent senders, every endpoint must see the same sequence
+	var wg sync.WaitGroup
+	for s := 0; s < 4; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := s; i < orderedBroadcasts; i += 4 {
+				instance.HandleBroadcast(i)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	first, second := a.wait(t, orderedBroadcasts), b.wait(t, orderedBroadcasts)
+	last := make([]int, 4)
+	for i := range last {
+		last[i] = -1
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Endpoints disagree at position %d: %d and %d", i, first[i], second[i])
+		}
+		// Each sender is still delivered in order
+		if n := first[i]; n <= last[n%4] {
+			t.Fatalf("Broadcast %d delivered after %d", n, last[n%4])
+		} else {
+			last[n%4] = n
+		}
+	}
+}
+
+// blocker is an endpoint whose broadcasts wait until it is released
+type blocker struct {
+	*recorder
+	release chan struct{}
+}
+
+func (b *blocker) HandleBroadcast(message interface{}) {
+	<-b.release
+}
+
+func TestFullQueueDoesNotLockEndpoints(t *testing.T) {
+	defer withOrdering(shared.BusOrderingFIFO)()
+
+	b := &blocker{recorder: newRecorder(), release: make(chan struct{})}
+	instance.PluginLoaded(b)
+	defer unload(b.recorder)
+
+	// Fill the queue of the endpoint until the broadcasts block
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < shared.DefaultDeliveryBuffer+2; i++ {
+			instance.HandleBroadcast(i)
+		}
+		close(sent)
+	}()
+
+	// Give the broadcasts the time to fill the queue
+	time.Sleep(200 * time.Millisecond)
+
+	loaded := make(chan struct{})
+	r := newRecorder()
+	go func() {
+		instance.PluginLoaded(r)
+		close(loaded)
+	}()
+
+	select {
+	case <-loaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Loading an endpoint waited for a full delivery queue")
+	}
+
+	close(b.release)
+	<-sent
+	unload(r)
+}
+
+// echo is an endpoint broadcasting again the first broadcasts it receives, once released
+type echo struct {
+	*recorder
+	release chan struct{}
+}
+
+func (e *echo) HandleBroadcast(message interface{}) {
+	<-e.release
+	e.recorder.HandleBroadcast(message)
+	if n := message.(int); n >= 0 && n < echoes {
+		instance.HandleBroadcast(-n - 1)
+	}
+}
+
+const echoes = 100
+
+func TestTotalRebroadcastFromHandler(t *testing.T) {
+	defer withOrdering(shared.BusOrderingTotal)()
+
+	e := &echo{recorder: newRecorder(), release: make(chan struct{})}
+	instance.PluginLoaded(e)
+	defer unload(e.recorder)
+
+	// Fill the queue of the endpoint so the sender waits for it
+	broadcasts := shared.DefaultDeliveryBuffer + 10
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < broadcasts; i++ {
+			instance.HandleBroadcast(i)
+		}
+		close(sent)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	close(e.release)
+
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The sender waited for an endpoint broadcasting again")
+	}
+	e.wait(t, broadcasts+echoes)
+}
+
+// listener is a subscriber remembering the topics of the messages published to it
+type listener struct {
+	shared.SimplePlugin
+	patterns []string
+	mutex    sync.Mutex
+	topics   []string
+}
+
+func newListener(patterns ...string) *listener {
+	return &listener{SimplePlugin: shared.SimplePlugin{Settings: shared.SetupSettings(uuid.New(), "Listener", "")}, patterns: patterns}
+}
+
+func (l *listener) Subscriptions() []string {
+	return l.patterns
+}
+
+func (l *listener) HandlePublish(topic string, message interface{}) {
+	l.mutex.Lock()
+	l.topics = append(l.topics, topic)
+	l.mutex.Unlock()
+}
+
+// received waits for the count publications, then a while for the unexpected ones
+func (l *listener) received(count int) []string {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mutex.Lock()
+		n := len(l.topics)
+		l.mutex.Unlock()
+		if n >= count {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.topics...)
+}
+
+func unsubscribe(l *listener) {
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	id := l.GetSettings().ID()
+	subscriptions[id].queue.Close()
+	delete(subscriptions, id)
+}
+
+func TestPublishWildcard(t *testing.T) {
+	one, all := newListener("storage/+/changed"), newListener("storage/#")
+	instance.PluginLoaded(one)
+	instance.PluginLoaded(all)
+	defer unsubscribe(one)
+	defer unsubscribe(all)
+
+	for _, topic := range []string{"storage/a/changed", "storage/a/b/changed", "other/a/changed"} {
+		instance.HandlePublish(topic, "value")
+	}
+
+	if topics := one.received(1); len(topics) != 1 || topics[0] != "storage/a/changed" {
+		t.Fatalf("Single level wildcard received %v", topics)
+	}
+	if topics := all.received(2); len(topics) != 2 {
+		t.Fatalf("Multi level wildcard received %v", topics)
+	}
+}
+
+// calculator is an endpoint serving the methods of calc
+type calculator struct {
+	shared.SimplePlugin
+	shared.RPCServer
+}
+
+func newCalculator(t *testing.T) *calculator {
+	c := &calculator{SimplePlugin: shared.SimplePlugin{Settings: shared.SetupSettings(uuid.New(), "Calculator", "")}}
+	if err := c.RegisterName("Calc", calc{}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *calculator) HandleBroadcast(message interface{}) {}
+
+func (c *calculator) HandleMessage(message interface{}) (<-chan interface{}, error) {
+	return nil, errors.New("Not an RPC request")
+}
+
+type calc struct{}
+
+type addArgs struct {
+	A, B int
+}
+
+func (calc) Add(args addArgs, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func (calc) Caller(caller uuid.UUID, args int, reply *uuid.UUID) error {
+	*reply = caller
+	return nil
+}
+
+func (calc) Fail(args int, reply *int) error {
+	return errors.New("Failed")
+}
+
+func (calc) Panic(args int, reply *int) error {
+	panic("broken")
+}
+
+func TestRPCRoundTrip(t *testing.T) {
+	c := newCalculator(t)
+	instance.PluginLoaded(c)
+	defer unload(c)
+
+	b, err := shared.NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.PluginLoaded(instance)
+	id := c.GetSettings().ID()
+
+	var sum int
+	if err := b.Call(id, "Calc.Add", addArgs{A: 2, B: 3}, &sum); err != nil || sum != 5 {
+		t.Fatalf("Add returned %d %v", sum, err)
+	}
+
+	var caller uuid.UUID
+	if err := b.Call(id, "Calc.Caller", 0, &caller); err != nil || caller != shared.HostUUID {
+		t.Fatalf("Caller returned %v %v", caller, err)
+	}
+
+	if err := b.Call(id, "Calc.Fail", 0, &sum); err == nil || err.Error() != "Failed" {
+		t.Fatalf("Fail returned %v", err)
+	}
+
+	// The bus keeps serving after a method panics
+	if err := b.Call(id, "Calc.Panic", 0, &sum); err == nil {
+		t.Fatal("Panic returned no error")
+	}
+	if err := b.Call(id, "Calc.Add", addArgs{A: 1, B: 1}, &sum); err != nil || sum != 2 {
+		t.Fatalf("Add after a panic returned %d %v", sum, err)
+	}
+
+	if err := b.Call(id, "Calc.Missing", 0, &sum); err == nil {
+		t.Fatal("Unknown method returned no error")
+	}
+}
@@ -35,6 +35,15 @@ import (
 var id = uuid.MustParse("6774B374-6136-4F7B-AF24-3F11BBA9F28B")
 var settings = shared.SetupSettings(id, "MyPlugin", "This is a sample plugin")
 
+// Manifest describes the plugin to the loader
+var Manifest = shared.PluginManifest{
+	Name:         "MyPlugin",
+	Version:      "1.0.0",
+	APIVersion:   shared.SharedAPIVersion,
+	Author:       "Hojat Parta",
+	Dependencies: []shared.PluginDependency{{Name: "UnencryptedStorage"}},
+}
+
 // myPlugin is my Kinda Plugin
 type myPlugin struct {
 	shared.SimplePlugin
@@ -35,15 +35,26 @@ import (
 var id = uuid.MustParse("CDFA9BD5-551E-4E29-B4D2-FA51C2559331")
 var settings = shared.SetupSettings(id, "MyService", "This is a sample service")
 
+// Manifest describes the plugin to the loader
+var Manifest = shared.PluginManifest{
+	Name:         "MyService",
+	Version:      "1.0.0",
+	APIVersion:   shared.SharedAPIVersion,
+	Author:       "Hojat Parta",
+	Dependencies: []shared.PluginDependency{{Name: "UnencryptedStorage"}, {Name: "EncryptedStorage"}},
+}
+
 // myPlugin is my Kinda Plugin
 type myService struct {
 	shared.SimplePlugin
 	shared.UseStorage
+	shared.UseSecrets
 }
 
 var instance = &myService{
 	shared.SimplePlugin{Settings: settings},
 	shared.UseStorage{UUID: shared.UnencryptedStorageUUID},
+	shared.UseSecrets{},
 }
 
 // NewPlugin returns an instance of the plugin
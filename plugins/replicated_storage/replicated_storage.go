@@ -0,0 +1,1318 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/m4rs14n/go-app/shared"
+)
+
+// Every process runs its own replica, the replicas reach each other with their node id, which is also the id of the
+// plugin, and the plugins reach the replica of their process with shared.ReplicatedStorageUUID. The id set here is
+// replaced by the node id once the settings are configured.
+var settings = shared.SetupSettings(uuid.New(), "ReplicatedStorage", "This is a storage plugin replicated across processes")
+
+// Manifest describes the plugin to the loader
+var Manifest = shared.PluginManifest{
+	Name:         "ReplicatedStorage",
+	Version:      "1.0.0",
+	APIVersion:   shared.SharedAPIVersion,
+	Author:       "Hojat Parta",
+	Capabilities: []string{shared.CapabilityStorage, shared.CapabilityReplicatedStorage},
+}
+
+const (
+	heartbeatInterval = 100 * time.Millisecond
+	// electionTimeout is randomized up to twice its value so that the replicas do not all run at once
+	electionTimeout = 500 * time.Millisecond
+	rpcTimeout      = time.Second
+	// retryInterval is the time the leader waits before sending again to a replica it could not reach
+	retryInterval  = time.Second
+	proposeTimeout = 5 * time.Second
+
+	// maxLogEntries is the length of the log before the applied entries are replaced by a snapshot
+	maxLogEntries = 1000
+	// maxAppendEntries is the number of entries sent at once to a follower
+	maxAppendEntries = 256
+)
+
+const (
+	roleFollower = iota
+	roleCandidate
+	roleLeader
+)
+
+const (
+	entryNoop = iota
+	entryMessage
+	entryExpire
+)
+
+var (
+	errNotLeader     = errors.New("Replica is not the leader")
+	errNotMember     = errors.New("Caller is not a replica of the cluster")
+	errLeaderChanged = errors.New("Leader changed before the write was committed")
+	errRPCTimeout    = errors.New("Replica did not answer in time")
+)
+
+// logEntry is a change of the storage, the replicas apply the same entries in the same order
+type logEntry struct {
+	Index   uint64
+	Term    uint64
+	Kind    int
+	Caller  uuid.UUID
+	Message shared.StorageMessage
+	Time    time.Time
+}
+
+type voteArgs struct {
+	Term      uint64
+	Candidate uuid.UUID
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type voteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type appendArgs struct {
+	Term      uint64
+	Leader    uuid.UUID
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []logEntry
+	Commit    uint64
+}
+
+type appendReply struct {
+	Term    uint64
+	Success bool
+	// Match is the last index known to match the leader, Hint the next index to try on failure
+	Match uint64
+	Hint  uint64
+}
+
+type snapshotArgs struct {
+	Term     uint64
+	Leader   uuid.UUID
+	Index    uint64
+	LastTerm uint64
+	Archive  shared.StorageArchive
+}
+
+type snapshotReply struct {
+	Term  uint64
+	Match uint64
+}
+
+type proposeArgs struct {
+	Caller  uuid.UUID
+	Message shared.StorageMessage
+}
+
+type proposeReply struct {
+	Index  uint64
+	Result interface{}
+}
+
+// proposal waits for an entry appended by the leader to be applied
+type proposal struct {
+	term uint64
+	done chan proposalResult
+}
+
+type proposalResult struct {
+	result interface{}
+	err    error
+}
+
+// transport sends the requests of a replica to the other ones
+type transport interface {
+	send(peer uuid.UUID, method string, args interface{}, reply interface{}) error
+}
+
+// replica keeps the raft state, its exported methods are served to the other replicas
+type replica struct {
+	mutex sync.Mutex
+
+	// id is the node id of the replica, peers are the other members of the cluster
+	id        uuid.UUID
+	peers     []uuid.UUID
+	engine    *shared.StorageEngine
+	transport transport
+	// store keeps the term, the vote and the log across restarts, they are only in memory when it is nil
+	store *replicaStore
+	// spawn runs the requests to the other replicas, now and timeouts give the time and the election timeouts
+	spawn    func(f func())
+	now      func() time.Time
+	timeouts func() time.Duration
+
+	term     uint64
+	votedFor uuid.UUID
+	role     int
+	leader   uuid.UUID
+	votes    int
+
+	// log holds the entries after the snapshot, log[i] has the index snapshotIndex+1+i
+	log           []logEntry
+	snapshot      shared.StorageArchive
+	snapshotIndex uint64
+	snapshotTerm  uint64
+
+	commitIndex uint64
+	lastApplied uint64
+	// applied is closed and replaced every time entries are applied
+	applied  chan struct{}
+	pending  map[uint64]*proposal
+	expiring bool
+
+	nextIndex  map[uuid.UUID]uint64
+	matchIndex map[uuid.UUID]uint64
+	sending    map[uuid.UUID]bool
+	retry      map[uuid.UUID]time.Time
+
+	// heard is the last time the replica heard from a leader or granted its vote
+	heard   time.Time
+	timeout time.Duration
+}
+
+// replicatedStorage is a storage plugin replicated with the raft protocol
+type replicatedStorage struct {
+	shared.SimplePlugin
+	shared.UseBus
+	shared.RPCServer
+}
+
+// Make sure we implement required interfaces
+var _ shared.Endpoint = (*replicatedStorage)(nil)
+var _ shared.CallerEndpoint = (*replicatedStorage)(nil)
+var _ shared.AliasedEndpoint = (*replicatedStorage)(nil)
+var _ shared.SettingsSchema = (*replicatedStorage)(nil)
+var _ shared.SettingsConfigured = (*replicatedStorage)(nil)
+var _ shared.SettingsChanged = (*replicatedStorage)(nil)
+
+var instance = &replicatedStorage{
+	SimplePlugin: shared.SimplePlugin{Settings: settings},
+}
+
+var engine = shared.NewStorageEngine(shared.ReplicatedStorageUUID)
+
+// state is the replica of the process, it is created once the settings are configured
+var state *replica
+
+// NewPlugin returns an instance of the plugin
+func NewPlugin() (shared.Plugin, error) {
+	return instance, nil
+}
+
+// Schema declares the settings of the plugin
+func (s *replicatedStorage) Schema() []shared.SettingSpec {
+	return append([]shared.SettingSpec{
+		{Key: shared.StorageSettingNode, Type: "", Description: "node id of the replica, kept in its state file"},
+		{Key: shared.StorageSettingMembers, Type: []string{},
+			Description: "node ids of the replicas of the cluster, including this one"},
+		{Key: shared.StorageSettingPath, Type: "", Description: "state file of the replica, required in a cluster"},
+	}, shared.StorageQuotaSchema...)
+}
+
+// SettingsConfigured opens the state of the replica, the plugin takes the node id as its id so the other replicas
+// authenticate it by the envelopes of its requests
+func (s *replicatedStorage) SettingsConfigured() error {
+	var node uuid.UUID
+	if value := settings.GetString(shared.StorageSettingNode, ""); value != "" {
+		var err error
+		if node, err = uuid.Parse(value); err != nil {
+			return fmt.Errorf("Invalid node id %s", value)
+		}
+	}
+
+	var values []string
+	settings.GetValue(shared.StorageSettingMembers, &values)
+
+	var members []uuid.UUID
+	for _, value := range values {
+		member, err := uuid.Parse(value)
+		if err != nil {
+			return fmt.Errorf("Invalid member %s", value)
+		}
+		members = append(members, member)
+	}
+
+	var store *replicaStore
+	var saved replicaState
+	if path := settings.GetString(shared.StorageSettingPath, ""); path != "" {
+		var err error
+		if store, saved, err = openReplicaStore(path); err != nil {
+			return err
+		}
+	} else if len(members) > 1 {
+		return errors.New("The replicas of a cluster need a state file")
+	}
+
+	switch {
+	case saved.node != uuid.Nil && node != uuid.Nil && saved.node != node:
+		store.Close()
+		return fmt.Errorf("The state file belongs to the replica %v", saved.node)
+	case saved.node != uuid.Nil:
+		node = saved.node
+	case node == uuid.Nil:
+		node = uuid.New()
+	}
+
+	var peers []uuid.UUID
+	member := len(members) == 0
+	for _, m := range members {
+		if m == node {
+			member = true
+		} else {
+			peers = append(peers, m)
+		}
+	}
+	if !member {
+		if store != nil {
+			store.Close()
+		}
+		return fmt.Errorf("The replica %v is not a member of the cluster", node)
+	}
+
+	r := newReplica(node, peers, engine, s)
+	r.store = store
+	if err := r.restore(node, saved); err != nil {
+		if store != nil {
+			store.Close()
+		}
+		return err
+	}
+
+	if err := s.RegisterName("Replica", r); err != nil {
+		return err
+	}
+
+	settings[shared.SettingID] = node
+	state = r
+	return nil
+}
+
+// SettingsChanged applies the updates of the quotas, the members of the cluster cannot change while it runs
+func (s *replicatedStorage) SettingsChanged(previous shared.Settings) error {
+	if len(settings.Changed(previous, shared.StorageSettingNode, shared.StorageSettingMembers, shared.StorageSettingPath)) > 0 {
+		return errors.New("The members of the cluster cannot change while it runs")
+	}
+	return nil
+}
+
+// Start method
+func (s *replicatedStorage) Start(done <-chan struct{}) {
+	s.SimplePlugin.Start(done)
+
+	go func() {
+		tick := time.NewTicker(heartbeatInterval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-tick.C:
+				state.tick(now)
+			}
+		}
+	}()
+}
+
+// Stop method
+func (s *replicatedStorage) Stop() {
+	engine.Close()
+
+	state.mutex.Lock()
+	if state.store != nil {
+		state.store.Close()
+	}
+	state.mutex.Unlock()
+
+	s.SimplePlugin.Stop()
+}
+
+// Aliases makes the replica reachable as the replicated storage within its process
+func (s *replicatedStorage) Aliases() []uuid.UUID {
+	return []uuid.UUID{shared.ReplicatedStorageUUID}
+}
+
+// BroadcastMessage sends the message to all clients
+func (s *replicatedStorage) HandleBroadcast(message interface{}) {
+	// Do nothing
+}
+
+// SendMessage sends the message to a specific client asynchronously
+func (s *replicatedStorage) HandleMessage(message interface{}) (<-chan interface{}, error) {
+	return s.HandleMessageFrom(uuid.Nil, message)
+}
+
+// HandleMessageFrom reads the local replica and replicates the changes through the leader before answering
+func (s *replicatedStorage) HandleMessageFrom(caller uuid.UUID, message interface{}) (<-chan interface{}, error) {
+	if msg, ok := message.(shared.StorageMessage); ok && shared.StorageMessageChanges(msg.Type) {
+		res, err := s.propose(caller, msg)
+		if err != nil {
+			log.Printf("Cannot replicate the change of %s: %v", msg.Path, err)
+			return result(shared.BusError{Message: shared.ErrStorageUnreachable.Error()}), nil
+		}
+		if res == nil {
+			return nil, nil
+		}
+		return result(res), nil
+	}
+	return engine.HandleMessageFrom(caller, message)
+}
+
+// propose appends the change to the log of the leader and returns its result once applied by the local replica
+func (s *replicatedStorage) propose(caller uuid.UUID, msg shared.StorageMessage) (interface{}, error) {
+	deadline := time.Now().Add(proposeTimeout)
+	for time.Now().Before(deadline) {
+		state.mutex.Lock()
+		if state.role == roleLeader {
+			p, err := state.append(logEntry{Kind: entryMessage, Caller: caller, Message: msg, Time: state.now()})
+			state.mutex.Unlock()
+			if err != nil {
+				return nil, err
+			}
+
+			res, err := p.wait(deadline)
+			if err != errLeaderChanged {
+				return res, err
+			}
+			continue
+		}
+		leader := state.leader
+		state.mutex.Unlock()
+
+		if leader != uuid.Nil {
+			var reply proposeReply
+			err := s.call(leader, "Replica.Propose", proposeArgs{Caller: caller, Message: msg}, &reply, time.Until(deadline))
+			if err == nil {
+				// Read your writes, the local replica answers the next reads
+				state.waitApplied(reply.Index, deadline)
+				return reply.Result, nil
+			}
+
+			// The change was not appended unless the leader timed out, only then it may still be applied
+			if err.Error() != errNotLeader.Error() && err.Error() != errLeaderChanged.Error() && err != shared.ErrRPCUnreachable {
+				return nil, err
+			}
+		}
+
+		time.Sleep(heartbeatInterval)
+	}
+	return nil, errRPCTimeout
+}
+
+// send is the transport of the replica, the requests go through the bus with the node id as the sender
+func (s *replicatedStorage) send(peer uuid.UUID, method string, args interface{}, reply interface{}) error {
+	return s.call(peer, method, args, reply, rpcTimeout)
+}
+
+// call is Call with a timeout, the connection to a peer which does not answer in time is closed
+func (s *replicatedStorage) call(peer uuid.UUID, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := s.CallContext(ctx, peer, method, args, reply)
+	if err == context.DeadlineExceeded {
+		return errRPCTimeout
+	}
+	return err
+}
+
+// randomTimeout returns an election timeout
+func randomTimeout() time.Duration {
+	return electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout)))
+}
+
+// result returns a channel with a single result
+func result(value interface{}) <-chan interface{} {
+	ch := make(chan interface{}, 1)
+	ch <- value
+	close(ch)
+	return ch
+}
+
+// wait returns the result of the proposal once applied
+func (p *proposal) wait(deadline time.Time) (interface{}, error) {
+	select {
+	case res := <-p.done:
+		return res.result, res.err
+	case <-time.After(time.Until(deadline)):
+		return nil, errRPCTimeout
+	}
+}
+
+// newReplica returns a follower of the cluster made of the replica and its peers
+func newReplica(id uuid.UUID, peers []uuid.UUID, engine *shared.StorageEngine, transport transport) *replica {
+	r := &replica{
+		id:         id,
+		peers:      peers,
+		engine:     engine,
+		transport:  transport,
+		spawn:      func(f func()) { go f() },
+		now:        time.Now,
+		timeouts:   randomTimeout,
+		applied:    make(chan struct{}),
+		pending:    make(map[uint64]*proposal),
+		nextIndex:  make(map[uuid.UUID]uint64),
+		matchIndex: make(map[uuid.UUID]uint64),
+		sending:    make(map[uuid.UUID]bool),
+		retry:      make(map[uuid.UUID]time.Time),
+	}
+	r.heard = r.now()
+	r.timeout = r.timeouts()
+	return r
+}
+
+// restore takes the state read from the state file, the node id is saved in a new state file
+func (r *replica) restore(node uuid.UUID, saved replicaState) error {
+	if r.store != nil && saved.node == uuid.Nil {
+		if err := r.store.save(stateRecord{Kind: stateVote, Node: node}); err != nil {
+			return err
+		}
+	}
+
+	r.term, r.votedFor = saved.term, saved.votedFor
+	if saved.snapshotIndex > 0 {
+		if err := r.engine.Import(saved.snapshot); err != nil {
+			return err
+		}
+		r.snapshot = saved.snapshot
+		r.snapshotIndex, r.snapshotTerm = saved.snapshotIndex, saved.snapshotTerm
+		r.commitIndex, r.lastApplied = saved.snapshotIndex, saved.snapshotIndex
+	}
+
+	// The entries after the snapshot are applied again once the leader tells they are committed
+	r.log = saved.log
+	return nil
+}
+
+// member tells whether the caller is one of the other replicas
+func (r *replica) member(caller uuid.UUID) bool {
+	for _, peer := range r.peers {
+		if peer == caller {
+			return true
+		}
+	}
+	return false
+}
+
+// quorum returns the number of replicas needed to elect a leader or commit an entry
+func (r *replica) quorum() int {
+	return (len(r.peers)+1)/2 + 1
+}
+
+// saveVote persists the term and the vote, the mutex must be held
+func (r *replica) saveVote() error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.save(stateRecord{Kind: stateVote, Term: r.term, VotedFor: r.votedFor})
+}
+
+// saveEntries persists entries replacing the log from the index of the first one, the mutex must be held
+func (r *replica) saveEntries(entries []logEntry) error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.save(stateRecord{Kind: stateEntries, Entries: entries})
+}
+
+// saveSnapshot rewrites the state file with the snapshot and the log after it, the mutex must be held
+func (r *replica) saveSnapshot(snapshot shared.StorageArchive, index uint64, term uint64, entries []logEntry) error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.rewrite(replicaState{
+		node:          r.id,
+		term:          r.term,
+		votedFor:      r.votedFor,
+		log:           entries,
+		snapshot:      snapshot,
+		snapshotIndex: index,
+		snapshotTerm:  term,
+	})
+}
+
+// lastIndex returns the index of the last entry, the mutex must be held
+func (r *replica) lastIndex() uint64 {
+	return r.snapshotIndex + uint64(len(r.log))
+}
+
+// termAt returns the term of the entry at the index, which must not be before the snapshot, the mutex must be held
+func (r *replica) termAt(index uint64) uint64 {
+	if index <= r.snapshotIndex {
+		return r.snapshotTerm
+	}
+	return r.log[index-r.snapshotIndex-1].Term
+}
+
+// entry returns the entry at the index, which must be after the snapshot, the mutex must be held
+func (r *replica) entry(index uint64) logEntry {
+	return r.log[index-r.snapshotIndex-1]
+}
+
+// stepDown follows the leader of a newer term, the mutex must be held
+func (r *replica) stepDown(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = uuid.Nil
+		r.leader = uuid.Nil
+		if err := r.saveVote(); err != nil {
+			log.Printf("Cannot save the term %d: %v", term, err)
+		}
+	}
+	r.role = roleFollower
+}
+
+// tick runs the elections and the heartbeats
+func (r *replica) tick(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.role == roleLeader {
+		if !r.expiring && r.engine.Expired(now) {
+			// The values are removed by a log entry so that all the replicas remove them at the same revision
+			if _, err := r.append(logEntry{Kind: entryExpire, Time: now}); err == nil {
+				r.expiring = true
+			}
+		}
+
+		for _, peer := range r.peers {
+			r.replicate(peer)
+		}
+		return
+	}
+
+	if now.Sub(r.heard) < r.timeout {
+		return
+	}
+
+	r.heard = now
+	r.timeout = r.timeouts()
+	r.term++
+	r.role = roleCandidate
+	r.votedFor = r.id
+	r.leader = uuid.Nil
+	r.votes = 1
+
+	// The vote for itself must survive a restart like the votes for the other replicas
+	if err := r.saveVote(); err != nil {
+		log.Printf("Cannot run for the term %d: %v", r.term, err)
+		r.role = roleFollower
+		return
+	}
+
+	if r.votes >= r.quorum() {
+		r.becomeLeader()
+		return
+	}
+
+	args := voteArgs{Term: r.term, Candidate: r.id, LastIndex: r.lastIndex(), LastTerm: r.termAt(r.lastIndex())}
+	for _, peer := range r.peers {
+		peer := peer
+		r.spawn(func() { r.requestVote(peer, args) })
+	}
+}
+
+// requestVote asks a replica to vote for this one
+func (r *replica) requestVote(peer uuid.UUID, args voteArgs) {
+	var reply voteReply
+	err := r.transport.send(peer, "Replica.RequestVote", args, &reply)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+
+	if r.role != roleCandidate || r.term != args.Term || !reply.Granted {
+		return
+	}
+
+	r.votes++
+	if r.votes >= r.quorum() {
+		r.becomeLeader()
+	}
+}
+
+// becomeLeader starts leading the term, the mutex must be held
+func (r *replica) becomeLeader() {
+	log.Printf("Replica %v leads term %d", r.id, r.term)
+	r.role = roleLeader
+	r.leader = r.id
+	r.expiring = false
+
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+	}
+
+	// The entries of the previous terms are committed along with an entry of this term
+	if _, err := r.append(logEntry{Kind: entryNoop, Time: r.now()}); err != nil {
+		log.Printf("Cannot lead the term %d: %v", r.term, err)
+		r.role = roleFollower
+		r.leader = uuid.Nil
+	}
+}
+
+// append adds an entry to the log of the leader and sends it to the followers, the entry is saved before it counts
+// for the majority, the mutex must be held
+func (r *replica) append(entry logEntry) (*proposal, error) {
+	entry.Index = r.lastIndex() + 1
+	entry.Term = r.term
+	if err := r.saveEntries([]logEntry{entry}); err != nil {
+		return nil, err
+	}
+	r.log = append(r.log, entry)
+
+	p := &proposal{term: r.term, done: make(chan proposalResult, 1)}
+	r.pending[entry.Index] = p
+
+	for _, peer := range r.peers {
+		r.replicate(peer)
+	}
+	r.advanceCommit()
+	return p, nil
+}
+
+// replicate sends the missing entries, or the snapshot, to a follower, the mutex must be held
+func (r *replica) replicate(peer uuid.UUID) {
+	if r.sending[peer] || r.now().Before(r.retry[peer]) {
+		return
+	}
+
+	next, ok := r.nextIndex[peer]
+	if !ok || next == 0 {
+		next = r.lastIndex() + 1
+		r.nextIndex[peer] = next
+	}
+
+	r.sending[peer] = true
+	if next <= r.snapshotIndex {
+		args := snapshotArgs{Term: r.term, Leader: r.id, Index: r.snapshotIndex, LastTerm: r.snapshotTerm, Archive: r.snapshot}
+		r.spawn(func() { r.sendSnapshot(peer, args) })
+		return
+	}
+
+	last := r.lastIndex()
+	if last-next+1 > maxAppendEntries {
+		last = next + maxAppendEntries - 1
+	}
+
+	args := appendArgs{
+		Term:      r.term,
+		Leader:    r.id,
+		PrevIndex: next - 1,
+		PrevTerm:  r.termAt(next - 1),
+		Entries:   append([]logEntry(nil), r.log[next-r.snapshotIndex-1:last-r.snapshotIndex]...),
+		Commit:    r.commitIndex,
+	}
+	r.spawn(func() { r.sendEntries(peer, args) })
+}
+
+// sendEntries sends an AppendEntries request and handles its reply
+func (r *replica) sendEntries(peer uuid.UUID, args appendArgs) {
+	var reply appendReply
+	err := r.transport.send(peer, "Replica.AppendEntries", args, &reply)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sending[peer] = false
+
+	if err == shared.ErrRPCUnreachable {
+		r.retry[peer] = r.now().Add(retryInterval)
+	}
+	if err != nil {
+		return
+	}
+
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+
+	if r.role != roleLeader || r.term != args.Term {
+		return
+	}
+
+	if !reply.Success {
+		next := r.nextIndex[peer] - 1
+		if reply.Hint > 0 && reply.Hint < next {
+			next = reply.Hint
+		}
+		if next < 1 {
+			next = 1
+		}
+		r.nextIndex[peer] = next
+		r.replicate(peer)
+		return
+	}
+
+	r.acknowledge(peer, reply.Match, args.Commit)
+}
+
+// sendSnapshot sends an InstallSnapshot request and handles its reply
+func (r *replica) sendSnapshot(peer uuid.UUID, args snapshotArgs) {
+	var reply snapshotReply
+	err := r.transport.send(peer, "Replica.InstallSnapshot", args, &reply)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sending[peer] = false
+
+	if err == shared.ErrRPCUnreachable {
+		r.retry[peer] = r.now().Add(retryInterval)
+	}
+	if err != nil {
+		return
+	}
+
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+
+	if r.role == roleLeader && r.term == args.Term {
+		r.acknowledge(peer, reply.Match, 0)
+	}
+}
+
+// acknowledge records the entries a follower has and sends it the next ones or the new commit index, the mutex must
+// be held
+func (r *replica) acknowledge(peer uuid.UUID, match uint64, commit uint64) {
+	if match > r.matchIndex[peer] {
+		r.matchIndex[peer] = match
+	}
+	r.nextIndex[peer] = r.matchIndex[peer] + 1
+	r.advanceCommit()
+
+	if r.nextIndex[peer] <= r.lastIndex() || commit < r.commitIndex {
+		r.replicate(peer)
+	}
+}
+
+// advanceCommit commits the entries of the term stored by a majority of the members, the mutex must be held
+func (r *replica) advanceCommit() {
+	for index := r.lastIndex(); index > r.commitIndex && r.termAt(index) == r.term; index-- {
+		count := 1
+		for _, peer := range r.peers {
+			if r.matchIndex[peer] >= index {
+				count++
+			}
+		}
+
+		if count >= r.quorum() {
+			r.commitIndex = index
+			r.apply()
+
+			// The followers answer the writes they forwarded once they applied them
+			for _, peer := range r.peers {
+				r.replicate(peer)
+			}
+			return
+		}
+	}
+}
+
+// apply applies the committed entries to the storage and answers their proposals, the mutex must be held
+func (r *replica) apply() {
+	if r.lastApplied >= r.commitIndex {
+		return
+	}
+
+	for r.lastApplied < r.commitIndex {
+		r.lastApplied++
+		entry := r.entry(r.lastApplied)
+
+		var res interface{}
+		switch entry.Kind {
+		case entryMessage:
+			if ch, err := r.engine.Apply(entry.Caller, entry.Message, entry.Time); err == nil && ch != nil {
+				res = <-ch
+			}
+		case entryExpire:
+			r.engine.Expire(entry.Time)
+			r.expiring = false
+		}
+
+		if p, ok := r.pending[entry.Index]; ok {
+			delete(r.pending, entry.Index)
+			if p.term == entry.Term {
+				p.done <- proposalResult{result: res}
+			} else {
+				p.done <- proposalResult{err: errLeaderChanged}
+			}
+		}
+	}
+
+	close(r.applied)
+	r.applied = make(chan struct{})
+
+	if len(r.log) > maxLogEntries {
+		r.compact()
+	}
+}
+
+// compact replaces the applied entries with a snapshot of the storage, the mutex must be held
+func (r *replica) compact() {
+	snapshot, err := r.engine.Export()
+	if err != nil {
+		log.Printf("Cannot compact the log: %v", err)
+		return
+	}
+
+	index, term := r.lastApplied, r.termAt(r.lastApplied)
+	entries := append([]logEntry(nil), r.log[index-r.snapshotIndex:]...)
+
+	// The state file keeps the whole log until it is rewritten
+	if err := r.saveSnapshot(snapshot, index, term, entries); err != nil {
+		log.Printf("Cannot compact the log: %v", err)
+		return
+	}
+
+	r.snapshot = snapshot
+	r.snapshotIndex, r.snapshotTerm = index, term
+	r.log = entries
+}
+
+// waitApplied waits for the local replica to apply the entry at the index
+func (r *replica) waitApplied(index uint64, deadline time.Time) {
+	for {
+		r.mutex.Lock()
+		if r.lastApplied >= index {
+			r.mutex.Unlock()
+			return
+		}
+		applied := r.applied
+		r.mutex.Unlock()
+
+		select {
+		case <-applied:
+		case <-time.After(time.Until(deadline)):
+			return
+		}
+	}
+}
+
+// RequestVote grants the vote of the replica to a candidate with a log at least as recent as its own, the vote is
+// saved before it is granted
+func (r *replica) RequestVote(caller uuid.UUID, args voteArgs, reply *voteReply) error {
+	if !r.member(caller) || args.Candidate != caller {
+		return errNotMember
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if args.Term > r.term {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+
+	lastTerm := r.termAt(r.lastIndex())
+	upToDate := args.LastTerm > lastTerm || (args.LastTerm == lastTerm && args.LastIndex >= r.lastIndex())
+	if args.Term == r.term && (r.votedFor == uuid.Nil || r.votedFor == args.Candidate) && upToDate {
+		r.votedFor = args.Candidate
+		if err := r.saveVote(); err != nil {
+			r.votedFor = uuid.Nil
+			return err
+		}
+		r.heard = r.now()
+		reply.Granted = true
+	}
+	return nil
+}
+
+// AppendEntries stores the entries sent by the leader and applies the committed ones, the entries are saved before
+// they are acknowledged
+func (r *replica) AppendEntries(caller uuid.UUID, args appendArgs, reply *appendReply) error {
+	if !r.member(caller) || args.Leader != caller {
+		return errNotMember
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if args.Term > r.term || (args.Term == r.term && r.role == roleCandidate) {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+
+	if args.Term < r.term {
+		return nil
+	}
+	r.leader = args.Leader
+	r.heard = r.now()
+
+	// The entries up to the snapshot are committed so they match
+	prevIndex, prevTerm, entries := args.PrevIndex, args.PrevTerm, args.Entries
+	if prevIndex < r.snapshotIndex {
+		for len(entries) > 0 && entries[0].Index <= r.snapshotIndex {
+			entries = entries[1:]
+		}
+		prevIndex, prevTerm = r.snapshotIndex, r.snapshotTerm
+	}
+
+	if prevIndex > r.lastIndex() {
+		reply.Hint = r.lastIndex() + 1
+		return nil
+	}
+
+	if conflict := r.termAt(prevIndex); conflict != prevTerm {
+		// Skip the whole conflicting term
+		hint := prevIndex
+		for hint > r.snapshotIndex+1 && r.termAt(hint-1) == conflict {
+			hint--
+		}
+		reply.Hint = hint
+		return nil
+	}
+
+	// The entries from the first one missing or conflicting replace the end of the log
+	for i, entry := range entries {
+		if entry.Index <= r.lastIndex() && r.termAt(entry.Index) == entry.Term {
+			continue
+		}
+
+		if err := r.saveEntries(entries[i:]); err != nil {
+			return err
+		}
+		if entry.Index <= r.lastIndex() {
+			r.log = r.log[:entry.Index-r.snapshotIndex-1]
+		}
+		r.log = append(r.log, entries[i:]...)
+		break
+	}
+
+	reply.Success = true
+	reply.Match = args.PrevIndex + uint64(len(args.Entries))
+
+	commit := args.Commit
+	if commit > reply.Match {
+		commit = reply.Match
+	}
+	if commit > r.commitIndex {
+		r.commitIndex = commit
+		r.apply()
+	}
+	return nil
+}
+
+// InstallSnapshot replaces the storage with the snapshot of a leader the replica fell too far behind
+func (r *replica) InstallSnapshot(caller uuid.UUID, args snapshotArgs, reply *snapshotReply) error {
+	if !r.member(caller) || args.Leader != caller {
+		return errNotMember
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if args.Term > r.term || (args.Term == r.term && r.role == roleCandidate) {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+
+	if args.Term < r.term {
+		return nil
+	}
+	r.leader = args.Leader
+	r.heard = r.now()
+	reply.Match = args.Index
+
+	if args.Index <= r.lastApplied {
+		return nil
+	}
+
+	var entries []logEntry
+	if args.Index <= r.lastIndex() && r.termAt(args.Index) == args.LastTerm {
+		entries = append(entries, r.log[args.Index-r.snapshotIndex:]...)
+	}
+
+	if err := r.saveSnapshot(args.Archive, args.Index, args.LastTerm, entries); err != nil {
+		return err
+	}
+
+	log.Printf("Replica %v installs the snapshot at %d", r.id, args.Index)
+	if err := r.engine.Import(args.Archive); err != nil {
+		return err
+	}
+
+	r.log = entries
+	r.snapshot = args.Archive
+	r.snapshotIndex, r.snapshotTerm = args.Index, args.LastTerm
+	r.lastApplied = args.Index
+	if r.commitIndex < args.Index {
+		r.commitIndex = args.Index
+	}
+
+	// The proposals replaced by the snapshot have an unknown result
+	for index, p := range r.pending {
+		if index <= args.Index {
+			delete(r.pending, index)
+			p.done <- proposalResult{err: shared.ErrStorageUnreachable}
+		}
+	}
+
+	close(r.applied)
+	r.applied = make(chan struct{})
+	r.apply()
+	return nil
+}
+
+// Propose appends a change forwarded by another replica to the log of the leader, the replicas are trusted with the
+// plugin which sent the change to them
+func (r *replica) Propose(caller uuid.UUID, args proposeArgs, reply *proposeReply) error {
+	if !r.member(caller) {
+		return errNotMember
+	}
+
+	r.mutex.Lock()
+	if r.role != roleLeader {
+		r.mutex.Unlock()
+		return errNotLeader
+	}
+	p, err := r.append(logEntry{Kind: entryMessage, Caller: args.Caller, Message: args.Message, Time: r.now()})
+	index := r.lastIndex()
+	r.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	res, err := p.wait(time.Now().Add(proposeTimeout))
+	if err != nil {
+		return err
+	}
+
+	reply.Index = index
+	reply.Result = res
+	return nil
+}
+
+const (
+	// stateVote holds the term and the vote, and the node id in the first record
+	stateVote = iota
+	// stateEntries holds entries replacing the log from the index of the first one
+	stateEntries
+	// stateSnapshot holds the snapshot replacing the log, it is first in a rewritten file
+	stateSnapshot
+)
+
+// stateRecord is a change of the state of a replica, the state file is a sequence of records
+type stateRecord struct {
+	Kind     int
+	Node     uuid.UUID
+	Term     uint64
+	VotedFor uuid.UUID
+	Entries  []logEntry
+	Index    uint64
+	LastTerm uint64
+	Archive  shared.StorageArchive
+}
+
+// replicaState is the state of a replica read from its state file
+type replicaState struct {
+	node          uuid.UUID
+	term          uint64
+	votedFor      uuid.UUID
+	log           []logEntry
+	snapshot      shared.StorageArchive
+	snapshotIndex uint64
+	snapshotTerm  uint64
+}
+
+// replicaStore appends the changes of the state of a replica to its state file, each change is synced before the
+// replica answers
+type replicaStore struct {
+	path string
+	file *os.File
+}
+
+// openReplicaStore reads the state file then rewrites it, so a record truncated by a crash is dropped
+func openReplicaStore(path string) (*replicaStore, replicaState, error) {
+	var saved replicaState
+
+	if f, err := os.Open(path); err == nil {
+		r := bufio.NewReader(f)
+		for {
+			var record stateRecord
+			if err := shared.ReadRecord(r, &record); err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("State file %s is truncated: %v", path, err)
+				break
+			}
+			saved.add(record)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, saved, err
+	}
+
+	s := &replicaStore{path: path}
+	if err := s.rewrite(saved); err != nil {
+		return nil, saved, err
+	}
+	return s, saved, nil
+}
+
+// add applies a record to the state
+func (s *replicaState) add(record stateRecord) {
+	switch record.Kind {
+	case stateVote:
+		if record.Node != uuid.Nil {
+			s.node = record.Node
+		}
+		s.term, s.votedFor = record.Term, record.VotedFor
+	case stateEntries:
+		if len(record.Entries) == 0 || record.Entries[0].Index <= s.snapshotIndex {
+			return
+		}
+		if keep := record.Entries[0].Index - s.snapshotIndex - 1; keep < uint64(len(s.log)) {
+			s.log = s.log[:keep]
+		}
+		s.log = append(s.log, record.Entries...)
+	case stateSnapshot:
+		s.snapshot = record.Archive
+		s.snapshotIndex, s.snapshotTerm = record.Index, record.LastTerm
+		s.log = nil
+	}
+}
+
+// save appends a record and syncs it
+func (s *replicaStore) save(record stateRecord) error {
+	if s.file == nil {
+		return errors.New("State file is closed")
+	}
+
+	if err := shared.WriteRecord(s.file, record); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// rewrite replaces the state file with the records of the state, then appends to the new file
+func (s *replicaStore) rewrite(state replicaState) error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	records := []stateRecord{{Kind: stateVote, Node: state.node, Term: state.term, VotedFor: state.votedFor}}
+	if state.snapshotIndex > 0 {
+		records = append(records, stateRecord{Kind: stateSnapshot, Index: state.snapshotIndex,
+			LastTerm: state.snapshotTerm, Archive: state.snapshot})
+	}
+	for start := 0; start < len(state.log); start += maxAppendEntries {
+		end := start + maxAppendEntries
+		if end > len(state.log) {
+			end = len(state.log)
+		}
+		records = append(records, stateRecord{Kind: stateEntries, Entries: state.log[start:end]})
+	}
+
+	for _, record := range records {
+		if err := shared.WriteRecord(w, record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	return nil
+}
+
+// Close closes the state file
+func (s *replicaStore) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+
+	// All the replicas must have the same quotas to apply the same changes
+	engine.Quota = func(owner uuid.UUID) shared.StorageQuota {
+		return shared.StorageQuotaFor(settings, owner)
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/m4rs14n/go-app/shared"
+)
+
+// cluster runs replicas in the test goroutine, the requests are queued and delivered by run unless the replicas are
+// partitioned
+type cluster struct {
+	t     *testing.T
+	ids   []uuid.UUID
+	nodes map[uuid.UUID]*replica
+	// group is the side of the partition of each replica, the replicas only reach the ones of their group
+	group map[uuid.UUID]int
+	jobs  []func()
+	now   time.Time
+}
+
+// link is the transport of a replica in the cluster
+type link struct {
+	c    *cluster
+	from uuid.UUID
+}
+
+func (l link) send(peer uuid.UUID, method string, args interface{}, reply interface{}) error {
+	if l.c.group[l.from] != l.c.group[peer] {
+		return shared.ErrRPCUnreachable
+	}
+
+	target := l.c.nodes[peer]
+	switch method {
+	case "Replica.RequestVote":
+		return target.RequestVote(l.from, args.(voteArgs), reply.(*voteReply))
+	case "Replica.AppendEntries":
+		return target.AppendEntries(l.from, args.(appendArgs), reply.(*appendReply))
+	case "Replica.InstallSnapshot":
+		return target.InstallSnapshot(l.from, args.(snapshotArgs), reply.(*snapshotReply))
+	}
+	l.c.t.Fatalf("Unexpected method %s", method)
+	return nil
+}
+
+// newCluster returns replicas electing the first one when they are all up, the state files are in dir if it is set
+func newCluster(t *testing.T, size int, dir string) *cluster {
+	c := &cluster{
+		t:     t,
+		nodes: make(map[uuid.UUID]*replica),
+		group: make(map[uuid.UUID]int),
+		now:   time.Now(),
+	}
+	for i := 0; i < size; i++ {
+		c.ids = append(c.ids, uuid.New())
+	}
+	for i := range c.ids {
+		c.start(i, dir)
+	}
+	return c
+}
+
+// start creates the replica i, from its state file if any
+func (c *cluster) start(i int, dir string) *replica {
+	id := c.ids[i]
+	var peers []uuid.UUID
+	for _, peer := range c.ids {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+
+	r := newReplica(id, peers, shared.NewStorageEngine(shared.ReplicatedStorageUUID), link{c: c, from: id})
+	r.spawn = func(f func()) { c.jobs = append(c.jobs, f) }
+	r.now = func() time.Time { return c.now }
+	timeout := electionTimeout + time.Duration(i)*electionTimeout/2
+	r.timeouts = func() time.Duration { return timeout }
+	r.heard, r.timeout = c.now, timeout
+
+	if dir != "" {
+		store, saved, err := openReplicaStore(filepath.Join(dir, id.String()))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		r.store = store
+		if err := r.restore(id, saved); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	c.nodes[id] = r
+	return r
+}
+
+// run delivers the queued requests and their answers
+func (c *cluster) run() {
+	for len(c.jobs) > 0 {
+		job := c.jobs[0]
+		c.jobs = c.jobs[1:]
+		job()
+	}
+}
+
+// tick advances the time of all the replicas by the heartbeat interval
+func (c *cluster) tick(n int) {
+	for ; n > 0; n-- {
+		c.now = c.now.Add(heartbeatInterval)
+		for _, id := range c.ids {
+			c.nodes[id].tick(c.now)
+		}
+		c.run()
+	}
+}
+
+// leaders returns the replicas leading in the group
+func (c *cluster) leaders(group int) []*replica {
+	var leaders []*replica
+	for _, id := range c.ids {
+		r := c.nodes[id]
+		r.mutex.Lock()
+		if r.role == roleLeader && c.group[id] == group {
+			leaders = append(leaders, r)
+		}
+		r.mutex.Unlock()
+	}
+	return leaders
+}
+
+// leader returns the single leader of the group once elected
+func (c *cluster) leader(group int) *replica {
+	for i := 0; i < 50; i++ {
+		if leaders := c.leaders(group); len(leaders) == 1 {
+			return leaders[0]
+		}
+		c.tick(1)
+	}
+	c.t.Fatalf("No leader elected in group %d", group)
+	return nil
+}
+
+// write appends a change to the log of the leader
+func (c *cluster) write(leader *replica, caller uuid.UUID, path string, value interface{}) *proposal {
+	leader.mutex.Lock()
+	p, err := leader.append(logEntry{
+		Kind:    entryMessage,
+		Caller:  caller,
+		Message: shared.StorageMessage{Type: shared.StorageMessageTypeWrite, Path: path, Value: value},
+		Time:    c.now,
+	})
+	leader.mutex.Unlock()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.run()
+	return p
+}
+
+// read returns the value of the path in the storage of a replica
+func (c *cluster) read(r *replica, caller uuid.UUID, path string) interface{} {
+	ch, err := r.engine.Apply(caller, shared.StorageMessage{Type: shared.StorageMessageTypeRead, Path: path}, c.now)
+	if err != nil || ch == nil {
+		c.t.Fatalf("Cannot read %s: %v", path, err)
+	}
+	return <-ch
+}
+
+// committed tells whether the proposal was applied by the leader
+func committed(p *proposal) bool {
+	select {
+	case res := <-p.done:
+		p.done <- res
+		return res.err == nil
+	default:
+		return false
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	c := newCluster(t, 3, "")
+	leader := c.leader(0)
+
+	if leader.id != c.ids[0] {
+		t.Fatalf("The replica with the shortest timeout should lead, got %v", leader.id)
+	}
+
+	for _, id := range c.ids {
+		r := c.nodes[id]
+		if r.term != leader.term || r.leader != leader.id {
+			t.Fatalf("Replica %v follows %v in term %d, expected %v in term %d", id, r.leader, r.term, leader.id, leader.term)
+		}
+	}
+
+	// The followers keep following while they hear from the leader
+	c.tick(50)
+	if leaders := c.leaders(0); len(leaders) != 1 || leaders[0] != leader {
+		t.Fatal("The leader changed while it was up")
+	}
+}
+
+func TestLogCatchUp(t *testing.T) {
+	c := newCluster(t, 3, "")
+	leader := c.leader(0)
+	caller := uuid.New()
+
+	lagging := c.ids[2]
+	c.group[lagging] = 1
+
+	var last *proposal
+	for i := 0; i < 10; i++ {
+		last = c.write(leader, caller, "/catchup", i)
+	}
+	c.tick(1)
+	if !committed(last) {
+		t.Fatal("The majority should commit without the lagging replica")
+	}
+	if value := c.read(c.nodes[lagging], caller, "/catchup"); value == 9 {
+		t.Fatal("The partitioned replica should not have the value")
+	}
+
+	c.group[lagging] = 0
+	c.tick(15)
+	if value := c.read(c.nodes[lagging], caller, "/catchup"); value != 9 {
+		t.Fatalf("Expected the lagging replica to catch up, got %v", value)
+	}
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	c := newCluster(t, 3, "")
+	leader := c.leader(0)
+	caller := uuid.New()
+
+	lagging := c.ids[2]
+	c.group[lagging] = 1
+	for i := 0; i <= maxLogEntries; i++ {
+		c.write(leader, caller, "/snapshot", i)
+	}
+	c.tick(1)
+
+	if leader.snapshotIndex == 0 {
+		t.Fatal("The leader should have compacted its log")
+	}
+
+	c.group[lagging] = 0
+	c.tick(15)
+	if value := c.read(c.nodes[lagging], caller, "/snapshot"); value != maxLogEntries {
+		t.Fatalf("Expected the lagging replica to install the snapshot, got %v", value)
+	}
+}
+
+func TestMinorityCannotCommit(t *testing.T) {
+	c := newCluster(t, 5, "")
+	old := c.leader(0)
+	caller := uuid.New()
+
+	// The leader is left with one follower
+	for _, id := range c.ids {
+		if id != old.id && id != c.ids[1] && id != c.ids[0] {
+			c.group[id] = 1
+		}
+	}
+	if old.id != c.ids[0] {
+		t.Fatal("The first replica should lead")
+	}
+
+	lost := c.write(old, caller, "/minority", "lost")
+	c.tick(50)
+	if committed(lost) {
+		t.Fatal("The minority should not commit")
+	}
+
+	leader := c.leader(1)
+	kept := c.write(leader, caller, "/minority", "kept")
+	c.tick(1)
+	if !committed(kept) {
+		t.Fatal("The majority should commit")
+	}
+
+	// Once healed the old leader follows and drops its entry
+	for _, id := range c.ids {
+		c.group[id] = 0
+	}
+	c.tick(15)
+
+	if leaders := c.leaders(0); len(leaders) != 1 || leaders[0] != leader {
+		t.Fatal("The leader of the majority should keep leading")
+	}
+	for _, id := range c.ids {
+		if value := c.read(c.nodes[id], caller, "/minority"); value != "kept" {
+			t.Fatalf("Expected replica %v to have the value of the majority, got %v", id, value)
+		}
+	}
+	if res := <-lost.done; res.err != errLeaderChanged {
+		t.Fatalf("Expected the lost write to fail, got %v", res.err)
+	}
+}
+
+func TestRejectsOtherCallers(t *testing.T) {
+	c := newCluster(t, 3, "")
+	r := c.nodes[c.ids[0]]
+	stranger := uuid.New()
+
+	var vote voteReply
+	if err := r.RequestVote(stranger, voteArgs{Term: 10, Candidate: stranger}, &vote); err != errNotMember {
+		t.Fatalf("Expected a stranger to be rejected, got %v", err)
+	}
+	if err := r.RequestVote(c.ids[1], voteArgs{Term: 10, Candidate: c.ids[2]}, &vote); err != errNotMember {
+		t.Fatalf("Expected a replica voting for another one to be rejected, got %v", err)
+	}
+
+	var reply appendReply
+	if err := r.AppendEntries(shared.HostUUID, appendArgs{Term: 10, Leader: c.ids[1]}, &reply); err != errNotMember {
+		t.Fatalf("Expected the host to be rejected, got %v", err)
+	}
+
+	var propose proposeReply
+	if err := r.Propose(stranger, proposeArgs{Caller: shared.HostUUID}, &propose); err != errNotMember {
+		t.Fatalf("Expected a stranger proposal to be rejected, got %v", err)
+	}
+
+	if r.term != 0 {
+		t.Fatalf("The rejected requests changed the term to %d", r.term)
+	}
+}
+
+func TestRestartKeepsState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newCluster(t, 3, dir)
+	leader := c.leader(0)
+	caller := uuid.New()
+	p := c.write(leader, caller, "/restart", "value")
+	c.tick(1)
+	if !committed(p) {
+		t.Fatal("The write should commit")
+	}
+
+	follower := c.nodes[c.ids[1]]
+	term, vote, last := follower.term, follower.votedFor, follower.lastIndex()
+	follower.store.Close()
+
+	restarted := c.start(1, dir)
+	if restarted.term != term || restarted.votedFor != vote || restarted.lastIndex() != last {
+		t.Fatalf("Expected term %d, vote %v and %d entries, got %d, %v and %d", term, vote, last,
+			restarted.term, restarted.votedFor, restarted.lastIndex())
+	}
+
+	// It does not vote twice in the term
+	var reply voteReply
+	args := voteArgs{Term: term, Candidate: c.ids[2], LastIndex: last, LastTerm: restarted.termAt(last)}
+	if err := restarted.RequestVote(c.ids[2], args, &reply); err != nil || reply.Granted {
+		t.Fatalf("Expected the vote to be refused, got %v %v", reply.Granted, err)
+	}
+
+	c.tick(5)
+	if value := c.read(restarted, caller, "/restart"); value != "value" {
+		t.Fatalf("Expected the restarted replica to apply its log, got %v", value)
+	}
+}
@@ -31,11 +31,21 @@ import (
 	"errors"
 	"log"
 
+	"github.com/google/uuid"
 	"github.com/m4rs14n/go-app/shared"
 )
 
 var settings = shared.SetupSettings(shared.UnencryptedStorageUUID, "UnencryptedStorage", "This is a simple unencrypted storage plugin")
 
+// Manifest describes the plugin to the loader
+var Manifest = shared.PluginManifest{
+	Name:         "UnencryptedStorage",
+	Version:      "1.0.0",
+	APIVersion:   shared.SharedAPIVersion,
+	Author:       "Hojat Parta",
+	Capabilities: []string{shared.CapabilityStorage},
+}
+
 // unencryptedStorage is a unencrypted storage plugin
 type unencryptedStorage struct {
 	shared.SimplePlugin
@@ -43,6 +53,9 @@ type unencryptedStorage struct {
 
 // Make sure we implement required interfaces
 var _ shared.Endpoint = (*unencryptedStorage)(nil)
+var _ shared.CallerEndpoint = (*unencryptedStorage)(nil)
+var _ shared.SettingsSchema = (*unencryptedStorage)(nil)
+var _ shared.SettingsChanged = (*unencryptedStorage)(nil)
 
 var instance = &unencryptedStorage{
 	shared.SimplePlugin{Settings: settings},
@@ -53,8 +66,54 @@ func NewPlugin() (shared.Plugin, error) {
 	return instance, nil
 }
 
-// Simple in memory storage for now
-var disk = make(map[string]interface{})
+// Schema declares the settings of the plugin
+func (s *unencryptedStorage) Schema() []shared.SettingSpec {
+	return append(append([]shared.SettingSpec{}, shared.StorageBackendSchema...), shared.StorageQuotaSchema...)
+}
+
+// SettingsChanged applies the updates of the quotas, the backend cannot change
+func (s *unencryptedStorage) SettingsChanged(previous shared.Settings) error {
+	return shared.StorageBackendChanged(settings, previous)
+}
+
+// engine answers once Start opened the backend selected by the settings
+var engine = shared.NewStorageEngine(shared.UnencryptedStorageUUID)
+
+// opened is closed once the engine has its backend
+var opened = make(chan struct{})
+
+func init() {
+	// The quotas are read from the settings so the host can change them
+	engine.Quota = func(owner uuid.UUID) shared.StorageQuota {
+		return shared.StorageQuotaFor(settings, owner)
+	}
+}
+
+// Start method
+func (s *unencryptedStorage) Start(done <-chan struct{}) {
+	s.SimplePlugin.Start(done)
+
+	// The storage does not answer rather than losing the values written in memory
+	backend, err := shared.OpenStorageBackend(settings)
+	if err == nil {
+		if err = engine.SetBackend(backend); err != nil {
+			backend.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Cannot open the storage backend: %v", err)
+		return
+	}
+
+	close(opened)
+	go engine.RunExpiry(done)
+}
+
+// Stop method
+func (s *unencryptedStorage) Stop() {
+	engine.Close()
+	s.SimplePlugin.Stop()
+}
 
 // BroadcastMessage sends the message to all clients
 func (s *unencryptedStorage) HandleBroadcast(message interface{}) {
@@ -63,24 +122,15 @@ func (s *unencryptedStorage) HandleBroadcast(message interface{}) {
 
 // SendMessage sends the message to a specific client asynchronously
 func (s *unencryptedStorage) HandleMessage(message interface{}) (<-chan interface{}, error) {
-	if storageMsg, ok := message.(shared.StorageMessage); ok {
-		switch storageMsg.Type {
-		case shared.StorageMessageTypeRead:
-			ch := make(chan interface{})
-
-			go func() {
-				ch <- disk[storageMsg.Path]
-				close(ch)
-			}()
-
-			return ch, nil
+	return s.HandleMessageFrom(uuid.Nil, message)
+}
 
-		case shared.StorageMessageTypeWrite:
-			disk[storageMsg.Path] = storageMsg.Value
-			return nil, nil
-		}
+// HandleMessageFrom handles the messages in the namespace of the caller or in the namespaces shared with it
+func (s *unencryptedStorage) HandleMessageFrom(caller uuid.UUID, message interface{}) (<-chan interface{}, error) {
+	select {
+	case <-opened:
+		return engine.HandleMessageFrom(caller, message)
+	default:
+		return nil, errors.New("The unencrypted storage is not started")
 	}
-
-	log.Print("Invalid message")
-	return nil, errors.New("Invalid message")
 }
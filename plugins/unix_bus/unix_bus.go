@@ -28,13 +28,17 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/m4rs14n/go-app/shared"
@@ -43,19 +47,52 @@ import (
 var id = uuid.MustParse("5AB218CD-A9D1-41A6-877D-5454AF9994C2")
 var settings = shared.SetupSettings(id, "UnixBus", "This is a bus plugin")
 
+// Manifest describes the plugin to the loader
+var Manifest = shared.PluginManifest{
+	Name:         "UnixBus",
+	Version:      "1.0.0",
+	APIVersion:   shared.SharedAPIVersion,
+	Author:       "Hojat Parta",
+	Capabilities: []string{shared.CapabilityBus},
+}
+
+func init() {
+	// Local bus will have a higher priority
+	settings[shared.BusSettingPriority] = 100
+}
+
 // bus is the Bus Plugin
 type unixBus struct {
 	shared.SimplePlugin
 	listeners []net.Listener
 	waitGroup sync.WaitGroup
+
+	conns        map[net.Conn]struct{}
+	connsMutex   sync.Mutex
+	ordered      map[uuid.UUID]*orderedConn
+	orderedMutex sync.Mutex
+	// sequencer hands the broadcasts to the ordered connections one at a time in the total ordering mode
+	sequencer *shared.DeliveryQueue
+
+	// topics caches the subscriptions read from the .topics files, they are read again when the directory changes
+	topics         map[uuid.UUID][]string
+	topicsModified time.Time
+	topicsRead     time.Time
+	topicsMutex    sync.Mutex
 }
 
 // Make sure we implement required interfaces
 var _ shared.PluginListener = (*unixBus)(nil)
 var _ shared.BusService = (*unixBus)(nil)
+var _ shared.ContextBus = (*unixBus)(nil)
+var _ shared.SubscriberBus = (*unixBus)(nil)
+var _ shared.SettingsSchema = (*unixBus)(nil)
 
 var instance = &unixBus{
 	SimplePlugin: shared.SimplePlugin{Settings: settings},
+	conns:        make(map[net.Conn]struct{}),
+	ordered:      make(map[uuid.UUID]*orderedConn),
+	sequencer:    shared.NewDeliveryQueue(shared.DefaultDeliveryBuffer),
 }
 
 // NewPlugin returns an instance of the plugin
@@ -63,92 +100,197 @@ func NewPlugin() (shared.Plugin, error) {
 	return instance, nil
 }
 
-const endpointsDir = "/tmp/endpoints"
+// Schema declares the settings of the plugin
+func (s *unixBus) Schema() []shared.SettingSpec {
+	return shared.BusSchema
+}
+
+// endpointsDir holds the sockets of the endpoints, the tests point it to a directory of their own
+var endpointsDir = "/tmp/endpoints"
+
+// topicsResolution is the time after which the modification time of the endpoints directory is trusted, the changes
+// made within the resolution of the file system keep the same time
+const topicsResolution = time.Second
 
 const (
 	messageTypeBroadcast = iota
 	messageTypeSend
 	messageTypeResult
+	messageTypePublish
 )
 
 type message struct {
 	Type    int
 	UUID    uuid.UUID
+	Topic   string
 	Message interface{}
 }
 
+// Start method
+func (b *unixBus) Start(done <-chan struct{}) {
+	b.SimplePlugin.Start(done)
+
+	if err := shared.OpenBusDeliveryLog(b.Settings); err != nil {
+		log.Printf("Cannot open the delivery log: %v", err)
+	}
+}
+
 // Stop method
 func (b *unixBus) Stop() {
 	for _, l := range b.listeners {
 		l.Close()
 	}
+
+	b.sequencer.Close()
+
+	b.orderedMutex.Lock()
+	for _, oc := range b.ordered {
+		oc.close()
+	}
+	b.orderedMutex.Unlock()
+
+	// Ordered broadcasts keep their connection open
+	b.connsMutex.Lock()
+	for c := range b.conns {
+		c.Close()
+	}
+	b.connsMutex.Unlock()
+
 	b.waitGroup.Wait()
 	b.SimplePlugin.Stop()
 }
 
 // PluginLoaded allows the plugin to check if a loaded plugin is of any interest
 func (b *unixBus) PluginLoaded(plugin shared.Plugin) {
-	if endpoint, ok := plugin.(shared.Endpoint); ok {
-		uuid := plugin.GetSettings().ID()
-		sockAddr := fmt.Sprintf("%s/%v.sock", endpointsDir, uuid)
+	endpoint, isEndpoint := plugin.(shared.Endpoint)
+	subscriber, isSubscriber := plugin.(shared.Subscriber)
+	if !isEndpoint && !isSubscriber {
+		return
+	}
 
-		if err := os.RemoveAll(sockAddr); err != nil {
-			log.Fatal(err)
-		}
+	uuid := plugin.GetSettings().ID()
+	sockAddr := fmt.Sprintf("%s/%v.sock", endpointsDir, uuid)
+	topicsAddr := fmt.Sprintf("%s/%v.topics", endpointsDir, uuid)
+
+	if err := os.RemoveAll(sockAddr); err != nil {
+		log.Fatal(err)
+	}
 
-		l, err := net.Listen("unix", sockAddr)
-		if err != nil {
-			log.Fatal("listen error: ", err)
+	var queue *shared.DeliveryQueue
+	if isSubscriber {
+		topics := strings.Join(subscriber.Subscriptions(), "\n")
+		if err := ioutil.WriteFile(topicsAddr, []byte(topics), 0600); err != nil {
+			log.Fatal(err)
 		}
+		b.invalidateTopics()
+		queue = shared.NewDeliveryQueue(shared.SubscriberBuffer(b.Settings))
+	}
 
-		b.listeners = append(b.listeners, l)
+	l, err := net.Listen("unix", sockAddr)
+	if err != nil {
+		log.Fatal("listen error: ", err)
+	}
 
-		go func() {
-			for {
-				conn, err := l.Accept()
-				if err != nil {
-					// log.Printf("accept error: %v", err)
-					break
-				}
+	// The identity of a message is the one the sender wrote in its envelope, only trust the processes of the user and
+	// never take them for the host
+	if err := os.Chmod(sockAddr, 0600); err != nil {
+		log.Fatal(err)
+	}
 
-				b.waitGroup.Add(1)
-				go func(c net.Conn) {
-					defer c.Close()
-					defer b.waitGroup.Done()
+	b.listeners = append(b.listeners, l)
 
-					dec := gob.NewDecoder(c)
-					var req message
-					err := dec.Decode(&req)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// log.Printf("accept error: %v", err)
+				break
+			}
 
-					if err == nil {
-						switch req.Type {
-						case messageTypeBroadcast:
+			b.waitGroup.Add(1)
+			b.connsMutex.Lock()
+			b.conns[conn] = struct{}{}
+			b.connsMutex.Unlock()
+
+			go func(c net.Conn) {
+				defer c.Close()
+				defer b.waitGroup.Done()
+				defer func() {
+					b.connsMutex.Lock()
+					delete(b.conns, c)
+					b.connsMutex.Unlock()
+				}()
+
+				dec := gob.NewDecoder(c)
+				var req message
+				err := dec.Decode(&req)
+
+				if err == nil {
+					switch {
+					case req.Type == messageTypeBroadcast && isEndpoint:
+						// Broadcasts sent on the same connection are handled in order
+						for err == nil && req.Type == messageTypeBroadcast {
 							endpoint.HandleBroadcast(req.Message)
+							req = message{}
+							err = dec.Decode(&req)
+						}
 
-						case messageTypeSend:
-							ch, err := endpoint.HandleMessage(req.Message)
-							if err == nil {
-								enc := gob.NewEncoder(c)
-								for res := range ch {
-									err = enc.Encode(message{Type: messageTypeResult, Message: res})
-									if err != nil {
-										break
+					case req.Type == messageTypePublish && isSubscriber:
+						topic, msg := req.Topic, req.Message
+						if !queue.Push(func() { subscriber.HandlePublish(topic, msg) }) {
+							log.Printf("Subscriber %v is full, dropping message on %s", uuid, topic)
+						}
+
+					case req.Type == messageTypeSend && isEndpoint:
+						ch, err := shared.DispatchRemoteMessage(endpoint, req.Message)
+						if err != nil {
+							log.Printf("Message to %v rejected: %v", uuid, err)
+						}
+						if err == nil && ch != nil {
+							// Results can be streamed for a long time (e.g. watches), stop when the sender goes away
+							gone := make(chan struct{})
+							go func() {
+								ioutil.ReadAll(c)
+								close(gone)
+							}()
+
+							enc := gob.NewEncoder(c)
+						results:
+							for {
+								select {
+								case res, ok := <-ch:
+									if !ok {
+										break results
+									}
+									if err := enc.Encode(message{Type: messageTypeResult, Message: res}); err != nil {
+										break results
 									}
+								case <-gone:
+									break results
 								}
 							}
-
-						default:
-							log.Fatal("invalid command")
 						}
+
+					default:
+						log.Printf("Invalid command %d for %v", req.Type, uuid)
 					}
-				}(conn)
-			}
+				}
+			}(conn)
+		}
 
-			if err := os.RemoveAll(sockAddr); err != nil {
-				log.Fatal(err)
-			}
-		}()
-	}
+		if queue != nil {
+			queue.Close()
+		}
+
+		if err := os.RemoveAll(topicsAddr); err != nil {
+			log.Fatal(err)
+		}
+		b.invalidateTopics()
+
+		if err := os.RemoveAll(sockAddr); err != nil {
+			log.Fatal(err)
+		}
+	}()
 }
 
 func broadcastMessage(uuid uuid.UUID, msg interface{}) {
@@ -164,28 +306,166 @@ func broadcastMessage(uuid uuid.UUID, msg interface{}) {
 	err = enc.Encode(message{Type: messageTypeBroadcast, Message: msg})
 }
 
+// orderedConn keeps a connection open to an endpoint to deliver its broadcasts in order
+type orderedConn struct {
+	uuid  uuid.UUID
+	queue *shared.DeliveryQueue
+	conn  net.Conn
+	enc   *gob.Encoder
+}
+
+func (oc *orderedConn) send(msg interface{}) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if oc.conn == nil {
+			c, err := net.Dial("unix", fmt.Sprintf("%s/%v.sock", endpointsDir, oc.uuid))
+			if err != nil {
+				return
+			}
+			oc.conn, oc.enc = c, gob.NewEncoder(c)
+		}
+
+		if err := oc.enc.Encode(message{Type: messageTypeBroadcast, Message: msg}); err == nil {
+			return
+		}
+
+		// The endpoint may have been restarted, try again on a new connection
+		oc.conn.Close()
+		oc.conn, oc.enc = nil, nil
+	}
+}
+
+func (oc *orderedConn) close() {
+	oc.queue.PushWait(func() {
+		if oc.conn != nil {
+			oc.conn.Close()
+			oc.conn, oc.enc = nil, nil
+		}
+	})
+	oc.queue.Close()
+}
+
+func (b *unixBus) orderedConnection(uuid uuid.UUID) *orderedConn {
+	b.orderedMutex.Lock()
+	defer b.orderedMutex.Unlock()
+
+	oc, ok := b.ordered[uuid]
+	if !ok {
+		oc = &orderedConn{uuid: uuid, queue: shared.NewDeliveryQueue(shared.DefaultDeliveryBuffer)}
+		b.ordered[uuid] = oc
+	}
+	return oc
+}
+
 // GetPriority returns the priority of the bus
 func (b *unixBus) Priority() int {
-	return 100 // Local bus will have a higher priority
+	return b.Settings.GetInt(shared.BusSettingPriority, 100)
 }
 
 // BroadcastMessage sends the message to all clients
 func (b *unixBus) HandleBroadcast(msg interface{}) {
-	filepath.Walk(endpointsDir, func(path string, info os.FileInfo, err error) error {
-		if info.Mode()&os.ModeDir == 0 {
-			filename := filepath.Base(path)
-			ext := filepath.Ext(path)
-			name := filename[0 : len(filename)-len(ext)]
-			if uuid, err := uuid.Parse(name); err == nil {
-				go broadcastMessage(uuid, msg)
-			}
+	ordering := shared.BusOrdering(b.Settings)
+
+	var conns []*orderedConn
+	walkEndpoints(".sock", func(uuid uuid.UUID, path string) {
+		if ordering == shared.BusOrderingNone {
+			go broadcastMessage(uuid, msg)
+		} else {
+			conns = append(conns, b.orderedConnection(uuid))
 		}
+	})
+
+	push := func() {
+		for _, oc := range conns {
+			oc := oc
+			oc.queue.PushWait(func() { oc.send(msg) })
+		}
+	}
+
+	if ordering == shared.BusOrderingTotal {
+		b.sequencer.PushWait(push)
+	} else {
+		push()
+	}
+}
+
+func publishMessage(uuid uuid.UUID, topic string, msg interface{}) {
+	sockAddr := fmt.Sprintf("%s/%v.sock", endpointsDir, uuid)
+
+	c, err := net.Dial("unix", sockAddr)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	enc := gob.NewEncoder(c)
+	err = enc.Encode(message{Type: messageTypePublish, Topic: topic, Message: msg})
+}
+
+// HandlePublish sends the message to the subscribers of the topic
+func (b *unixBus) HandlePublish(topic string, msg interface{}) {
+	b.HandlePublishTo(b.Subscribers(topic), topic, msg)
+}
+
+// Subscribers returns the subscribers of the topic
+func (b *unixBus) Subscribers(topic string) []uuid.UUID {
+	var ids []uuid.UUID
+	for id, patterns := range b.subscriptions() {
+		if shared.MatchAnyTopic(patterns, topic) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// HandlePublishTo sends the message to some subscribers of the topic
+func (b *unixBus) HandlePublishTo(subscribers []uuid.UUID, topic string, msg interface{}) {
+	for _, id := range subscribers {
+		go publishMessage(id, topic, msg)
+	}
+}
+
+// subscriptions returns the topic patterns of the subscribers, read from the .topics files when the endpoints
+// directory changed since they were last read
+func (b *unixBus) subscriptions() map[uuid.UUID][]string {
+	b.topicsMutex.Lock()
+	defer b.topicsMutex.Unlock()
+
+	info, err := os.Stat(endpointsDir)
+	if err != nil {
 		return nil
+	}
+
+	modified := info.ModTime()
+	if b.topics != nil && modified.Equal(b.topicsModified) && b.topicsRead.Sub(modified) > topicsResolution {
+		return b.topics
+	}
+
+	topics := make(map[uuid.UUID][]string)
+	read := time.Now()
+	walkEndpoints(".topics", func(uuid uuid.UUID, path string) {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			topics[uuid] = strings.Split(string(data), "\n")
+		}
 	})
+
+	b.topics, b.topicsModified, b.topicsRead = topics, modified, read
+	return topics
+}
+
+// invalidateTopics makes the next publication read the .topics files again
+func (b *unixBus) invalidateTopics() {
+	b.topicsMutex.Lock()
+	b.topics = nil
+	b.topicsMutex.Unlock()
 }
 
 // SendMessage sends the message to a specific client asynchronously
 func (b *unixBus) HandleMessage(uuid uuid.UUID, msg interface{}) (<-chan interface{}, error) {
+	return b.HandleMessageContext(context.Background(), uuid, msg)
+}
+
+// HandleMessageContext is HandleMessage closing the connection once the context is done
+func (b *unixBus) HandleMessageContext(ctx context.Context, uuid uuid.UUID, msg interface{}) (<-chan interface{}, error) {
 	sockAddr := fmt.Sprintf("%s/%v.sock", endpointsDir, uuid)
 
 	c, err := net.Dial("unix", sockAddr)
@@ -201,9 +481,22 @@ func (b *unixBus) HandleMessage(uuid uuid.UUID, msg interface{}) (<-chan interfa
 
 	ch := make(chan interface{})
 
+	// The results stop when the context is done, even if the endpoint never answers
+	stop := make(chan struct{})
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				c.Close()
+			case <-stop:
+			}
+		}()
+	}
+
 	go func() {
 		defer close(ch)
 		defer c.Close()
+		defer close(stop)
 
 		dec := gob.NewDecoder(c)
 		var r message
@@ -215,7 +508,11 @@ func (b *unixBus) HandleMessage(uuid uuid.UUID, msg interface{}) (<-chan interfa
 
 			switch r.Type {
 			case messageTypeResult:
-				ch <- r.Message
+				select {
+				case ch <- r.Message:
+				case <-ctx.Done():
+					return
+				}
 
 			default:
 				log.Printf("Invalid response so ignoring")
@@ -226,6 +523,31 @@ func (b *unixBus) HandleMessage(uuid uuid.UUID, msg interface{}) (<-chan interfa
 	return ch, nil
 }
 
+// Endpoints returns the endpoints reachable through the bus
+func (b *unixBus) Endpoints() []uuid.UUID {
+	var ids []uuid.UUID
+	walkEndpoints(".sock", func(uuid uuid.UUID, path string) {
+		ids = append(ids, uuid)
+	})
+	return ids
+}
+
+// walkEndpoints calls fn with the uuid and the path of the files of the endpoints with the extension
+func walkEndpoints(ext string, fn func(uuid uuid.UUID, path string)) {
+	filepath.Walk(endpointsDir, func(path string, info os.FileInfo, err error) error {
+		// The files of the endpoints stopping meanwhile are gone
+		if err != nil || info.Mode()&os.ModeDir != 0 || filepath.Ext(path) != ext {
+			return nil
+		}
+
+		filename := filepath.Base(path)
+		if uuid, err := uuid.Parse(filename[0 : len(filename)-len(ext)]); err == nil {
+			fn(uuid, path)
+		}
+		return nil
+	})
+}
+
 func init() {
 	if _, err := os.Stat(endpointsDir); os.IsNotExist(err) {
 		os.MkdirAll(endpointsDir, 0700)
@@ -32,9 +32,13 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/google/uuid"
 	"github.com/m4rs14n/go-app/shared"
 )
 
+// uuid of my_service plugin, it shares "/path" with my_plugin
+var myServiceUUID = uuid.MustParse("CDFA9BD5-551E-4E29-B4D2-FA51C2559331")
+
 func main() {
 	done := make(chan struct{})
 	unixBus, err := shared.LoadPlugin("unix_bus.so")
@@ -50,7 +54,7 @@ func main() {
 	plugin.Start(done)
 
 	if storage, ok := plugin.(shared.Storage); ok {
-		if ch := storage.Read("/path"); ch != nil {
+		if ch := storage.Shared(myServiceUUID).Read("/path"); ch != nil {
 			response := <-ch
 			fmt.Printf("Read: %v\n", response)
 		}
@@ -0,0 +1,119 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/m4rs14n/go-app/shared"
+)
+
+var node = flag.String("node", "", "node id of the replica, kept in the state file after the first start")
+var members = flag.String("members", "", "comma separated node ids of the replicas of the cluster")
+var stateFile = flag.String("state", "", "state file of the replica")
+var configFile = flag.String("config", "", "JSON file with the settings of the plugins by name")
+
+// Run it in several terminals and type "set <path> <value>", "get <path>", "del <path>" or "list [prefix]", the
+// settings are changed with "config <plugin> <key> <value>" or read again from the file with "reload"
+func main() {
+	flag.Parse()
+
+	if *configFile != "" {
+		if err := shared.LoadConfig(*configFile); err != nil {
+			panic(err)
+		}
+	}
+
+	// The flags override the configuration file
+	values := make(map[string]interface{})
+	if *node != "" {
+		values[shared.StorageSettingNode] = *node
+	}
+	if *members != "" {
+		values[shared.StorageSettingMembers] = strings.Split(*members, ",")
+	}
+	if *stateFile != "" {
+		values[shared.StorageSettingPath] = *stateFile
+	}
+	shared.SetConfig("ReplicatedStorage", values)
+
+	// The host is created before the plugins are loaded so none of them can claim it
+	host, err := shared.NewHost()
+	if err != nil {
+		panic(err)
+	}
+
+	done := make(chan struct{})
+	for _, path := range []string{"local_bus.so", "unix_bus.so", "replicated_storage.so"} {
+		plugin, err := shared.LoadPlugin(path)
+		if err != nil {
+			panic(err)
+		}
+		plugin.Start(done)
+	}
+
+	storage := host.Storage(shared.ReplicatedStorageUUID)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		switch {
+		case args[0] == "set" && len(args) == 3:
+			fmt.Printf("Set: %v\n", storage.Write(args[1], args[2]))
+		case args[0] == "get" && len(args) == 2:
+			if ch := storage.Read(args[1]); ch != nil {
+				fmt.Printf("Get: %v\n", <-ch)
+			}
+		case args[0] == "del" && len(args) == 2:
+			fmt.Printf("Del: %v\n", storage.Delete(args[1]))
+		case args[0] == "list":
+			prefix := "/"
+			if len(args) > 1 {
+				prefix = args[1]
+			}
+			list, err := storage.List(prefix, "", 0)
+			fmt.Printf("List: %v %v\n", list.Paths, err)
+		case args[0] == "config" && len(args) == 4:
+			fmt.Printf("Config: %v\n", shared.UpdateSettings(args[1], shared.Settings{args[2]: args[3]}))
+		case args[0] == "reload" && *configFile != "":
+			fmt.Printf("Reload: %v\n", shared.ReloadConfig(*configFile))
+		default:
+			fmt.Println("Usage: set <path> <value> | get <path> | del <path> | list [prefix] | config <plugin> <key> <value> | reload")
+		}
+	}
+
+	shared.StopAllPlugins(done)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StorageArchiveFormat is the version of the archive format
+const StorageArchiveFormat = 1
+
+// StorageArchiveEntry is a value of an archive
+type StorageArchiveEntry struct {
+	Owner    uuid.UUID
+	Path     string
+	Value    interface{}
+	Modified time.Time
+	Expires  time.Time
+	Version  uint64
+}
+
+// StorageArchiveGrant is a shared path of an archive
+type StorageArchiveGrant struct {
+	Owner   uuid.UUID
+	Path    string
+	Grantee uuid.UUID
+	Access  int
+}
+
+// StorageArchive is a point-in-time copy of a storage
+type StorageArchive struct {
+	Format   int
+	Storage  uuid.UUID
+	Created  time.Time
+	Revision uint64
+	Entries  []StorageArchiveEntry
+	Grants   []StorageArchiveGrant
+	// Sealed holds the entries and the grants encrypted by a storage encrypting its values, only a storage with the
+	// same key restores them
+	Sealed []byte
+}
+
+// ErrStorageArchiveSealed is returned when a storage cannot open an encrypted archive
+var ErrStorageArchiveSealed = errors.New("The archive is encrypted by another storage")
+
+// ArchiveSealer is the interface that, when implemented by a StorageBackend, encrypts the archives of the storage so
+// the values do not leave it in clear
+type ArchiveSealer interface {
+	SealArchive(archive StorageArchive) (StorageArchive, error)
+	OpenArchive(archive StorageArchive) (StorageArchive, error)
+}
+
+// Namespaces returns the namespaces found in the archive
+func (a StorageArchive) Namespaces() []uuid.UUID {
+	seen := make(map[uuid.UUID]bool)
+	var namespaces []uuid.UUID
+	for _, e := range a.Entries {
+		if !seen[e.Owner] {
+			seen[e.Owner] = true
+			namespaces = append(namespaces, e.Owner)
+		}
+	}
+	return namespaces
+}
+
+// Filter returns the part of the archive of a namespace
+func (a StorageArchive) Filter(namespace uuid.UUID) StorageArchive {
+	filtered := a
+	filtered.Entries = nil
+	filtered.Grants = nil
+
+	for _, e := range a.Entries {
+		if e.Owner == namespace {
+			filtered.Entries = append(filtered.Entries, e)
+		}
+	}
+	for _, g := range a.Grants {
+		if g.Owner == namespace {
+			filtered.Grants = append(filtered.Grants, g)
+		}
+	}
+	return filtered
+}
+
+// WriteStorageArchive writes the archive in its portable form, a gzip compressed gob stream
+func WriteStorageArchive(w io.Writer, archive StorageArchive) error {
+	zw := gzip.NewWriter(w)
+	if err := gob.NewEncoder(zw).Encode(archive); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadStorageArchive reads an archive written by WriteStorageArchive
+func ReadStorageArchive(r io.Reader) (archive StorageArchive, err error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+
+	if err = gob.NewDecoder(zr).Decode(&archive); err != nil {
+		return
+	}
+
+	if archive.Format != StorageArchiveFormat {
+		err = fmt.Errorf("Unsupported storage archive format %d", archive.Format)
+	}
+	return
+}
+
+// BackupStorage saves a snapshot of the storage to a file, the snapshots of the encrypted storages are sealed with
+// their key
+func BackupStorage(storage Storage, file string) error {
+	archive, err := storage.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteStorageArchive(f, archive); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// RestoreStorage restores a storage from a file, all the namespaces if namespace is uuid.Nil
+func RestoreStorage(storage Storage, file string, namespace uuid.UUID) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	archive, err := ReadStorageArchive(f)
+	if err != nil {
+		return err
+	}
+
+	return storage.Restore(archive, namespace)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StorageSettingBackend is the key for the backend of a storage plugin, StorageBackendMemory by default
+	StorageSettingBackend = "backend"
+	// StorageSettingPath is the key for the file of the file backend
+	StorageSettingPath = "path"
+	// StorageSettingKeyFile is the key for the file of the key the values are encrypted with, not encrypted if unset
+	StorageSettingKeyFile = "key_file"
+)
+
+const (
+	// StorageBackendMemory keeps the values in memory
+	StorageBackendMemory = "memory"
+	// StorageBackendFile persists the values in a file
+	StorageBackendFile = "file"
+)
+
+// StorageBackendSchema declares the settings of OpenStorageBackend
+var StorageBackendSchema = []SettingSpec{
+	{Key: StorageSettingBackend, Type: "", Values: []interface{}{StorageBackendMemory, StorageBackendFile},
+		Description: "where the values are kept"},
+	{Key: StorageSettingPath, Type: "", Description: "file of the file backend"},
+	{Key: StorageSettingKeyFile, Type: "", Description: "file of the key the values are encrypted with"},
+}
+
+// StorageBackendChanged rejects the updates of the backend settings as the backend is opened on start
+func StorageBackendChanged(settings Settings, previous Settings) error {
+	changed := settings.Changed(previous, StorageSettingBackend, StorageSettingPath, StorageSettingKeyFile)
+	if len(changed) > 0 {
+		return fmt.Errorf("The storage backend is opened on start, %s cannot change", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// StorageRecord is a value kept by a storage backend along with its metadata
+type StorageRecord struct {
+	Key         string
+	Value       interface{}
+	ContentType string
+	Size        int
+	Modified    time.Time
+	Expires     time.Time
+	Version     uint64
+}
+
+// expired checks if the record expired at the given time
+func (r StorageRecord) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// StorageBackend keeps the records of a storage endpoint, the StorageEngine handles the messages on top of it
+type StorageBackend interface {
+	// Get returns the record stored at the key
+	Get(key string) (StorageRecord, bool, error)
+	// Put stores the record at its key
+	Put(record StorageRecord) error
+	// Delete removes the record stored at the key
+	Delete(key string) error
+	// Scan calls fn with the records from start (included) to end (excluded, no bound if empty) in the order of the
+	// keys until it returns false
+	Scan(start string, end string, fn func(record StorageRecord) bool) error
+	// Snapshot returns a consistent copy of all the records in the order of the keys
+	Snapshot() ([]StorageRecord, error)
+	// Close releases the resources of the backend
+	Close() error
+}
+
+// MemoryBackend keeps the records in memory
+type MemoryBackend struct {
+	records map[string]StorageRecord
+	// index keeps the keys sorted for the scans
+	index []string
+	mutex sync.RWMutex
+}
+
+// Make sure MemoryBackend implements required interfaces
+var _ StorageBackend = (*MemoryBackend)(nil)
+
+// NewMemoryBackend creates an empty memory backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{records: make(map[string]StorageRecord)}
+}
+
+// Get returns the record stored at the key
+func (b *MemoryBackend) Get(key string) (StorageRecord, bool, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	record, ok := b.records[key]
+	return record, ok, nil
+}
+
+// Put stores the record at its key
+func (b *MemoryBackend) Put(record StorageRecord) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.records[record.Key]; !ok {
+		i := sort.SearchStrings(b.index, record.Key)
+		b.index = append(b.index, "")
+		copy(b.index[i+1:], b.index[i:])
+		b.index[i] = record.Key
+	}
+	b.records[record.Key] = record
+	return nil
+}
+
+// Delete removes the record stored at the key
+func (b *MemoryBackend) Delete(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.records[key]; ok {
+		i := sort.SearchStrings(b.index, key)
+		b.index = append(b.index[:i], b.index[i+1:]...)
+		delete(b.records, key)
+	}
+	return nil
+}
+
+// Scan calls fn with the records from start to end in the order of the keys until it returns false
+func (b *MemoryBackend) Scan(start string, end string, fn func(record StorageRecord) bool) error {
+	b.mutex.RLock()
+	from := sort.SearchStrings(b.index, start)
+	to := len(b.index)
+	if end != "" {
+		to = sort.SearchStrings(b.index, end)
+	}
+
+	// fn may change the backend, it is called on a copy
+	var records []StorageRecord
+	for i := from; i < to; i++ {
+		records = append(records, b.records[b.index[i]])
+	}
+	b.mutex.RUnlock()
+
+	for _, record := range records {
+		if !fn(record) {
+			break
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a copy of all the records in the order of the keys
+func (b *MemoryBackend) Snapshot() ([]StorageRecord, error) {
+	var records []StorageRecord
+	err := b.Scan("", "", func(record StorageRecord) bool {
+		records = append(records, record)
+		return true
+	})
+	return records, err
+}
+
+// Close does nothing for the memory backend
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+// OpenStorageBackend opens the backend selected by the storage settings, wrapped in an EncryptedBackend if a key file
+// is set
+func OpenStorageBackend(settings Settings) (StorageBackend, error) {
+	var backend StorageBackend
+
+	kind := settings.GetString(StorageSettingBackend, StorageBackendMemory)
+	switch kind {
+	case "", StorageBackendMemory:
+		backend = NewMemoryBackend()
+	case StorageBackendFile:
+		path := settings.GetString(StorageSettingPath, "")
+		if path == "" {
+			return nil, errors.New("The file backend needs a path")
+		}
+
+		file, err := OpenFileBackend(path)
+		if err != nil {
+			return nil, err
+		}
+		backend = file
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %s", kind)
+	}
+
+	keyFile := settings.GetString(StorageSettingKeyFile, "")
+	if keyFile == "" {
+		return backend, nil
+	}
+
+	key, err := LoadStorageKey(keyFile)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+
+	encrypted, err := NewEncryptedBackend(backend, key)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return encrypted, nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build go1.18
+// +build go1.18
+
+package shared
+
+import (
+	"debug/buildinfo"
+	"fmt"
+	"runtime/debug"
+)
+
+// buildSettings are the build settings a plugin must share with the host
+var buildSettings = []string{"GOOS", "GOARCH", "CGO_ENABLED", "-race"}
+
+// checkBuild compares the build of a plugin file with the build of the host before the Go runtime opens it, the Go
+// runtime only names a package when they do not match
+func checkBuild(path string) error {
+	plugin, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot load %s, it is not a Go plugin: %v", path, err)
+	}
+
+	host, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+
+	if plugin.GoVersion != host.GoVersion {
+		return fmt.Errorf("Cannot load %s, it was built with %s but the host with %s", path, plugin.GoVersion,
+			host.GoVersion)
+	}
+
+	for _, key := range buildSettings {
+		if p, h := buildSetting(plugin, key), buildSetting(host, key); p != h {
+			return fmt.Errorf("Cannot load %s, it was built with %s=%s but the host with %s=%s", path, key, p, key, h)
+		}
+	}
+
+	modules := make(map[string]*debug.Module)
+	modules[host.Main.Path] = &host.Main
+	for _, dep := range host.Deps {
+		modules[dep.Path] = dep
+	}
+
+	for _, dep := range plugin.Deps {
+		h, ok := modules[dep.Path]
+		if !ok {
+			continue
+		}
+
+		p, h := replaced(dep), replaced(h)
+		if p.Version != h.Version || p.Sum != h.Sum {
+			return fmt.Errorf("Cannot load %s, it was built with %s %s but the host with %s %s", path, p.Path,
+				p.Version, h.Path, h.Version)
+		}
+	}
+	return nil
+}
+
+// buildSetting returns the value of a build setting, false if it is not set as the boolean settings are only
+// recorded when true
+func buildSetting(info *debug.BuildInfo, key string) string {
+	for _, setting := range info.Settings {
+		if setting.Key == key {
+			return setting.Value
+		}
+	}
+	return "false"
+}
+
+// replaced returns the module used in place of a module
+func replaced(module *debug.Module) *debug.Module {
+	if module.Replace != nil {
+		return module.Replace
+	}
+	return module
+}
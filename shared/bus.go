@@ -28,21 +28,56 @@
 package shared
 
 import (
+	"context"
+	"errors"
 	"log"
+	"path"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const (
-	// BusSettingPriority is the key for the priority in the plugin settings
+	// BusSettingPriority is the key for the priority in the plugin settings, the buses with lower priorities are
+	// tried first
 	BusSettingPriority = "priority"
+	// BusSettingEnabled is the key for whether the plugins send through the bus, true by default
+	BusSettingEnabled = "enabled"
+	// BusSettingRoutes is the key for the []string of the endpoints only reached through the bus, by uuid or by
+	// name pattern (see path.Match) of the plugins loaded in the process
+	BusSettingRoutes = "routes"
+	// BusSettingOrdering is the key for the broadcast ordering in the plugin settings
+	BusSettingOrdering = "ordering"
+	// BusSettingSubscriberBuffer is the key for the number of pending publications buffered per subscriber
+	BusSettingSubscriberBuffer = "subscriber_buffer"
+	// BusSettingDeliveryLog is the key for the file the ids of the queued messages delivered to the endpoints of the
+	// process are kept in, see OpenDeliveryLog
+	BusSettingDeliveryLog = "delivery_log"
+
+	// DefaultSubscriberBuffer is used when the bus settings do not define a subscriber buffer
+	DefaultSubscriberBuffer = 64
+	// DefaultDeliveryBuffer is the number of pending broadcasts buffered per endpoint in the ordered modes
+	DefaultDeliveryBuffer = 1024
+)
+
+const (
+	// BusOrderingNone delivers the broadcasts as soon as possible, in any order
+	BusOrderingNone = "none"
+	// BusOrderingFIFO delivers the broadcasts of a sender in the order they were sent
+	BusOrderingFIFO = "fifo"
+	// BusOrderingTotal delivers all the broadcasts of a process in the same order to every endpoint
+	BusOrderingTotal = "total"
 )
 
 // Bus is the interface used to communicate on a bus
 type Bus interface {
 	// BroadcastMessage sends the message to all clients
 	BroadcastMessage(message interface{})
+	// Publish sends the message to the clients subscribed to the topic
+	Publish(topic string, message interface{})
 	// TODO: Add error channel in case the bus cannot deliver
 	// SendMessageAsync sends the message to a specific client asynchronously
 	SendMessage(uuid uuid.UUID, message interface{}) <-chan interface{}
@@ -54,10 +89,30 @@ type BusService interface {
 	Priority() int
 	// HandleBroadcast handles bus broadcasts
 	HandleBroadcast(message interface{})
+	// HandlePublish handles bus publications
+	HandlePublish(topic string, message interface{})
 	// HandleMessage handles bus messages
 	HandleMessage(uuid uuid.UUID, message interface{}) (<-chan interface{}, error)
+	// Endpoints returns the endpoints reachable through the bus
+	Endpoints() []uuid.UUID
+}
+
+// ContextBus is the interface that, when implemented by a BusService, stops waiting for the results of a message
+// and closes their channel once the context is done
+type ContextBus interface {
+	HandleMessageContext(ctx context.Context, uuid uuid.UUID, message interface{}) (<-chan interface{}, error)
+}
+
+// GatherResult is the answer of an endpoint to a gathered message
+type GatherResult struct {
+	UUID   uuid.UUID
+	Result interface{}
+	Err    error
 }
 
+// ErrGatherTimeout is the error of the endpoints that did not answer before the deadline
+var ErrGatherTimeout = errors.New("Endpoint did not answer before the deadline")
+
 // Endpoint represents an endpoint connected to a bus (service)
 type Endpoint interface {
 	// HandleBroadcast handles bus broadcasts
@@ -66,14 +121,95 @@ type Endpoint interface {
 	HandleMessage(message interface{}) (<-chan interface{}, error)
 }
 
+// AliasedEndpoint is the interface that, when implemented by an Endpoint, makes the endpoint reachable by other
+// uuids within the process, e.g. a well-known service uuid served by a replica with a uuid of its own
+type AliasedEndpoint interface {
+	Aliases() []uuid.UUID
+}
+
 // UseBus allows a plugin to have access to logging
 type UseBus struct {
+	id    uuid.UUID
 	buses []BusService
+	queue *DurableQueue
+
+	// enabled are the buses sent through by priority, routes are the routing table built from their settings
+	enabled []BusService
+	routes  []busRoute
+	// names are the names of the loaded plugins by id and alias, for the name patterns of the routes
+	names map[uuid.UUID]string
+	// generation is the settingsGeneration the routing table was built at
+	generation uint64
+
+	// busesMutex guards the buses, the plugins may use the bus from their goroutines while others are loaded
+	busesMutex sync.RWMutex
+}
+
+// busRoute sends the messages to the endpoints matching the pattern through the bus
+type busRoute struct {
+	pattern string
+	bus     BusService
+}
+
+// matches checks if the route applies to the endpoint
+func (r busRoute) matches(id uuid.UUID, name string) bool {
+	if routed, err := uuid.Parse(r.pattern); err == nil {
+		return routed == id
+	}
+	matched, _ := path.Match(r.pattern, name)
+	return name != "" && matched
 }
 
 // Make sure UseBus implements required interfaces
 var _ PluginListener = (*UseBus)(nil)
 var _ Bus = (*UseBus)(nil)
+var _ identifiable = (*UseBus)(nil)
+
+// BusError carries an error from an endpoint back to the sender as a result
+type BusError struct {
+	Message string
+}
+
+func (e BusError) Error() string {
+	return e.Message
+}
+
+// BusSchema declares the settings of the buses
+var BusSchema = []SettingSpec{
+	{Key: BusSettingPriority, Type: 0, Description: "buses with lower priorities are tried first"},
+	{Key: BusSettingEnabled, Default: true, Description: "whether the plugins send through the bus"},
+	{Key: BusSettingRoutes, Type: []string{}, Description: "uuids or name patterns of the endpoints only reached through the bus"},
+	{Key: BusSettingOrdering, Type: "", Values: []interface{}{BusOrderingNone, BusOrderingFIFO, BusOrderingTotal},
+		Description: "order the broadcasts are delivered in"},
+	{Key: BusSettingSubscriberBuffer, Type: 0, Min: 1, Description: "pending publications buffered per subscriber"},
+	{Key: BusSettingDeliveryLog, Type: "", Description: "file keeping the queued messages delivered across restarts"},
+}
+
+// SubscriberBuffer returns the number of pending publications a bus buffers per subscriber
+func SubscriberBuffer(settings Settings) int {
+	if size := settings.GetInt(BusSettingSubscriberBuffer, 0); size > 0 {
+		return size
+	}
+	return DefaultSubscriberBuffer
+}
+
+// OpenBusDeliveryLog opens the delivery log set in the settings of a bus, the buses call it when they start so the
+// queued messages they deliver are handled once across restarts, else only until the process exits
+func OpenBusDeliveryLog(settings Settings) error {
+	if path := settings.GetString(BusSettingDeliveryLog, ""); path != "" {
+		return OpenDeliveryLog(path)
+	}
+	return nil
+}
+
+// BusOrdering returns the broadcast ordering of a bus
+func BusOrdering(settings Settings) string {
+	switch ordering := settings.GetString(BusSettingOrdering, ""); ordering {
+	case BusOrderingFIFO, BusOrderingTotal:
+		return ordering
+	}
+	return BusOrderingNone
+}
 
 // ByPriority implements sort.Interface for []BusService based on the priorities
 type ByPriority []BusService
@@ -82,27 +218,180 @@ func (a ByPriority) Len() int           { return len(a) }
 func (a ByPriority) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByPriority) Less(i, j int) bool { return a[i].Priority() < a[j].Priority() }
 
+// setIdentity is called by the loader with the id of the plugin, it is sent along with the messages
+func (b *UseBus) setIdentity(id uuid.UUID) {
+	b.id = id
+}
+
+// sender returns the identity sent along with the messages, set by the loader for the plugins and by NewHost for the
+// host, the helpers without identity cannot send
+func (b *UseBus) sender() (uuid.UUID, error) {
+	if b.id == uuid.Nil {
+		return uuid.Nil, ErrNoSender
+	}
+	return b.id, nil
+}
+
 // PluginLoaded allows the plugin to check if a loaded plugin is of any interest
 func (b *UseBus) PluginLoaded(plugin Plugin) {
+	b.busesMutex.Lock()
+	defer b.busesMutex.Unlock()
+
+	if b.names == nil {
+		b.names = make(map[uuid.UUID]string)
+	}
+
+	settings := plugin.GetSettings()
+	b.names[settings.ID()] = settings.Name()
+	if aliased, ok := plugin.(AliasedEndpoint); ok {
+		for _, alias := range aliased.Aliases() {
+			b.names[alias] = settings.Name()
+		}
+	}
+
 	if bus, ok := plugin.(BusService); ok {
 		b.buses = append(b.buses, bus)
-		sort.Sort(ByPriority(b.buses))
+		b.reroute()
+	}
+}
+
+// reroute sorts the buses and builds the routing table from their settings, busesMutex must be held
+func (b *UseBus) reroute() {
+	b.generation = atomic.LoadUint64(&settingsGeneration)
+	sort.Stable(ByPriority(b.buses))
+
+	b.enabled = nil
+	b.routes = nil
+	for _, bus := range b.buses {
+		settings := Settings{}
+		if plugin, ok := bus.(Plugin); ok {
+			settings = plugin.GetSettings()
+		}
+
+		if !settings.GetBool(BusSettingEnabled, true) {
+			continue
+		}
+		b.enabled = append(b.enabled, bus)
+
+		var patterns []string
+		settings.GetValue(BusSettingRoutes, &patterns)
+		for _, pattern := range patterns {
+			b.routes = append(b.routes, busRoute{pattern: pattern, bus: bus})
+		}
+	}
+}
+
+// rerouteUpdated rebuilds the routing table if settings were updated since it was built, the priority, the state or
+// the routes of a bus may have changed
+func (b *UseBus) rerouteUpdated() {
+	b.busesMutex.RLock()
+	updated := b.generation != atomic.LoadUint64(&settingsGeneration)
+	b.busesMutex.RUnlock()
+
+	if updated {
+		b.busesMutex.Lock()
+		b.reroute()
+		b.busesMutex.Unlock()
 	}
 }
 
+// busList returns the enabled buses sorted by priority
+func (b *UseBus) busList() []BusService {
+	b.rerouteUpdated()
+
+	b.busesMutex.RLock()
+	defer b.busesMutex.RUnlock()
+	return append([]BusService(nil), b.enabled...)
+}
+
+// busesFor returns the buses routing the endpoint by priority, or all the enabled buses if none routes it
+func (b *UseBus) busesFor(id uuid.UUID) []BusService {
+	b.rerouteUpdated()
+
+	b.busesMutex.RLock()
+	defer b.busesMutex.RUnlock()
+
+	var routed []BusService
+	for _, route := range b.routes {
+		if route.matches(id, b.names[id]) && (len(routed) == 0 || routed[len(routed)-1] != route.bus) {
+			routed = append(routed, route.bus)
+		}
+	}
+
+	if len(routed) > 0 {
+		return routed
+	}
+	return append([]BusService(nil), b.enabled...)
+}
+
+// reaches checks if the messages to the endpoint may go through the bus
+func (b *UseBus) reaches(bus BusService, id uuid.UUID) bool {
+	for _, routed := range b.busesFor(id) {
+		if routed == bus {
+			return true
+		}
+	}
+	return false
+}
+
 // BroadcastMessage sends the message to all clients
 func (b *UseBus) BroadcastMessage(message interface{}) {
-	for _, bus := range b.buses {
+	for _, bus := range b.busList() {
 		bus.HandleBroadcast(message)
 	}
 }
 
+// Publish sends the message to the clients subscribed to the topic
+func (b *UseBus) Publish(topic string, message interface{}) {
+	// Each subscriber is reached through the bus with the highest priority among the ones routing it, the buses
+	// which cannot list their subscribers publish to all of them
+	reached := make(map[uuid.UUID]bool)
+	for _, bus := range b.busList() {
+		subscriberBus, ok := bus.(SubscriberBus)
+		if !ok {
+			bus.HandlePublish(topic, message)
+			continue
+		}
+
+		var subscribers []uuid.UUID
+		for _, id := range subscriberBus.Subscribers(topic) {
+			if !reached[id] && b.reaches(bus, id) {
+				reached[id] = true
+				subscribers = append(subscribers, id)
+			}
+		}
+
+		if len(subscribers) > 0 {
+			subscriberBus.HandlePublishTo(subscribers, topic, message)
+		}
+	}
+}
+
 // SendMessage sends the message to a specific client asynchronously
 func (b *UseBus) SendMessage(uuid uuid.UUID, message interface{}) <-chan interface{} {
-	for _, bus := range b.buses {
-		resChannel, err := bus.HandleMessage(uuid, message)
+	return b.SendMessageContext(context.Background(), uuid, message)
+}
+
+// SendMessageContext is SendMessage giving up on the results once the context is done, through the buses
+// implementing ContextBus
+func (b *UseBus) SendMessageContext(ctx context.Context, uuid uuid.UUID, message interface{}) <-chan interface{} {
+	from, err := b.sender()
+	if err != nil {
+		log.Printf("Cannot send message: %v", err)
+		return nil
+	}
+
+	message = Envelope{From: from, Message: message}
+	for _, bus := range b.busesFor(uuid) {
+		var resChannel <-chan interface{}
+		if contextBus, ok := bus.(ContextBus); ok {
+			resChannel, err = contextBus.HandleMessageContext(ctx, uuid, message)
+		} else {
+			resChannel, err = bus.HandleMessage(uuid, message)
+		}
 		if err != nil {
-			return nil
+			// The endpoint may be reachable through the next bus
+			continue
 		}
 		return resChannel
 	}
@@ -110,3 +399,102 @@ func (b *UseBus) SendMessage(uuid uuid.UUID, message interface{}) <-chan interfa
 	log.Printf("Cannot send message")
 	return nil
 }
+
+// Gather sends the message to every endpoint and returns a channel with one result per endpoint, the channel is
+// closed when all the endpoints answered or the timeout expired
+func (b *UseBus) Gather(message interface{}, timeout time.Duration) <-chan GatherResult {
+	// Each endpoint is reached through the bus with the highest priority among the ones routing it
+	targets := make(map[uuid.UUID]BusService)
+	for _, bus := range b.busList() {
+		for _, id := range bus.Endpoints() {
+			if _, ok := targets[id]; !ok && b.reaches(bus, id) {
+				targets[id] = bus
+			}
+		}
+	}
+
+	results := make(chan GatherResult, len(targets))
+	from, err := b.sender()
+	if err != nil {
+		for id := range targets {
+			results <- GatherResult{UUID: id, Err: err}
+		}
+		close(results)
+		return results
+	}
+	message = Envelope{From: from, Message: message}
+
+	// Every endpoint waits on the same deadline, a closed channel wakes them all
+	deadline := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(deadline) })
+
+	var wg sync.WaitGroup
+	for id, bus := range targets {
+		wg.Add(1)
+		go func(id uuid.UUID, bus BusService) {
+			defer wg.Done()
+
+			ch, err := bus.HandleMessage(id, message)
+			if err != nil || ch == nil {
+				results <- GatherResult{UUID: id, Err: err}
+				return
+			}
+
+			// Only the first result is gathered, the others are drained so the bus does not block on them
+			drain := func() {
+				for range ch {
+				}
+			}
+
+			select {
+			case res := <-ch:
+				results <- GatherResult{UUID: id, Result: res}
+				go drain()
+			case <-deadline:
+				results <- GatherResult{UUID: id, Err: ErrGatherTimeout}
+				go drain()
+			}
+		}(id, bus)
+	}
+
+	go func() {
+		wg.Wait()
+		timer.Stop()
+		close(results)
+	}()
+
+	return results
+}
+
+// StartDurableQueue enables the durable queue mode, the messages sent with SendMessageDurable are persisted in the
+// log file and retried until acknowledged or maxAttempts is reached
+func (b *UseBus) StartDurableQueue(path string, maxAttempts int, done <-chan struct{}) error {
+	queue, err := OpenDurableQueue(path, b.SendMessage)
+	if err != nil {
+		return err
+	}
+
+	if maxAttempts > 0 {
+		queue.MaxAttempts = maxAttempts
+	}
+
+	b.queue = queue
+	go queue.Run(done)
+	return nil
+}
+
+// SendMessageDurable queues the message for a specific client and returns the message id
+func (b *UseBus) SendMessageDurable(target uuid.UUID, message interface{}) (uuid.UUID, error) {
+	if b.queue == nil {
+		return uuid.Nil, errors.New("Durable queue is not started")
+	}
+	return b.queue.Enqueue(target, message)
+}
+
+// DeadLetters returns the messages the durable queue gave up on
+func (b *UseBus) DeadLetters() ([]QueuedMessage, error) {
+	if b.queue == nil {
+		return nil, errors.New("Durable queue is not started")
+	}
+	return b.queue.DeadLetters()
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// silentBus is a bus whose endpoints never answer
+type silentBus struct {
+	endpoints []uuid.UUID
+}
+
+func (b *silentBus) Priority() int                                   { return 0 }
+func (b *silentBus) HandleBroadcast(message interface{})             {}
+func (b *silentBus) HandlePublish(topic string, message interface{}) {}
+func (b *silentBus) Endpoints() []uuid.UUID                          { return b.endpoints }
+
+func (b *silentBus) HandleMessage(id uuid.UUID, message interface{}) (<-chan interface{}, error) {
+	return make(chan interface{}), nil
+}
+
+func TestGatherTimeout(t *testing.T) {
+	bus := &silentBus{endpoints: []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}}
+	b := &UseBus{}
+	b.setIdentity(uuid.New())
+	b.PluginLoaded(&busPlugin{SimplePlugin{Settings: SetupSettings(uuid.New(), "Silent", "")}, bus})
+
+	results := b.Gather("ping", 50*time.Millisecond)
+
+	timeouts := 0
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				if timeouts != len(bus.endpoints) {
+					t.Fatalf("Expected %d timeouts, got %d", len(bus.endpoints), timeouts)
+				}
+				return
+			}
+			if res.Err != ErrGatherTimeout {
+				t.Fatalf("Expected a timeout from %v, got %v", res.UUID, res.Err)
+			}
+			timeouts++
+		case <-deadline:
+			t.Fatalf("Gather did not close the results, %d timeouts", timeouts)
+		}
+	}
+}
+
+// busPlugin loads a bus as a plugin
+type busPlugin struct {
+	SimplePlugin
+	*silentBus
+}
+
+func (p *busPlugin) Priority() int {
+	return p.Settings.GetInt(BusSettingPriority, 0)
+}
+
+// newBusPlugin returns a bus plugin with the settings
+func newBusPlugin(name string, values Settings) *busPlugin {
+	settings := SetupSettings(uuid.New(), name, "")
+	for k, v := range values {
+		settings[k] = v
+	}
+	return &busPlugin{SimplePlugin{Settings: settings}, &silentBus{}}
+}
+
+// aliasedPlugin is a plugin reachable by other uuids
+type aliasedPlugin struct {
+	SimplePlugin
+	aliases []uuid.UUID
+}
+
+func (p *aliasedPlugin) Aliases() []uuid.UUID {
+	return p.aliases
+}
+
+// expectBuses fails the test if the buses are not the expected ones in the same order
+func expectBuses(t *testing.T, what string, got []BusService, expected ...*busPlugin) {
+	t.Helper()
+
+	same := len(got) == len(expected)
+	for i := 0; same && i < len(got); i++ {
+		same = got[i] == BusService(expected[i])
+	}
+	if !same {
+		names := make([]string, len(got))
+		for i, bus := range got {
+			names[i] = bus.(Plugin).GetSettings().Name()
+		}
+		t.Fatalf("Unexpected buses for %s: %v", what, names)
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	routed := uuid.New()
+	replicated := &aliasedPlugin{SimplePlugin{Settings: SetupSettings(uuid.New(), "ReplicatedStorage", "")},
+		[]uuid.UUID{uuid.New()}}
+	other := &SimplePlugin{Settings: SetupSettings(uuid.New(), "Other", "")}
+
+	slow := newBusPlugin("Slow", Settings{BusSettingPriority: 10, BusSettingRoutes: []string{"Replicated*", routed.String()}})
+	fast := newBusPlugin("Fast", Settings{BusSettingPriority: 1, BusSettingRoutes: []string{routed.String()}})
+	plain := newBusPlugin("Plain", Settings{BusSettingPriority: 5})
+
+	b := &UseBus{}
+	for _, plugin := range []Plugin{slow, replicated, fast, other, plain} {
+		b.PluginLoaded(plugin)
+	}
+
+	expectBuses(t, "the broadcasts", b.busList(), fast, plain, slow)
+	expectBuses(t, "a name pattern", b.busesFor(replicated.Settings.ID()), slow)
+	expectBuses(t, "an alias", b.busesFor(replicated.aliases[0]), slow)
+	expectBuses(t, "a uuid routed twice", b.busesFor(routed), fast, slow)
+	expectBuses(t, "an endpoint without route", b.busesFor(other.Settings.ID()), fast, plain, slow)
+	expectBuses(t, "an unknown endpoint", b.busesFor(uuid.New()), fast, plain, slow)
+
+	if b.reaches(plain, replicated.Settings.ID()) || !b.reaches(plain, other.Settings.ID()) {
+		t.Fatal("The bus reaches the endpoints routed through another one")
+	}
+}
+
+func TestBusEnableDisable(t *testing.T) {
+	first := newBusPlugin("First Bus", Settings{BusSettingPriority: 1, BusSettingRoutes: []string{"Routed"}})
+	second := newBusPlugin("Second Bus", Settings{BusSettingPriority: 2})
+	routed := &SimplePlugin{Settings: SetupSettings(uuid.New(), "Routed", "")}
+
+	defer func(p map[string]Plugin) {
+		plugins = p
+	}(plugins)
+	plugins = map[string]Plugin{"First Bus": first, "Second Bus": second, "Routed": routed}
+
+	b := &UseBus{}
+	for _, plugin := range []Plugin{first, second, routed} {
+		b.PluginLoaded(plugin)
+	}
+	expectBuses(t, "the broadcasts", b.busList(), first, second)
+	expectBuses(t, "the routed endpoint", b.busesFor(routed.Settings.ID()), first)
+
+	if err := UpdateSettings("First Bus", map[string]interface{}{BusSettingEnabled: false}); err != nil {
+		t.Fatal(err)
+	}
+	// The routes of a disabled bus are dropped, its endpoints are reached through the enabled buses
+	expectBuses(t, "the broadcasts once disabled", b.busList(), second)
+	expectBuses(t, "the routed endpoint once disabled", b.busesFor(routed.Settings.ID()), second)
+
+	if err := UpdateSettings("First Bus", map[string]interface{}{BusSettingEnabled: true, BusSettingPriority: 3}); err != nil {
+		t.Fatal(err)
+	}
+	expectBuses(t, "the broadcasts once enabled", b.busList(), second, first)
+	expectBuses(t, "the routed endpoint once enabled", b.busesFor(routed.Settings.ID()), first)
+}
@@ -0,0 +1,362 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StorageCacheOptions limits the read cache of a storage, a zero value means no limit
+type StorageCacheOptions struct {
+	MaxEntries int
+	MaxBytes   int
+	TTL        time.Duration
+}
+
+// StorageCacheStats reports the activity of the read cache
+type StorageCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int
+}
+
+// cacheEntry is a cached read result
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	size    int
+	expires time.Time
+}
+
+// storageCache is a read-through LRU cache invalidated by the storage events
+type storageCache struct {
+	options StorageCacheOptions
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int
+	stats   StorageCacheStats
+
+	// pending holds the reads in flight, a read is only cached if nothing invalidated its path meanwhile
+	pending map[string]uint64
+	token   uint64
+
+	// live is set for the namespaces whose watch is up, the cache is bypassed for the other ones as their changes
+	// go unnoticed
+	watched map[uuid.UUID]bool
+	live    map[uuid.UUID]bool
+	done    chan struct{}
+}
+
+func newStorageCache(options StorageCacheOptions) *storageCache {
+	return &storageCache{
+		options: options,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]uint64),
+		watched: make(map[uuid.UUID]bool),
+		live:    make(map[uuid.UUID]bool),
+		done:    make(chan struct{}),
+	}
+}
+
+// cacheKey returns the key of a path in the namespace of the owner
+func cacheKey(owner uuid.UUID, path string) string {
+	return owner.String() + path
+}
+
+// get returns the cached value of the key
+func (c *storageCache) get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*cacheEntry)
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			c.lru.MoveToFront(elem)
+			c.stats.Hits++
+			return e.value, true
+		}
+		c.removeElement(elem)
+	}
+
+	c.stats.Misses++
+	return nil, false
+}
+
+// begin records a read of the key in flight and returns its token, the read is not cached if the watch of the
+// namespace is not live
+func (c *storageCache) begin(owner uuid.UUID, key string) (uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.live[owner] {
+		return 0, false
+	}
+
+	c.token++
+	c.pending[key] = c.token
+	return c.token, true
+}
+
+// put caches the result of the read started with the token
+func (c *storageCache) put(key string, token uint64, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.pending[key] != token {
+		return
+	}
+	delete(c.pending, key)
+
+	size, err := StorageValueSize(value)
+	if err != nil || (c.options.MaxBytes > 0 && size > c.options.MaxBytes) {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+
+	e := &cacheEntry{key: key, value: value, size: size}
+	if c.options.TTL > 0 {
+		e.expires = time.Now().Add(c.options.TTL)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += size
+
+	for (c.options.MaxEntries > 0 && c.lru.Len() > c.options.MaxEntries) ||
+		(c.options.MaxBytes > 0 && c.bytes > c.options.MaxBytes) {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// invalidate drops the cached value of the key and the reads in flight
+func (c *storageCache) invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, key)
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// invalidatePrefix drops every key starting with the prefix
+func (c *storageCache) invalidatePrefix(prefix string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dropPrefix(prefix)
+}
+
+// setLive records whether the watch of the namespace is up, the namespace is flushed when it goes down
+func (c *storageCache) setLive(owner uuid.UUID, live bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.live[owner] = live
+	if !live {
+		c.dropPrefix(cacheKey(owner, ""))
+	}
+}
+
+// dropPrefix drops the keys starting with the prefix and their reads in flight, the mutex must be held
+func (c *storageCache) dropPrefix(prefix string) {
+	for key := range c.pending {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.pending, key)
+		}
+	}
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// removeElement removes an entry, the mutex must be held
+func (c *storageCache) removeElement(elem *list.Element) {
+	e := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+// watch invalidates the cached paths of the namespace when they change, once per namespace, it returns whether the
+// watch is live
+func (c *storageCache) watch(s *UseStorage) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.watched[s.owner] {
+		return c.live[s.owner]
+	}
+	c.watched[s.owner] = true
+
+	// Watching from revision 0 replays the recent history, covering the writes racing the first reads
+	owner := s.owner
+	events := s.watch(StoragePathSeparator, 0, c.done, func(live bool) { c.setLive(owner, live) })
+	go func() {
+		for event := range events {
+			if event.Type == StorageEventCompacted {
+				c.invalidatePrefix(cacheKey(s.owner, ""))
+				continue
+			}
+			c.invalidate(cacheKey(s.owner, event.Path))
+		}
+	}()
+	return false
+}
+
+// currentStats returns the statistics of the cache
+func (c *storageCache) currentStats() StorageCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// EnableCache caches the reads of the storage and of its shared views, the cached values are invalidated by the
+// writes seen through the storage events and the cache is bypassed while the events are not received
+func (s *UseStorage) EnableCache(options StorageCacheOptions) {
+	root := s.root()
+	root.cacheMutex.Lock()
+	defer root.cacheMutex.Unlock()
+
+	if root.cache != nil {
+		close(root.cache.done)
+	}
+	root.cache = newStorageCache(options)
+}
+
+// DisableCache drops the cache and stops watching the storage
+func (s *UseStorage) DisableCache() {
+	root := s.root()
+	root.cacheMutex.Lock()
+	defer root.cacheMutex.Unlock()
+
+	if root.cache != nil {
+		close(root.cache.done)
+		root.cache = nil
+	}
+}
+
+// CacheStats returns the statistics of the cache, they are all zero if the cache is disabled
+func (s *UseStorage) CacheStats() StorageCacheStats {
+	if c := s.storageCache(); c != nil {
+		return c.currentStats()
+	}
+	return StorageCacheStats{}
+}
+
+// storageCache returns the cache of the storage, nil if it is disabled
+func (s *UseStorage) storageCache() *storageCache {
+	root := s.root()
+	root.cacheMutex.Lock()
+	defer root.cacheMutex.Unlock()
+	return root.cache
+}
+
+// cachedRead serves a read from the cache or reads it through
+func (s *UseStorage) cachedRead(c *storageCache, msg StorageMessage) <-chan interface{} {
+	path, err := CleanStoragePath(msg.Path)
+	if err != nil {
+		return s.send(msg)
+	}
+
+	// The cached values are only served while the watch invalidating them is live
+	if !c.watch(s) {
+		return s.send(msg)
+	}
+
+	key := cacheKey(s.owner, path)
+	if value, ok := c.get(key); ok {
+		ch := make(chan interface{}, 1)
+		ch <- value
+		close(ch)
+		return ch
+	}
+
+	token, ok := c.begin(s.owner, key)
+	res := s.send(msg)
+	if res == nil || !ok {
+		return res
+	}
+
+	ch := make(chan interface{})
+	go func() {
+		defer close(ch)
+
+		first := true
+		for value := range res {
+			if first && StorageError(value) == nil {
+				c.put(key, token, value)
+			}
+			first = false
+			ch <- value
+		}
+	}()
+	return ch
+}
+
+// invalidateCache drops the cached paths a message is about to change
+func (s *UseStorage) invalidateCache(msg StorageMessage) {
+	c := s.storageCache()
+	if c == nil {
+		return
+	}
+
+	switch msg.Type {
+	case StorageMessageTypeWrite, StorageMessageTypeDelete:
+		if path, err := CleanStoragePath(msg.Path); err == nil {
+			c.invalidate(cacheKey(s.owner, path))
+		}
+	case StorageMessageTypeBatch:
+		for _, op := range msg.Ops {
+			if path, err := CleanStoragePath(op.Path); err == nil && op.Type != StorageOpCheck {
+				c.invalidate(cacheKey(s.owner, path))
+			}
+		}
+	case StorageMessageTypeDeleteTree:
+		if path, err := CleanStoragePath(msg.Path); err == nil {
+			c.invalidatePrefix(cacheKey(s.owner, path))
+		}
+	case StorageMessageTypeRestore:
+		c.invalidatePrefix("")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// waitCached reads the path until the value is served by the cache
+func waitCached(t *testing.T, storage Storage, cache *UseStorage, path string) interface{} {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		hits := cache.CacheStats().Hits
+		value := <-storage.Read(path)
+		if cache.CacheStats().Hits > hits {
+			return value
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s was never served by the cache", path)
+	return nil
+}
+
+// cacheLive checks if the cache of the storage trusts the watch of the namespace
+func cacheLive(s *UseStorage, owner uuid.UUID) bool {
+	c := s.storageCache()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.live[owner]
+}
+
+func TestCacheSeesWritesOfOtherPlugins(t *testing.T) {
+	owner := uuid.New()
+	writer, engine := newTestStorage(owner)
+	reader := sameTestStorage(writer, uuid.New())
+	if err := writer.Write("/path", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Share("/path", reader.id, StorageAccessRead); err != nil {
+		t.Fatal(err)
+	}
+
+	reader.EnableCache(StorageCacheOptions{})
+	defer reader.DisableCache()
+	shared := reader.Shared(owner)
+
+	if value := waitCached(t, shared, reader, "/path"); value != "first" {
+		t.Fatalf("Expected first, got %v", value)
+	}
+
+	if err := writer.Write("/path", "second"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for value := <-shared.Read("/path"); value != "second"; value = <-shared.Read("/path") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected second, still reading %v", value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// While the watch is down the writes go unnoticed, the reads skip the cache until it is back
+	waitCached(t, shared, reader, "/path")
+	engine.mutex.Lock()
+	engine.closeWatchers()
+	engine.mutex.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); cacheLive(reader, owner); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The cache did not notice the watch went down")
+		}
+	}
+
+	if err := writer.Write("/path", "third"); err != nil {
+		t.Fatal(err)
+	}
+	if value := <-shared.Read("/path"); value != "third" {
+		t.Fatalf("Expected third while the watch is down, got %v", value)
+	}
+}
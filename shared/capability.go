@@ -0,0 +1,190 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	// CapabilityBus is the capability of the BusService plugins
+	CapabilityBus = "bus"
+	// CapabilityEndpoint is the capability of the Endpoint plugins
+	CapabilityEndpoint = "endpoint"
+	// CapabilityRPC is the capability of the RPCService plugins
+	CapabilityRPC = "rpc"
+	// CapabilitySubscriber is the capability of the Subscriber plugins
+	CapabilitySubscriber = "subscriber"
+	// CapabilityStorage is declared by the storage endpoints, the plugins using a storage implement Storage too
+	CapabilityStorage = "storage"
+	// CapabilityEncryptedStorage is declared by the storage endpoints encrypting the values
+	CapabilityEncryptedStorage = "encrypted_storage"
+	// CapabilityReplicatedStorage is declared by the storage endpoints replicating the values
+	CapabilityReplicatedStorage = "replicated_storage"
+	// CapabilityKeyring is declared by the keyring plugins
+	CapabilityKeyring = "keyring"
+)
+
+// interfaceCapabilities are the capabilities of the plugins implementing an interface, they need no declaration
+var interfaceCapabilities = map[string]func(plugin Plugin) bool{
+	CapabilityBus: func(plugin Plugin) bool {
+		_, ok := plugin.(BusService)
+		return ok
+	},
+	CapabilityEndpoint: func(plugin Plugin) bool {
+		_, ok := plugin.(Endpoint)
+		return ok
+	},
+	CapabilityRPC: func(plugin Plugin) bool {
+		_, ok := plugin.(RPCService)
+		return ok
+	},
+	CapabilitySubscriber: func(plugin Plugin) bool {
+		_, ok := plugin.(Subscriber)
+		return ok
+	},
+}
+
+// loaded are the plugins in the order they were loaded, capabilities indexes them by capability
+var loaded []Plugin
+var capabilities = make(map[string][]Plugin)
+
+// capabilityMutex guards loaded, capabilities and interfaceCapabilities, the plugins are found while others load
+var capabilityMutex sync.RWMutex
+
+// RegisterCapability gives a capability to the plugins for which implements returns true, the plugins already loaded
+// included
+func RegisterCapability(capability string, implements func(plugin Plugin) bool) {
+	capabilityMutex.Lock()
+	defer capabilityMutex.Unlock()
+
+	interfaceCapabilities[capability] = implements
+	for _, plugin := range loaded {
+		if implements(plugin) && !hasCapability(plugin, capability) {
+			capabilities[capability] = append(capabilities[capability], plugin)
+		}
+	}
+}
+
+// hasCapability checks if the plugin is indexed with the capability, the caller holds capabilityMutex
+func hasCapability(plugin Plugin, capability string) bool {
+	for _, p := range capabilities[capability] {
+		if p == plugin {
+			return true
+		}
+	}
+	return false
+}
+
+// indexPlugin indexes a loaded plugin by the capabilities of its interfaces and of its manifest
+func indexPlugin(plugin Plugin, manifest *PluginManifest) {
+	capabilityMutex.Lock()
+	defer capabilityMutex.Unlock()
+
+	loaded = append(loaded, plugin)
+
+	var declared []string
+	if manifest != nil {
+		declared = manifest.Capabilities
+	}
+	for capability, implements := range interfaceCapabilities {
+		if implements(plugin) {
+			declared = append(declared, capability)
+		}
+	}
+
+	for _, capability := range declared {
+		if !hasCapability(plugin, capability) {
+			capabilities[capability] = append(capabilities[capability], plugin)
+		}
+	}
+}
+
+// FindPlugins returns the loaded plugins with the capability, in the order they were loaded
+func FindPlugins(capability string) []Plugin {
+	capabilityMutex.RLock()
+	defer capabilityMutex.RUnlock()
+
+	return append([]Plugin(nil), capabilities[capability]...)
+}
+
+// FindPlugin returns the first loaded plugin with the capability, nil if none
+func FindPlugin(capability string) Plugin {
+	capabilityMutex.RLock()
+	defer capabilityMutex.RUnlock()
+
+	if found := capabilities[capability]; len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// PluginCapabilities returns the sorted capabilities of a loaded plugin
+func PluginCapabilities(name string) []string {
+	plugin := GetPlugin(name)
+	if plugin == nil {
+		return nil
+	}
+
+	capabilityMutex.RLock()
+	defer capabilityMutex.RUnlock()
+
+	var found []string
+	for capability := range capabilities {
+		if hasCapability(plugin, capability) {
+			found = append(found, capability)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// FindPluginsOf appends the loaded plugins implementing an interface to the slice of that interface pointed by out,
+// like FindPluginsOf(&buses) with buses a []BusService
+func FindPluginsOf(out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice || v.Elem().Type().Elem().Kind() != reflect.Interface {
+		return errors.New("FindPluginsOf needs a pointer to a slice of interfaces")
+	}
+
+	capabilityMutex.RLock()
+	defer capabilityMutex.RUnlock()
+
+	slice := v.Elem()
+	t := slice.Type().Elem()
+	for _, plugin := range loaded {
+		if reflect.TypeOf(plugin).Implements(t) {
+			slice = reflect.Append(slice, reflect.ValueOf(plugin))
+		}
+	}
+	v.Elem().Set(slice)
+	return nil
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ConfigEnvPrefix is the prefix of the environment variables configuring the plugins, GOAPP_<PLUGIN>_<KEY> sets a
+// key of a plugin, the name of the plugin in upper case and its other characters replaced by underscores
+const ConfigEnvPrefix = "GOAPP_"
+
+// config holds the sections of the configuration file by plugin name or id
+var config = make(map[string]map[string]interface{})
+var configMutex sync.Mutex
+
+// LoadConfig reads a JSON configuration file holding an object of settings per plugin name or id, they are merged
+// into the settings of the plugins loaded afterwards
+func LoadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var sections map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return fmt.Errorf("Invalid configuration %s: %v", path, err)
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	for name, section := range sections {
+		if id, err := uuid.Parse(name); err == nil {
+			name = id.String()
+		}
+		config[name] = section
+	}
+	return nil
+}
+
+// SetConfig merges values into the section of a plugin name or id, like a configuration file or command line flags
+// would, they apply to the plugins loaded afterwards
+func SetConfig(name string, values map[string]interface{}) {
+	if id, err := uuid.Parse(name); err == nil {
+		name = id.String()
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	section := config[name]
+	if section == nil {
+		section = make(map[string]interface{})
+		config[name] = section
+	}
+	for k, v := range values {
+		section[k] = v
+	}
+}
+
+// configEnvName returns the name of a plugin in its environment variables
+func configEnvName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
+
+// configValues returns the section of the plugin in the configuration file, then its environment variables
+func configValues(settings Settings) map[string]interface{} {
+	values := make(map[string]interface{})
+
+	configMutex.Lock()
+	for _, name := range []string{settings.Name(), settings.ID().String()} {
+		for k, v := range config[name] {
+			values[k] = v
+		}
+	}
+	configMutex.Unlock()
+
+	prefix := ConfigEnvPrefix + configEnvName(settings.Name()) + "_"
+	for _, env := range os.Environ() {
+		if kv := strings.SplitN(env, "=", 2); len(kv) == 2 && strings.HasPrefix(kv[0], prefix) {
+			values[strings.ToLower(kv[0][len(prefix):])] = kv[1]
+		}
+	}
+	return values
+}
+
+// applySettings sets the values converted to the type of the current values, a nil value removes the setting
+func applySettings(settings Settings, values map[string]interface{}, errs *SettingsError) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	for _, k := range keys {
+		if k == SettingID || k == SettingName {
+			errs.Problems = append(errs.Problems, fmt.Sprintf("%s cannot be configured", k))
+			continue
+		}
+
+		value := values[k]
+		if value == nil {
+			delete(settings, k)
+			continue
+		}
+
+		if current, ok := settings[k]; ok && current != nil {
+			converted, err := convertSetting(value, reflect.TypeOf(current))
+			if err != nil {
+				errs.Problems = append(errs.Problems, fmt.Sprintf("%s: %v", k, err))
+				continue
+			}
+			value = converted
+		}
+		settings[k] = value
+	}
+}
+
+// ConfigureSettings merges the section of the plugin in the configuration file, then its environment variables, into
+// its settings, the values are converted to the type of the values set in code which act as defaults
+func ConfigureSettings(settings Settings) error {
+	errs := &SettingsError{Name: settings.Name()}
+	applySettings(settings, configValues(settings), errs)
+	return errs.err()
+}
+
+// SettingsConfigured is the interface that, when implemented by a Plugin, is called once its settings are configured
+// and validated, before it is identified and seen by the other plugins. A plugin may still set its id there, like from
+// a state file, the plugin is not loaded if it returns an error.
+type SettingsConfigured interface {
+	SettingsConfigured() error
+}
+
+// SettingsChanged is the interface that, when implemented by a Plugin, is called with the previous settings after
+// its settings are updated at runtime, the update is rolled back if it returns an error
+type SettingsChanged interface {
+	SettingsChanged(previous Settings) error
+}
+
+// SettingsListener is the interface that, when implemented, recieves the notifications of the settings of plugins
+// updated at runtime
+type SettingsListener interface {
+	PluginSettingsChanged(plugin Plugin)
+}
+
+var settingsListeners []SettingsListener
+
+// settingsGeneration counts the updates, the helpers caching settings of other plugins compare it
+var settingsGeneration uint64
+
+// updateMutex serializes the updates, the plugins must not update settings from SettingsChanged
+var updateMutex sync.Mutex
+
+// UpdateSettings changes the settings of a loaded plugin at runtime, like from an admin command. The values are
+// converted and validated like the configuration, then the plugin may reject them and keep its previous settings.
+func UpdateSettings(name string, changes map[string]interface{}) error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+
+	plugin := GetPlugin(name)
+	if plugin == nil {
+		return fmt.Errorf("Unknown plugin %s", name)
+	}
+
+	settings := plugin.GetSettings()
+	previous := settings.Copy()
+	candidate := settings.Copy()
+
+	errs := &SettingsError{Name: name}
+	applySettings(candidate, changes, errs)
+	if schema, ok := plugin.(SettingsSchema); ok {
+		errs.add(ValidateSettings(candidate, schema.Schema()))
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+
+	if len(candidate.Changed(previous)) == 0 {
+		return nil
+	}
+
+	settings.replace(candidate)
+	if callback, ok := plugin.(SettingsChanged); ok {
+		if err := callback.SettingsChanged(previous); err != nil {
+			settings.replace(previous)
+			return fmt.Errorf("%s rejected the settings: %v", name, err)
+		}
+	}
+
+	atomic.AddUint64(&settingsGeneration, 1)
+
+	pluginsMutex.RLock()
+	current := append([]SettingsListener(nil), settingsListeners...)
+	pluginsMutex.RUnlock()
+
+	for _, listener := range current {
+		listener.PluginSettingsChanged(plugin)
+	}
+	return nil
+}
+
+// ReloadConfig reads the configuration file again and updates the loaded plugins with it and with the environment,
+// the settings removed from the file keep their values
+func ReloadConfig(path string) error {
+	if err := LoadConfig(path); err != nil {
+		return err
+	}
+
+	loaded := loadedPlugins()
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].GetSettings().Name() < loaded[j].GetSettings().Name()
+	})
+
+	var errs []string
+	for _, plugin := range loaded {
+		if err := UpdateSettings(plugin.GetSettings().Name(), configValues(plugin.GetSettings())); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// convertSetting converts a configured value to a type, the strings of the environment variables hold JSON for the
+// types other than strings and durations
+func convertSetting(value interface{}, t reflect.Type) (interface{}, error) {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return nil, fmt.Errorf("expected %v, got nothing", t)
+	} else if v.Type() == t {
+		return value, nil
+	}
+
+	// The string kinds are converted directly, a Secret would be redacted by JSON
+	if v.Kind() == reflect.String && t.Kind() == reflect.String {
+		return v.Convert(t).Interface(), nil
+	}
+
+	s, isString := value.(string)
+
+	if isString && t == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("expected a duration, got %q", s)
+		}
+		return d, nil
+	}
+
+	if isString {
+		// The strings which are not JSON are JSON strings, like the uuids
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(s), &decoded); err == nil {
+			value = decoded
+		}
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("expected %v, got %s", t, data)
+	}
+	return ptr.Elem().Interface(), nil
+}
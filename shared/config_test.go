@@ -0,0 +1,132 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// writeConfig writes a configuration file and loads it, the sections of the names are removed by the returned function
+func writeConfig(t *testing.T, content string, names ...string) func() {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		configMutex.Lock()
+		defer configMutex.Unlock()
+		for _, name := range names {
+			delete(config, name)
+		}
+	}
+}
+
+func TestConfigFileAndEnvironment(t *testing.T) {
+	id := uuid.New()
+	settings := SetupSettings(id, "Config Test", "")
+	settings["port"] = 1
+	settings["host"] = "localhost"
+	settings["level"] = "info"
+	settings["timeout"] = time.Second
+	settings["debug"] = false
+	settings["untouched"] = "default"
+
+	defer writeConfig(t, `{
+		"Config Test": {"port": 8080, "host": "file", "level": "name", "timeout": "5s", "debug": true},
+		"`+strings.ToLower(id.String())+`": {"level": "id"}
+	}`, "Config Test", id.String())()
+
+	os.Setenv("GOAPP_CONFIG_TEST_PORT", "9090")
+	os.Setenv("GOAPP_CONFIG_TEST_HOST", "env")
+	os.Setenv("GOAPP_OTHER_TEST_HOST", "other")
+	defer os.Unsetenv("GOAPP_CONFIG_TEST_PORT")
+	defer os.Unsetenv("GOAPP_CONFIG_TEST_HOST")
+	defer os.Unsetenv("GOAPP_OTHER_TEST_HOST")
+
+	if err := ConfigureSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		// The environment overrides the file, and is converted to the type of the default
+		"port": 9090,
+		"host": "env",
+		// The section of the id overrides the section of the name
+		"level":     "id",
+		"timeout":   5 * time.Second,
+		"debug":     true,
+		"untouched": "default",
+	}
+	for key, value := range expected {
+		if !reflect.DeepEqual(settings[key], value) {
+			t.Errorf("Expected %s to be %#v, got %#v", key, value, settings[key])
+		}
+	}
+}
+
+func TestConfigReportsInvalidValues(t *testing.T) {
+	settings := SetupSettings(uuid.New(), "Invalid Config Test", "")
+	settings["port"] = 1
+	settings["timeout"] = time.Second
+
+	defer writeConfig(t, `{"Invalid Config Test": {"port": "many", "name": "Renamed"}}`, "Invalid Config Test")()
+
+	os.Setenv("GOAPP_INVALID_CONFIG_TEST_TIMEOUT", "later")
+	defer os.Unsetenv("GOAPP_INVALID_CONFIG_TEST_TIMEOUT")
+
+	err := ConfigureSettings(settings)
+	se, ok := err.(*SettingsError)
+	if !ok {
+		t.Fatalf("Expected a settings error, got %v", err)
+	}
+	if len(se.Problems) != 3 {
+		t.Fatalf("Expected the 3 problems to be reported, got %v", se.Problems)
+	}
+
+	if settings.Name() != "Invalid Config Test" || settings["port"] != 1 || settings["timeout"] != time.Second {
+		t.Fatalf("The invalid values were applied: %v", settings)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"sync"
+)
+
+// DeliveryQueue runs deliveries one at a time in the order they were pushed
+type DeliveryQueue struct {
+	jobs chan func()
+	// done is closed by Close, no lock is held while a delivery waits for room so a stuck one cannot keep the queue
+	// from closing
+	done  chan struct{}
+	close sync.Once
+}
+
+// NewDeliveryQueue creates a queue able to buffer size pending deliveries
+func NewDeliveryQueue(size int) *DeliveryQueue {
+	q := &DeliveryQueue{jobs: make(chan func(), size), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case job := <-q.jobs:
+				job()
+			case <-q.done:
+				// The deliveries pushed before the queue was closed are still done
+				for {
+					select {
+					case job := <-q.jobs:
+						job()
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return q
+}
+
+// Push adds a delivery to the queue, it returns false if the queue is full or closed and the delivery was dropped
+func (q *DeliveryQueue) Push(job func()) bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// PushWait adds a delivery to the queue and waits for room if it is full, it returns false if the queue is closed,
+// meanwhile too. A delivery pushed while the queue closes may not be done.
+func (q *DeliveryQueue) PushWait(job func()) bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+
+	select {
+	case q.jobs <- job:
+		return true
+	case <-q.done:
+		return false
+	}
+}
+
+// Close stops the queue after the pending deliveries are done
+func (q *DeliveryQueue) Close() {
+	q.close.Do(func() { close(q.done) })
+}
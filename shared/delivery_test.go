@@ -0,0 +1,103 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloseFullDeliveryQueue(t *testing.T) {
+	q := NewDeliveryQueue(1)
+
+	// The delivery running never ends and the next one fills the queue
+	stuck := make(chan struct{})
+	defer close(stuck)
+	started := make(chan struct{})
+	q.Push(func() {
+		close(started)
+		<-stuck
+	})
+	<-started
+	q.Push(func() {})
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.PushWait(func() {})
+	}()
+
+	// Give the delivery the time to wait for room
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for a delivery waiting for room")
+	}
+
+	select {
+	case ok := <-pushed:
+		if ok {
+			t.Fatal("A delivery was queued after the queue was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PushWait kept waiting after the queue was closed")
+	}
+
+	if q.Push(func() {}) || q.PushWait(func() {}) {
+		t.Fatal("A delivery was queued after the queue was closed")
+	}
+}
+
+func TestClosedDeliveryQueueRunsPending(t *testing.T) {
+	q := NewDeliveryQueue(10)
+
+	done := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		i := i
+		q.Push(func() { done <- i })
+	}
+	q.Close()
+
+	for i := 0; i < 10; i++ {
+		select {
+		case n := <-done:
+			if n != i {
+				t.Fatalf("Delivery %d done at position %d", n, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Delivery %d was not done after the close", i)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"encoding/gob"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// HostUUID is the identity of the messages sent by the host program rather than by a plugin, see NewHost. It is only
+// accepted from the process of the endpoint.
+var HostUUID = uuid.MustParse("8E4C7A52-1B0D-4F3A-9C6E-2D5B8F17A9C3")
+
+// ErrNoSender is returned for a message without the envelope of its sender
+var ErrNoSender = errors.New("Message has no sender")
+
+// ErrRemoteHost is returned for a message from another process claiming to be sent by the host
+var ErrRemoteHost = errors.New("The host cannot send messages from another process")
+
+// Envelope carries the identity of the plugin sending a message
+type Envelope struct {
+	From    uuid.UUID
+	Message interface{}
+}
+
+// CallerEndpoint is the interface that, when implemented by an Endpoint, recieves the identity of the sender
+// along with the message
+type CallerEndpoint interface {
+	HandleMessageFrom(from uuid.UUID, message interface{}) (<-chan interface{}, error)
+}
+
+// DispatchMessage is used by the buses to hand a message to an endpoint, it unwraps the messages added by the bus helpers,
+// the messages without the envelope of their sender are rejected
+func DispatchMessage(endpoint Endpoint, message interface{}) (<-chan interface{}, error) {
+	envelope, ok := message.(Envelope)
+	if !ok || envelope.From == uuid.Nil {
+		return nil, ErrNoSender
+	}
+	return dispatch(endpoint, envelope.From, envelope.Message)
+}
+
+// DispatchRemoteMessage is DispatchMessage for the buses receiving the messages from other processes, which cannot
+// claim the identity of the host
+func DispatchRemoteMessage(endpoint Endpoint, message interface{}) (<-chan interface{}, error) {
+	if envelope, ok := message.(Envelope); ok && envelope.From == HostUUID {
+		return nil, ErrRemoteHost
+	}
+	return DispatchMessage(endpoint, message)
+}
+
+func dispatch(endpoint Endpoint, from uuid.UUID, message interface{}) (<-chan interface{}, error) {
+	switch msg := message.(type) {
+	case Envelope:
+		// The outer envelope is added by the bus of the sender, a plugin cannot claim another identity inside it
+		return dispatch(endpoint, from, msg.Message)
+	case QueuedMessage:
+		return handleQueuedMessage(endpoint, from, msg)
+	case RPCRequest:
+		// The caller cannot be claimed by the request itself
+		msg.Caller = from
+		return serveRPC(endpoint, msg)
+	}
+
+	if e, ok := endpoint.(CallerEndpoint); ok {
+		return e.HandleMessageFrom(from, message)
+	}
+	return endpoint.HandleMessage(message)
+}
+
+func init() {
+	gob.Register(Envelope{})
+	gob.Register(BusError{})
+}
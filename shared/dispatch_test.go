@@ -0,0 +1,128 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// callerRecorder remembers the identity of the last message it handled
+type callerRecorder struct {
+	caller uuid.UUID
+}
+
+func (e *callerRecorder) HandleBroadcast(message interface{}) {}
+
+func (e *callerRecorder) HandleMessage(message interface{}) (<-chan interface{}, error) {
+	return e.HandleMessageFrom(uuid.Nil, message)
+}
+
+func (e *callerRecorder) HandleMessageFrom(from uuid.UUID, message interface{}) (<-chan interface{}, error) {
+	e.caller = from
+	return nil, nil
+}
+
+func TestDispatchRejectsMessagesWithoutSender(t *testing.T) {
+	endpoint := &callerRecorder{}
+	if _, err := DispatchMessage(endpoint, "hello"); err != ErrNoSender {
+		t.Fatalf("Expected ErrNoSender, got %v", err)
+	}
+	if _, err := DispatchMessage(endpoint, Envelope{Message: "hello"}); err != ErrNoSender {
+		t.Fatalf("Expected ErrNoSender for an anonymous envelope, got %v", err)
+	}
+}
+
+func TestDispatchKeepsOuterIdentity(t *testing.T) {
+	endpoint := &callerRecorder{}
+	sender := uuid.New()
+
+	// A plugin wrapping its message in an envelope of its own cannot claim to be the host
+	message := Envelope{From: sender, Message: Envelope{From: HostUUID, Message: "hello"}}
+	if _, err := DispatchMessage(endpoint, message); err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.caller != sender {
+		t.Fatalf("Expected caller %v, got %v", sender, endpoint.caller)
+	}
+}
+
+func TestHostSendsAsHost(t *testing.T) {
+	host, err := NewHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := host.sender(); err != nil || id != HostUUID {
+		t.Fatalf("Expected the host identity, got %v %v", id, err)
+	}
+	if id, err := host.Storage(uuid.New()).sender(); err != nil || id != HostUUID {
+		t.Fatalf("Expected the host identity for the storage, got %v %v", id, err)
+	}
+}
+
+func TestNoIdentityCannotSend(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	other := &UseStorage{UUID: storage.UUID}
+	for _, bus := range storage.buses {
+		other.PluginLoaded(bus.(Plugin))
+	}
+
+	// A helper the loader did not set up is not taken for the host
+	if err := other.Write("/value", 1); err != ErrNoSender {
+		t.Fatalf("Expected ErrNoSender, got %v", err)
+	}
+	if err := other.Call(storage.UUID, "Storage.Missing", 0, new(int)); err != ErrNoSender {
+		t.Fatalf("Expected ErrNoSender from Call, got %v", err)
+	}
+	if ch := other.SendMessage(storage.UUID, StorageMessage{Type: StorageMessageTypeRead, Path: "/value"}); ch != nil {
+		t.Fatal("A message was sent without identity")
+	}
+	for result := range other.Gather(StorageMessage{Type: StorageMessageTypeRead, Path: "/value"}, time.Second) {
+		if result.Err != ErrNoSender {
+			t.Fatalf("Expected ErrNoSender from Gather, got %+v", result)
+		}
+	}
+}
+
+func TestNoHostAfterPlugins(t *testing.T) {
+	pluginOpenedMutex.Lock()
+	opened := pluginOpened
+	pluginOpened = true
+	pluginOpenedMutex.Unlock()
+	defer func() {
+		pluginOpenedMutex.Lock()
+		pluginOpened = opened
+		pluginOpenedMutex.Unlock()
+	}()
+
+	if _, err := NewHost(); err != ErrHostAfterPlugins {
+		t.Fatalf("Expected ErrHostAfterPlugins, got %v", err)
+	}
+}
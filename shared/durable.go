@@ -0,0 +1,593 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultQueueMaxAttempts is the number of failed deliveries before a message is moved to the dead-letter queue
+	DefaultQueueMaxAttempts = 10
+	// DefaultQueueBackoff is the delay before the first retry, it doubles on every failure
+	DefaultQueueBackoff = 100 * time.Millisecond
+	// DefaultQueueMaxBackoff is the maximum delay between two retries
+	DefaultQueueMaxBackoff = 30 * time.Second
+	// DefaultQueueAckTimeout is how long to wait for an acknowledgement
+	DefaultQueueAckTimeout = 5 * time.Second
+	// DefaultQueueCompactAfter is the number of messages acknowledged or given up on before the log is rewritten with
+	// the pending messages only
+	DefaultQueueCompactAfter = 1000
+)
+
+// QueuedMessage is a message delivered through a durable queue
+type QueuedMessage struct {
+	ID       uuid.UUID
+	UUID     uuid.UUID
+	Message  interface{}
+	Attempts int
+}
+
+// QueueAck acknowledges the delivery of a queued message
+type QueueAck struct {
+	ID uuid.UUID
+}
+
+const (
+	queueOpEnqueue = iota
+	queueOpAttempt
+	queueOpAck
+	queueOpDead
+)
+
+type queueRecord struct {
+	Op      int
+	Message QueuedMessage
+}
+
+type queueEntry struct {
+	message QueuedMessage
+	next    time.Time
+}
+
+// DurableQueue persists messages in a log file and retries them until they are acknowledged
+type DurableQueue struct {
+	MaxAttempts  int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	AckTimeout   time.Duration
+	CompactAfter int
+
+	path    string
+	file    *os.File
+	send    func(uuid uuid.UUID, message interface{}) <-chan interface{}
+	pending []*queueEntry
+	// settled is the number of messages acknowledged or given up on since the log was rewritten
+	settled int
+	mutex   sync.Mutex
+	wake    chan struct{}
+}
+
+// OpenDurableQueue opens (or creates) the queue log and reloads the messages not acknowledged yet
+func OpenDurableQueue(path string, send func(uuid uuid.UUID, message interface{}) <-chan interface{}) (*DurableQueue, error) {
+	q := &DurableQueue{
+		MaxAttempts:  DefaultQueueMaxAttempts,
+		Backoff:      DefaultQueueBackoff,
+		MaxBackoff:   DefaultQueueMaxBackoff,
+		AckTimeout:   DefaultQueueAckTimeout,
+		CompactAfter: DefaultQueueCompactAfter,
+		path:         path,
+		send:         send,
+		wake:         make(chan struct{}, 1),
+	}
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *DurableQueue) replay() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries := make(map[uuid.UUID]*queueEntry)
+	r := bufio.NewReader(f)
+	for {
+		var record queueRecord
+		if err := ReadRecord(r, &record); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Durable queue %s is truncated: %v", q.path, err)
+			break
+		}
+
+		switch record.Op {
+		case queueOpEnqueue:
+			entry := &queueEntry{message: record.Message}
+			entries[record.Message.ID] = entry
+			q.pending = append(q.pending, entry)
+		case queueOpAttempt:
+			if entry, ok := entries[record.Message.ID]; ok {
+				entry.message.Attempts = record.Message.Attempts
+			}
+		case queueOpAck, queueOpDead:
+			delete(entries, record.Message.ID)
+		}
+	}
+
+	pending := q.pending[:0]
+	for _, entry := range q.pending {
+		if _, ok := entries[entry.message.ID]; ok {
+			pending = append(pending, entry)
+		}
+	}
+	q.pending = pending
+
+	return nil
+}
+
+// compact rewrites the log with the pending messages only, the log is appended to through the rewritten file and the
+// previous one is kept if the rewrite fails
+func (q *DurableQueue) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range q.pending {
+		if err := WriteRecord(f, queueRecord{Op: queueOpEnqueue, Message: entry.message}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := os.Rename(tmp, q.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.settled = 0
+	return nil
+}
+
+func (q *DurableQueue) appendRecord(op int, message QueuedMessage) error {
+	if err := WriteRecord(q.file, queueRecord{Op: op, Message: message}); err != nil {
+		return err
+	}
+	return q.file.Sync()
+}
+
+// Enqueue persists a message for a specific client and returns its id
+func (q *DurableQueue) Enqueue(target uuid.UUID, message interface{}) (id uuid.UUID, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.file == nil {
+		return id, errors.New("Durable queue is closed")
+	}
+
+	msg := QueuedMessage{ID: uuid.New(), UUID: target, Message: message}
+	if err = q.appendRecord(queueOpEnqueue, msg); err != nil {
+		return
+	}
+
+	q.pending = append(q.pending, &queueEntry{message: msg})
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return msg.ID, nil
+}
+
+// DeadLetters returns the messages that could not be delivered after MaxAttempts
+func (q *DurableQueue) DeadLetters() (messages []QueuedMessage, err error) {
+	f, err := os.Open(q.path + ".dead")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var msg QueuedMessage
+		if err := ReadRecord(r, &msg); err == io.EOF {
+			return messages, nil
+		} else if err != nil {
+			return messages, err
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// Run delivers the pending messages until the done channel is closed
+func (q *DurableQueue) Run(done <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			q.mutex.Lock()
+			q.file.Close()
+			q.file = nil
+			q.mutex.Unlock()
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+		timer.Reset(q.deliverDue())
+	}
+}
+
+// deliverDue tries to deliver the messages due and returns the delay until the next one
+func (q *DurableQueue) deliverDue() time.Duration {
+	q.mutex.Lock()
+	due := make([]*queueEntry, 0, len(q.pending))
+	now := time.Now()
+	for _, entry := range q.pending {
+		if !entry.next.After(now) {
+			due = append(due, entry)
+		}
+	}
+	q.mutex.Unlock()
+
+	for _, entry := range due {
+		acked := q.deliver(entry.message)
+
+		q.mutex.Lock()
+		switch {
+		case acked:
+			// A lost ack record only means a redelivery after a restart, which the receiver deduplicates
+			if err := q.appendRecord(queueOpAck, entry.message); err != nil {
+				log.Printf("Durable queue %s failed to record the ack of %v: %v", q.path, entry.message.ID, err)
+			}
+			q.remove(entry)
+			q.settled++
+		case entry.message.Attempts+1 >= q.MaxAttempts:
+			entry.message.Attempts++
+			log.Printf("Message %v to %v failed %d times, moving it to the dead-letter queue", entry.message.ID, entry.message.UUID, entry.message.Attempts)
+			if err := q.appendDead(entry.message); err != nil {
+				// Keep the message pending rather than losing it
+				log.Printf("Durable queue %s failed to write the dead letter %v: %v", q.path, entry.message.ID, err)
+				entry.next = time.Now().Add(q.MaxBackoff)
+				break
+			}
+			if err := q.appendRecord(queueOpDead, entry.message); err != nil {
+				log.Printf("Durable queue %s failed to record the dead letter %v: %v", q.path, entry.message.ID, err)
+			}
+			q.remove(entry)
+			q.settled++
+		default:
+			entry.message.Attempts++
+			if err := q.appendRecord(queueOpAttempt, entry.message); err != nil {
+				log.Printf("Durable queue %s failed to record the attempt on %v: %v", q.path, entry.message.ID, err)
+			}
+			entry.next = time.Now().Add(q.backoff(entry.message.Attempts))
+		}
+		q.mutex.Unlock()
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// The log would keep the settled messages until the next restart
+	if q.CompactAfter > 0 && q.settled >= q.CompactAfter {
+		if err := q.compact(); err != nil {
+			log.Printf("Durable queue %s failed to compact: %v", q.path, err)
+		}
+	}
+
+	delay := q.MaxBackoff
+	now = time.Now()
+	for _, entry := range q.pending {
+		if d := entry.next.Sub(now); d < delay {
+			delay = d
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+func (q *DurableQueue) deliver(msg QueuedMessage) bool {
+	ch := q.send(msg.UUID, msg)
+	if ch == nil {
+		return false
+	}
+
+	select {
+	case res := <-ch:
+		ack, ok := res.(QueueAck)
+		return ok && ack.ID == msg.ID
+	case <-time.After(q.AckTimeout):
+		return false
+	}
+}
+
+func (q *DurableQueue) backoff(attempts int) time.Duration {
+	delay := q.Backoff
+	for i := 1; i < attempts && delay < q.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.MaxBackoff {
+		delay = q.MaxBackoff
+	}
+	return delay
+}
+
+func (q *DurableQueue) appendDead(msg QueuedMessage) error {
+	f, err := os.OpenFile(q.path+".dead", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return WriteRecord(f, msg)
+}
+
+func (q *DurableQueue) remove(entry *queueEntry) {
+	for i, e := range q.pending {
+		if e == entry {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// maxDeliveredMessages bounds the number of message ids remembered for deduplication
+const maxDeliveredMessages = 10000
+
+type deliveryRecord struct {
+	ID uuid.UUID
+}
+
+var delivered = make(map[uuid.UUID]struct{})
+var deliveredOrder []uuid.UUID
+var delivering = make(map[uuid.UUID]chan struct{})
+var deliveryLog *os.File
+var deliveryLogPath string
+
+// deliveryLogRecords is the number of ids in the delivery log, it is rewritten with the remembered ones when it
+// holds twice as many
+var deliveryLogRecords int
+var deliveredMutex sync.Mutex
+
+// OpenDeliveryLog persists the ids of the queued messages delivered to the endpoints of this process, so a message
+// redelivered after a restart is still acknowledged without being handled twice
+func OpenDeliveryLog(path string) error {
+	deliveredMutex.Lock()
+	defer deliveredMutex.Unlock()
+
+	if deliveryLog != nil {
+		if path == deliveryLogPath {
+			return nil
+		}
+		return errors.New("Delivery log is already open")
+	}
+
+	if f, err := os.Open(path); err == nil {
+		r := bufio.NewReader(f)
+		for {
+			var record deliveryRecord
+			if err := ReadRecord(r, &record); err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("Delivery log %s is truncated: %v", path, err)
+				break
+			}
+			remember(record.ID)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	deliveryLogPath = path
+	return rewriteDeliveryLog()
+}
+
+// rewriteDeliveryLog rewrites the delivery log with the remembered ids only, deliveredMutex must be held
+func rewriteDeliveryLog() error {
+	tmp := deliveryLogPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, id := range deliveredOrder {
+		if err := WriteRecord(w, deliveryRecord{ID: id}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := os.Rename(tmp, deliveryLogPath); err != nil {
+		f.Close()
+		return err
+	}
+
+	if deliveryLog != nil {
+		deliveryLog.Close()
+	}
+	deliveryLog = f
+	deliveryLogRecords = len(deliveredOrder)
+	return nil
+}
+
+// remember adds a delivered id, deliveredMutex must be held
+func remember(id uuid.UUID) {
+	if _, ok := delivered[id]; ok {
+		return
+	}
+
+	delivered[id] = struct{}{}
+	deliveredOrder = append(deliveredOrder, id)
+	if len(deliveredOrder) > maxDeliveredMessages {
+		delete(delivered, deliveredOrder[0])
+		deliveredOrder = deliveredOrder[1:]
+	}
+}
+
+// claimDelivery returns true when the message has to be handled, a delivery of the same message in progress is
+// waited for so the message is handled at most once
+func claimDelivery(id uuid.UUID) bool {
+	deliveredMutex.Lock()
+	defer deliveredMutex.Unlock()
+
+	for {
+		if _, ok := delivered[id]; ok {
+			return false
+		}
+
+		wait, ok := delivering[id]
+		if !ok {
+			break
+		}
+
+		deliveredMutex.Unlock()
+		<-wait
+		deliveredMutex.Lock()
+	}
+
+	delivering[id] = make(chan struct{})
+	return true
+}
+
+// finishDelivery ends a delivery claimed with claimDelivery, a handled message is remembered and persisted
+func finishDelivery(id uuid.UUID, handled bool) error {
+	deliveredMutex.Lock()
+	defer deliveredMutex.Unlock()
+
+	if wait, ok := delivering[id]; ok {
+		close(wait)
+		delete(delivering, id)
+	}
+
+	if !handled {
+		return nil
+	}
+
+	remember(id)
+
+	if deliveryLog == nil {
+		return nil
+	}
+
+	if err := WriteRecord(deliveryLog, deliveryRecord{ID: id}); err != nil {
+		return err
+	}
+	if err := deliveryLog.Sync(); err != nil {
+		return err
+	}
+
+	if deliveryLogRecords++; deliveryLogRecords >= 2*maxDeliveredMessages {
+		return rewriteDeliveryLog()
+	}
+	return nil
+}
+
+// handleQueuedMessage delivers a queued message once and acknowledges it
+func handleQueuedMessage(endpoint Endpoint, from uuid.UUID, msg QueuedMessage) (<-chan interface{}, error) {
+	if claimDelivery(msg.ID) {
+		ch, err := dispatch(endpoint, from, msg.Message)
+		if err != nil {
+			finishDelivery(msg.ID, false)
+			return nil, err
+		}
+
+		if ch != nil {
+			for range ch {
+				// The results are not sent back to the queue
+			}
+		}
+
+		// Without a persisted delivery the message is not acknowledged, the sender retries it and the id
+		// remembered in memory keeps it from being handled again
+		if err := finishDelivery(msg.ID, true); err != nil {
+			return nil, err
+		}
+	}
+
+	ack := make(chan interface{}, 1)
+	ack <- QueueAck{ID: msg.ID}
+	close(ack)
+	return ack, nil
+}
+
+func init() {
+	gob.Register(QueuedMessage{})
+	gob.Register(QueueAck{})
+}
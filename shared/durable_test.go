@@ -0,0 +1,420 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type countingEndpoint struct {
+	handled int32
+}
+
+func (e *countingEndpoint) HandleBroadcast(message interface{}) {}
+
+func (e *countingEndpoint) HandleMessage(message interface{}) (<-chan interface{}, error) {
+	atomic.AddInt32(&e.handled, 1)
+	time.Sleep(10 * time.Millisecond)
+	return nil, nil
+}
+
+func resetDeliveries() {
+	deliveredMutex.Lock()
+	defer deliveredMutex.Unlock()
+
+	if deliveryLog != nil {
+		deliveryLog.Close()
+		deliveryLog = nil
+	}
+	deliveryLogPath = ""
+	delivered = make(map[uuid.UUID]struct{})
+	deliveredOrder = nil
+}
+
+func TestQueuedMessageHandledOnce(t *testing.T) {
+	resetDeliveries()
+	defer resetDeliveries()
+
+	endpoint := &countingEndpoint{}
+	msg := QueuedMessage{ID: uuid.New(), Message: "hello"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch, err := handleQueuedMessage(endpoint, uuid.New(), msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ack, ok := (<-ch).(QueueAck); !ok || ack.ID != msg.ID {
+				t.Errorf("Unexpected ack %v", ack)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if handled := atomic.LoadInt32(&endpoint.handled); handled != 1 {
+		t.Fatalf("Message handled %d times", handled)
+	}
+}
+
+func TestDeliveryLogSurvivesRestart(t *testing.T) {
+	resetDeliveries()
+	defer resetDeliveries()
+
+	dir, err := ioutil.TempDir("", "delivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "delivered")
+	if err := OpenDeliveryLog(path); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := &countingEndpoint{}
+	msg := QueuedMessage{ID: uuid.New(), Message: "hello"}
+	if _, err := handleQueuedMessage(endpoint, uuid.New(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart forgets the ids kept in memory
+	resetDeliveries()
+	if err := OpenDeliveryLog(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handleQueuedMessage(endpoint, uuid.New(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if handled := atomic.LoadInt32(&endpoint.handled); handled != 1 {
+		t.Fatalf("Message handled %d times across a restart", handled)
+	}
+}
+
+func TestReadRecordTooLarge(t *testing.T) {
+	f, err := ioutil.TempFile("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// A corrupted length prefix must not allocate the announced size
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Seek(0, 0)
+
+	var value string
+	if err := ReadRecord(f, &value); err != ErrRecordTooLarge {
+		t.Fatalf("Expected ErrRecordTooLarge, got %v", err)
+	}
+}
+
+// testSender acknowledges the queued messages after failing a number of times
+type testSender struct {
+	failures int
+	mutex    sync.Mutex
+	sent     []time.Time
+	acked    []uuid.UUID
+}
+
+func (s *testSender) send(target uuid.UUID, message interface{}) <-chan interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sent = append(s.sent, time.Now())
+	if len(s.sent) <= s.failures {
+		return nil
+	}
+
+	msg := message.(QueuedMessage)
+	s.acked = append(s.acked, msg.ID)
+	ch := make(chan interface{}, 1)
+	ch <- QueueAck{ID: msg.ID}
+	close(ch)
+	return ch
+}
+
+// wait waits until the condition on the sends is met
+func (s *testSender) wait(t *testing.T, what string, done func(sent int, acked int) bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		ok := done(len(s.sent), len(s.acked))
+		s.mutex.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+// runQueue opens the queue and delivers its messages until the returned function is called
+func runQueue(t *testing.T, path string, s *testSender, setup func(q *DurableQueue)) (*DurableQueue, func()) {
+	q, err := OpenDurableQueue(path, s.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Backoff = 10 * time.Millisecond
+	q.MaxBackoff = 200 * time.Millisecond
+	q.AckTimeout = 100 * time.Millisecond
+	if setup != nil {
+		setup(q)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		q.Run(done)
+		close(stopped)
+	}()
+
+	return q, func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func tempQueuePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "queue"), func() { os.RemoveAll(dir) }
+}
+
+func TestQueueRetriesWithBackoff(t *testing.T) {
+	path, remove := tempQueuePath(t)
+	defer remove()
+
+	s := &testSender{failures: 3}
+	q, stop := runQueue(t, path, s, nil)
+	defer stop()
+
+	if _, err := q.Enqueue(uuid.New(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t, "the ack", func(sent int, acked int) bool { return acked == 1 })
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.sent) != 4 {
+		t.Fatalf("Message sent %d times, expected 4", len(s.sent))
+	}
+	for i := 1; i < len(s.sent); i++ {
+		if gap, backoff := s.sent[i].Sub(s.sent[i-1]), q.backoff(i); gap < backoff {
+			t.Fatalf("Retry %d after %v, expected at least %v", i, gap, backoff)
+		}
+	}
+}
+
+func TestQueueBackoffLimit(t *testing.T) {
+	q := &DurableQueue{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000, 1000}
+	for i, delay := range expected {
+		if backoff := q.backoff(i + 1); backoff != delay*time.Millisecond {
+			t.Fatalf("Backoff of attempt %d is %v, expected %v", i+1, backoff, delay*time.Millisecond)
+		}
+	}
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	path, remove := tempQueuePath(t)
+	defer remove()
+
+	s := &testSender{failures: 1000}
+	q, stop := runQueue(t, path, s, func(q *DurableQueue) { q.MaxAttempts = 3 })
+	defer stop()
+
+	id, err := q.Enqueue(uuid.New(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t, "the attempts", func(sent int, acked int) bool { return sent >= 3 })
+
+	var dead []QueuedMessage
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dead) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		if dead, err = q.DeadLetters(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(dead) != 1 || dead[0].ID != id || dead[0].Attempts != 3 {
+		t.Fatalf("Unexpected dead letters %+v", dead)
+	}
+
+	// No more attempts once given up on
+	time.Sleep(100 * time.Millisecond)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.sent) != 3 {
+		t.Fatalf("Message sent %d times, expected 3", len(s.sent))
+	}
+}
+
+func TestQueueReplayAfterRestart(t *testing.T) {
+	path, remove := tempQueuePath(t)
+	defer remove()
+
+	// The queue stops before delivering anything, as if the process was killed
+	q, err := OpenDurableQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := q.Enqueue(uuid.New(), "first")
+	second, _ := q.Enqueue(uuid.New(), "second")
+	q.file.Close()
+
+	s := &testSender{}
+	_, stop := runQueue(t, path, s, nil)
+	s.wait(t, "the acks", func(sent int, acked int) bool { return acked == 2 })
+	stop()
+
+	if s.acked[0] != first || s.acked[1] != second {
+		t.Fatalf("Replayed %v, expected %v and %v", s.acked, first, second)
+	}
+
+	// The acknowledged messages are not replayed again
+	q, err = OpenDurableQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.file.Close()
+	if len(q.pending) != 0 {
+		t.Fatalf("%d messages replayed after their ack", len(q.pending))
+	}
+}
+
+func TestQueueAttemptsSurviveRestart(t *testing.T) {
+	path, remove := tempQueuePath(t)
+	defer remove()
+
+	maxAttempts := func(q *DurableQueue) { q.MaxAttempts = 4 }
+
+	s := &testSender{failures: 1000}
+	q, stop := runQueue(t, path, s, maxAttempts)
+	if _, err := q.Enqueue(uuid.New(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	s.wait(t, "two attempts", func(sent int, acked int) bool { return sent >= 2 })
+	stop()
+
+	s.mutex.Lock()
+	before := len(s.sent)
+	s.mutex.Unlock()
+
+	// The attempts before the restart count towards the maximum
+	q, stop = runQueue(t, path, s, maxAttempts)
+	defer stop()
+	s.wait(t, "the remaining attempts", func(sent int, acked int) bool { return sent >= 4 })
+
+	time.Sleep(300 * time.Millisecond)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.sent) != 4 {
+		t.Fatalf("Message sent %d times with %d before the restart, expected 4", len(s.sent), before)
+	}
+}
+
+func TestQueueCompactsWhileRunning(t *testing.T) {
+	path, remove := tempQueuePath(t)
+	defer remove()
+
+	const messages = 50
+
+	s := &testSender{}
+	q, stop := runQueue(t, path, s, func(q *DurableQueue) { q.CompactAfter = 10 })
+	for i := 0; i < messages; i++ {
+		if _, err := q.Enqueue(uuid.New(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.wait(t, "the acks", func(sent int, acked int) bool { return acked == messages })
+	stop()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records := 0
+	for {
+		var record queueRecord
+		if err := ReadRecord(f, &record); err != nil {
+			break
+		}
+		records++
+	}
+
+	// Without compaction the log holds an enqueue and an ack record per message
+	if records >= 2*q.CompactAfter {
+		t.Fatalf("Log holds %d records after %d acks", records, messages)
+	}
+}
+
+func TestBusDeliveryLog(t *testing.T) {
+	resetDeliveries()
+	defer resetDeliveries()
+
+	dir, err := ioutil.TempDir("", "delivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every bus of the process opens the same log
+	settings := SetupSettings(uuid.New(), "Bus", "")
+	settings[BusSettingDeliveryLog] = filepath.Join(dir, "delivered")
+	for i := 0; i < 2; i++ {
+		if err := OpenBusDeliveryLog(settings); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings[BusSettingDeliveryLog] = filepath.Join(dir, "other")
+	if err := OpenBusDeliveryLog(settings); err == nil {
+		t.Fatal("A second delivery log was opened")
+	}
+}
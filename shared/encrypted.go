@@ -0,0 +1,280 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// StorageKeySize is the size of the keys created for the encrypted backends
+const StorageKeySize = 32
+
+// ErrStorageCorrupted is returned when a stored value cannot be decrypted
+var ErrStorageCorrupted = errors.New("The stored value cannot be decrypted")
+
+// LoadStorageKey reads the key of an encrypted backend, a random key is created if the file does not exist
+func LoadStorageKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) != StorageKeySize {
+			return nil, fmt.Errorf("The storage key %s must be %d bytes", path, StorageKeySize)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, StorageKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	// The key is never replaced, the values encrypted with it would be lost
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created the storage key %s", path)
+	return key, nil
+}
+
+// sealedValue wraps the values so nil values can be encoded too
+type sealedValue struct {
+	Value interface{}
+}
+
+// EncryptedBackend encrypts the values with AES-GCM before storing them in another backend, the keys and the
+// metadata are left in clear for the scans
+type EncryptedBackend struct {
+	inner StorageBackend
+	aead  cipher.AEAD
+}
+
+// Make sure EncryptedBackend implements required interfaces
+var _ StorageBackend = (*EncryptedBackend)(nil)
+var _ ArchiveSealer = (*EncryptedBackend)(nil)
+
+// NewEncryptedBackend encrypts the values stored in the inner backend with the key, an AES key of 16, 24 or 32 bytes
+func NewEncryptedBackend(inner StorageBackend, key []byte) (*EncryptedBackend, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedBackend{inner: inner, aead: aead}, nil
+}
+
+// encrypt returns the nonce followed by the encrypted data, the additional data is authenticated
+func (b *EncryptedBackend) encrypt(plain []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+// decrypt returns the data encrypted by encrypt with the same additional data
+func (b *EncryptedBackend) decrypt(data []byte, additional []byte) ([]byte, error) {
+	if len(data) < b.aead.NonceSize() {
+		return nil, ErrStorageCorrupted
+	}
+
+	nonce := data[:b.aead.NonceSize()]
+	plain, err := b.aead.Open(nil, nonce, data[len(nonce):], additional)
+	if err != nil {
+		return nil, ErrStorageCorrupted
+	}
+	return plain, nil
+}
+
+// seal replaces the value of the record with its encrypted encoding, the key is authenticated so a value cannot be
+// moved to another key
+func (b *EncryptedBackend) seal(record StorageRecord) (StorageRecord, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sealedValue{record.Value}); err != nil {
+		return record, err
+	}
+
+	data, err := b.encrypt(buf.Bytes(), []byte(record.Key))
+	if err != nil {
+		return record, err
+	}
+
+	record.Value = data
+	return record, nil
+}
+
+// open decrypts the value of a sealed record
+func (b *EncryptedBackend) open(record StorageRecord) (StorageRecord, error) {
+	data, ok := record.Value.([]byte)
+	if !ok {
+		return record, ErrStorageCorrupted
+	}
+
+	plain, err := b.decrypt(data, []byte(record.Key))
+	if err != nil {
+		return record, err
+	}
+
+	var value sealedValue
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(&value); err != nil {
+		return record, err
+	}
+
+	record.Value = value.Value
+	return record, nil
+}
+
+// sealedArchive is the content of an archive encrypted by SealArchive
+type sealedArchive struct {
+	Entries []StorageArchiveEntry
+	Grants  []StorageArchiveGrant
+}
+
+// archiveData is the authenticated data of an archive, so the content cannot be moved to another archive
+func archiveData(archive StorageArchive) []byte {
+	return []byte(fmt.Sprintf("%d %v %d", archive.Format, archive.Storage, archive.Revision))
+}
+
+// SealArchive replaces the entries and the grants of the archive with their encrypted encoding
+func (b *EncryptedBackend) SealArchive(archive StorageArchive) (StorageArchive, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sealedArchive{Entries: archive.Entries, Grants: archive.Grants}); err != nil {
+		return archive, err
+	}
+
+	data, err := b.encrypt(buf.Bytes(), archiveData(archive))
+	if err != nil {
+		return archive, err
+	}
+
+	archive.Entries, archive.Grants, archive.Sealed = nil, nil, data
+	return archive, nil
+}
+
+// OpenArchive decrypts an archive sealed with the same key
+func (b *EncryptedBackend) OpenArchive(archive StorageArchive) (StorageArchive, error) {
+	plain, err := b.decrypt(archive.Sealed, archiveData(archive))
+	if err != nil {
+		return archive, ErrStorageArchiveSealed
+	}
+
+	var content sealedArchive
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(&content); err != nil {
+		return archive, err
+	}
+
+	archive.Entries, archive.Grants, archive.Sealed = content.Entries, content.Grants, nil
+	return archive, nil
+}
+
+// Get returns the record stored at the key
+func (b *EncryptedBackend) Get(key string) (StorageRecord, bool, error) {
+	record, ok, err := b.inner.Get(key)
+	if !ok || err != nil {
+		return record, ok, err
+	}
+
+	record, err = b.open(record)
+	return record, err == nil, err
+}
+
+// Put stores the record at its key
+func (b *EncryptedBackend) Put(record StorageRecord) error {
+	sealed, err := b.seal(record)
+	if err != nil {
+		return err
+	}
+	return b.inner.Put(sealed)
+}
+
+// Delete removes the record stored at the key
+func (b *EncryptedBackend) Delete(key string) error {
+	return b.inner.Delete(key)
+}
+
+// Scan calls fn with the records from start to end in the order of the keys until it returns false
+func (b *EncryptedBackend) Scan(start string, end string, fn func(record StorageRecord) bool) error {
+	var err error
+	scanErr := b.inner.Scan(start, end, func(record StorageRecord) bool {
+		if record, err = b.open(record); err != nil {
+			return false
+		}
+		return fn(record)
+	})
+
+	if scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+// Snapshot returns a copy of all the records in the order of the keys
+func (b *EncryptedBackend) Snapshot() ([]StorageRecord, error) {
+	records, err := b.inner.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range records {
+		if records[i], err = b.open(records[i]); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// Close closes the inner backend
+func (b *EncryptedBackend) Close() error {
+	return b.inner.Close()
+}
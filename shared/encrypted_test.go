@@ -0,0 +1,102 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// newEncryptedTestStorage returns the host storage of an engine encrypting its values with a random key
+func newEncryptedTestStorage(t *testing.T) *UseStorage {
+	key := make([]byte, StorageKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewEncryptedBackend(NewMemoryBackend(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, engine := newTestStorage(uuid.New())
+	if err := engine.SetBackend(backend); err != nil {
+		t.Fatal(err)
+	}
+	return sameTestStorage(storage, uuid.Nil)
+}
+
+func TestEncryptedSnapshotIsSealed(t *testing.T) {
+	storage := newEncryptedTestStorage(t)
+	if err := storage.Write("/secrets/password", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := storage.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.Entries) != 0 || archive.Sealed == nil {
+		t.Fatalf("Expected a sealed archive, got %d entries", len(archive.Entries))
+	}
+
+	var buf bytes.Buffer
+	if err := WriteStorageArchive(&buf, archive); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := ReadStorageArchive(&buf); err != nil || !bytes.Equal(read.Sealed, archive.Sealed) {
+		t.Fatalf("Cannot read the sealed archive back: %v", err)
+	}
+	if bytes.Contains(archive.Sealed, []byte("hunter2")) {
+		t.Fatal("The archive holds the value in clear")
+	}
+
+	// The storage which sealed the archive restores it
+	if err := storage.Write("/secrets/password", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Restore(archive, uuid.Nil); err != nil {
+		t.Fatal(err)
+	}
+	if value := <-storage.Read("/secrets/password"); value != "hunter2" {
+		t.Fatalf("Expected the restored value, got %v", value)
+	}
+
+	// The other storages do not have the key
+	if err := newEncryptedTestStorage(t).Restore(archive, uuid.Nil); err != ErrStorageArchiveSealed {
+		t.Fatalf("Expected another encrypted storage to refuse the archive, got %v", err)
+	}
+	plain, _ := newTestStorage(uuid.New())
+	if err := sameTestStorage(plain, uuid.Nil).Restore(archive, uuid.Nil); err != ErrStorageArchiveSealed {
+		t.Fatalf("Expected a storage in clear to refuse the archive, got %v", err)
+	}
+}
@@ -0,0 +1,1289 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StorageExpiryInterval is how often the storage endpoints remove the expired values
+const StorageExpiryInterval = time.Second
+
+// storageHistory is the number of events kept to resume the watches
+const storageHistory = 1000
+
+// storageWatchBuffer is the number of events buffered per watcher, a watcher falling behind is closed and resumes
+const storageWatchBuffer = 256
+
+// storageGrantsPrefix is the prefix of the backend keys holding the grants of the namespaces, the keys of the values
+// start with a slash
+const storageGrantsPrefix = "#grants/"
+
+// storageGrant shares a path of a namespace with another plugin
+type storageGrant struct {
+	path    string
+	grantee uuid.UUID
+	access  int
+}
+
+// storageChange is an event of a namespace
+type storageChange struct {
+	owner uuid.UUID
+	event StorageEvent
+}
+
+// storageWatcher streams the changes below a prefix of a namespace
+type storageWatcher struct {
+	caller uuid.UUID
+	owner  uuid.UUID
+	prefix string
+	ch     chan interface{}
+}
+
+// StorageEngine answers the storage messages on top of a StorageBackend
+type StorageEngine struct {
+	id uuid.UUID
+
+	// backend holds the values, the keys are the paths prefixed by the namespace
+	backend StorageBackend
+	// revision is incremented on every change, the versions of the values are the revisions they were changed at
+	revision uint64
+	// grants are the paths shared by each namespace
+	grants  map[uuid.UUID][]storageGrant
+	history []storageChange
+	// compacted is the last revision whose events are no longer in the history
+	compacted uint64
+	watchers  map[uuid.UUID]*storageWatcher
+	// usage counts the keys and bytes stored by each namespace
+	usage map[uuid.UUID]StorageUsage
+	// expiring keeps the expiry times of the keys with one
+	expiring map[string]time.Time
+
+	// Quota returns the quota of a namespace, no namespace is limited if nil
+	Quota func(owner uuid.UUID) StorageQuota
+
+	// now is the time the message being handled is applied at
+	now time.Time
+	// mutex serializes the access to the backend, the grants and the watchers
+	mutex sync.Mutex
+}
+
+// NewStorageEngine creates an empty storage in memory, the id is the storage written in the archives
+func NewStorageEngine(id uuid.UUID) *StorageEngine {
+	return &StorageEngine{
+		id:       id,
+		backend:  NewMemoryBackend(),
+		grants:   make(map[uuid.UUID][]storageGrant),
+		watchers: make(map[uuid.UUID]*storageWatcher),
+		usage:    make(map[uuid.UUID]StorageUsage),
+		expiring: make(map[string]time.Time),
+	}
+}
+
+// StorageMessageChanges checks if a message type changes the storage, the other ones only read it
+func StorageMessageChanges(msgType int) bool {
+	switch msgType {
+	case StorageMessageTypeWrite, StorageMessageTypeDelete, StorageMessageTypeShare, StorageMessageTypeBatch,
+		StorageMessageTypeDeleteTree, StorageMessageTypeRestore:
+		return true
+	}
+	return false
+}
+
+// SetBackend closes the current backend and continues with the values and the grants of the new one, the watches are
+// closed as their history is lost
+func (e *StorageEngine) SetBackend(backend StorageBackend) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var revision uint64
+	grants := make(map[uuid.UUID][]storageGrant)
+	usage := make(map[uuid.UUID]StorageUsage)
+	expiring := make(map[string]time.Time)
+
+	err := backend.Scan("", "", func(record StorageRecord) bool {
+		if strings.HasPrefix(record.Key, storageGrantsPrefix) {
+			owner, err := uuid.Parse(record.Key[len(storageGrantsPrefix):])
+			gs, ok := record.Value.([]StorageArchiveGrant)
+			if err != nil || !ok {
+				log.Printf("Invalid grants %s", record.Key)
+				return true
+			}
+
+			for _, g := range gs {
+				grants[owner] = append(grants[owner], storageGrant{path: g.Path, grantee: g.Grantee, access: g.Access})
+			}
+			return true
+		}
+
+		owner, _, err := splitStorageKey(record.Key)
+		if err != nil {
+			log.Printf("Invalid storage key %s", record.Key)
+			return true
+		}
+
+		u := usage[owner]
+		u.Keys++
+		u.Bytes += record.Size
+		usage[owner] = u
+
+		if !record.Expires.IsZero() {
+			expiring[record.Key] = record.Expires
+		}
+		if record.Version > revision {
+			revision = record.Version
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := e.backend.Close(); err != nil {
+		log.Printf("Cannot close the storage backend: %v", err)
+	}
+
+	e.backend = backend
+	e.revision = revision
+	e.grants = grants
+	e.usage = usage
+	e.expiring = expiring
+	e.history = nil
+	e.compacted = revision
+	e.closeWatchers()
+	return nil
+}
+
+// RunExpiry removes the expired values every StorageExpiryInterval until done is closed
+func (e *StorageEngine) RunExpiry(done <-chan struct{}) {
+	ticker := time.NewTicker(StorageExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			e.Expire(now)
+		}
+	}
+}
+
+// Close stops all the watches and closes the backend
+func (e *StorageEngine) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.closeWatchers()
+	return e.backend.Close()
+}
+
+// HandleMessageFrom handles the messages in the namespace of the caller or in the namespaces shared with it
+func (e *StorageEngine) HandleMessageFrom(caller uuid.UUID, message interface{}) (<-chan interface{}, error) {
+	return e.Apply(caller, message, time.Now())
+}
+
+// Apply is HandleMessageFrom at a given time, the replicas applying the same messages at the same times end up
+// with the same values and versions
+func (e *StorageEngine) Apply(caller uuid.UUID, message interface{}, now time.Time) (<-chan interface{}, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.now = now
+
+	if storageMsg, ok := message.(StorageMessage); ok {
+		if caller == uuid.Nil {
+			log.Printf("Access denied to %s for a message without sender", storageMsg.Path)
+			return storageResult(BusError{Message: ErrStorageAccessDenied.Error()}), nil
+		}
+
+		owner := storageMsg.Owner
+		if owner == uuid.Nil {
+			owner = caller
+		}
+
+		if err := cleanStoragePaths(&storageMsg); err != nil {
+			log.Printf("Invalid path %s", storageMsg.Path)
+			return storageResult(BusError{Message: err.Error()}), nil
+		}
+
+		var denied bool
+		switch storageMsg.Type {
+		case StorageMessageTypeWrite, StorageMessageTypeDelete, StorageMessageTypeDeleteTree:
+			denied = !e.allowed(caller, owner, storageMsg.Path, StorageAccessReadWrite)
+		case StorageMessageTypeShare, StorageMessageTypeSnapshot:
+			// Only the owner can share or copy its namespace
+			denied = owner != caller
+		case StorageMessageTypeRestore:
+			// Only the host can restore other namespaces
+			denied = owner != caller || (caller != HostUUID && storageMsg.Namespace != uuid.Nil && storageMsg.Namespace != caller)
+		case StorageMessageTypeList, StorageMessageTypeWatch, StorageMessageTypeUnwatch,
+			StorageMessageTypeListDir, StorageMessageTypeRange, StorageMessageTypeUsage:
+			// The listing, the events and the usage are filtered instead
+		case StorageMessageTypeBatch:
+			for _, op := range storageMsg.Ops {
+				access := StorageAccessReadWrite
+				if op.Type == StorageOpCheck {
+					access = StorageAccessRead
+				}
+				denied = denied || !e.allowed(caller, owner, op.Path, access)
+			}
+		default:
+			denied = !e.allowed(caller, owner, storageMsg.Path, StorageAccessRead)
+		}
+
+		if denied {
+			log.Printf("Access denied to %s of %v for %v", storageMsg.Path, owner, caller)
+			return storageResult(BusError{Message: ErrStorageAccessDenied.Error()}), nil
+		}
+
+		path := storageKey(owner, storageMsg.Path)
+
+		switch storageMsg.Type {
+		case StorageMessageTypeRead:
+			record, ok, err := e.get(path)
+			if err != nil {
+				return storageFailure(err), nil
+			} else if ok {
+				return storageResult(record.Value), nil
+			}
+			return storageResult(nil), nil
+
+		case StorageMessageTypeGet:
+			record, ok, err := e.get(path)
+			if err != nil {
+				return storageFailure(err), nil
+			}
+			item := StorageItem{Path: storageMsg.Path, Exists: ok}
+			if ok {
+				item.Value = record.Value
+			}
+			return storageResult(item), nil
+
+		case StorageMessageTypeWrite:
+			if err := validateStorageValue(storageMsg.Value); err != nil {
+				log.Printf("Rejected write to %s: %v", storageMsg.Path, err)
+				return storageResult(BusError{Message: err.Error()}), nil
+			}
+
+			fits, err := e.fits(owner, []StorageOp{{Type: StorageOpWrite, Path: storageMsg.Path, Value: storageMsg.Value}})
+			if err != nil {
+				return storageFailure(err), nil
+			} else if !fits {
+				log.Printf("Quota of %v exceeded by a write to %s", owner, storageMsg.Path)
+				return storageResult(BusError{Message: ErrStorageQuotaExceeded.Error()}), nil
+			}
+
+			if _, err := e.put(owner, storageMsg.Path, storageMsg.Value, storageMsg.Expires); err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(true), nil
+
+		case StorageMessageTypeDelete:
+			if err := e.remove(owner, storageMsg.Path); err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(true), nil
+
+		case StorageMessageTypeExists:
+			_, ok, err := e.get(path)
+			if err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(ok), nil
+
+		case StorageMessageTypeList:
+			list, err := e.list(caller, owner, storageMsg.Path, storageMsg.Cursor, storageMsg.Limit)
+			if err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(list), nil
+
+		case StorageMessageTypeStat:
+			record, ok, err := e.get(path)
+			if err != nil {
+				return storageFailure(err), nil
+			}
+
+			stat := StorageStat{Path: storageMsg.Path}
+			if ok {
+				stat.Exists = true
+				stat.Size = record.Size
+				stat.Modified = record.Modified
+				stat.Expires = record.Expires
+				stat.Version = record.Version
+				stat.ContentType = record.ContentType
+			}
+			return storageResult(stat), nil
+
+		case StorageMessageTypeShare:
+			if err := e.share(owner, storageMsg.Path, storageMsg.Grantee, storageMsg.Access); err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(true), nil
+
+		case StorageMessageTypeBatch:
+			result, err := e.batch(owner, storageMsg.Ops)
+			if err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(result), nil
+
+		case StorageMessageTypeWatch:
+			// The events after the revision are not all in the history anymore, the watcher has to read the values again
+			if storageMsg.Revision > 0 && storageMsg.Revision < e.compacted {
+				return storageResult(BusError{Message: ErrStorageCompacted.Error()}), nil
+			}
+			return e.watch(caller, owner, storageMsg.Path, storageMsg.Revision, storageMsg.WatchID), nil
+
+		case StorageMessageTypeUnwatch:
+			if w, ok := e.watchers[storageMsg.WatchID]; ok && w.caller == caller {
+				close(w.ch)
+				delete(e.watchers, storageMsg.WatchID)
+			}
+			return nil, nil
+
+		case StorageMessageTypeListDir:
+			names, err := e.listDir(caller, owner, storageMsg.Path)
+			if err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(names), nil
+
+		case StorageMessageTypeDeleteTree:
+			paths, err := e.tree(owner, storageMsg.Path)
+			for _, p := range paths {
+				if err == nil {
+					err = e.remove(owner, p)
+				}
+			}
+			if err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(true), nil
+
+		case StorageMessageTypeRange:
+			list, err := e.scan(caller, owner, storageMsg.Path, storageMsg.End, storageMsg.Limit)
+			if err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(list), nil
+
+		case StorageMessageTypeSnapshot:
+			namespace := caller
+			if caller == HostUUID {
+				namespace = uuid.Nil
+			}
+			archive, err := e.snapshot(namespace, false)
+			if err == nil {
+				archive, err = e.sealArchive(archive)
+			}
+			if err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(archive), nil
+
+		case StorageMessageTypeRestore:
+			archive, ok := storageMsg.Value.(StorageArchive)
+			if !ok {
+				return storageResult(BusError{Message: "Invalid storage archive"}), nil
+			}
+
+			archive, err := e.openArchive(archive)
+			if err != nil {
+				log.Printf("Cannot open the archive of %v: %v", archive.Storage, err)
+				return storageResult(BusError{Message: err.Error()}), nil
+			}
+
+			namespace := storageMsg.Namespace
+			if caller != HostUUID {
+				namespace = caller
+
+				// The host restores whatever it backed up, the plugins stay within their quota
+				paths, err := e.tree(namespace, StoragePathSeparator)
+				if err != nil {
+					return storageFailure(err), nil
+				}
+
+				ops := []StorageOp{}
+				for _, p := range paths {
+					ops = append(ops, StorageOp{Type: StorageOpDelete, Path: p})
+				}
+				for _, ae := range archive.Filter(namespace).Entries {
+					ops = append(ops, StorageOp{Type: StorageOpWrite, Path: ae.Path, Value: ae.Value})
+				}
+
+				fits, err := e.fits(namespace, ops)
+				if err != nil {
+					return storageFailure(err), nil
+				} else if !fits {
+					log.Printf("Quota of %v exceeded by a restore", namespace)
+					return storageResult(BusError{Message: ErrStorageQuotaExceeded.Error()}), nil
+				}
+			}
+
+			if err := e.restore(archive, namespace); err != nil {
+				return storageFailure(err), nil
+			}
+			return storageResult(true), nil
+
+		case StorageMessageTypeUsage:
+			return storageResult(e.report(caller)), nil
+		}
+	}
+
+	log.Print("Invalid message")
+	return nil, errors.New("Invalid message")
+}
+
+// Expire removes the values expired at the given time
+func (e *StorageEngine) Expire(now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.now = now
+
+	// The keys are expired in order so the replicas give them the same revisions
+	var keys []string
+	for k, expires := range e.expiring {
+		if !now.Before(expires) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		record, ok, err := e.backend.Get(k)
+		if err == nil && ok {
+			err = e.backend.Delete(k)
+		}
+		if err != nil {
+			log.Printf("Cannot expire %s: %v", k, err)
+			return
+		}
+
+		delete(e.expiring, k)
+		owner, path, err := splitStorageKey(k)
+		if !ok || err != nil {
+			continue
+		}
+
+		e.revision++
+		e.account(owner, -1, -record.Size)
+		e.notify(owner, StorageEvent{Type: StorageEventExpire, Path: path, OldVersion: record.Version, Revision: e.revision})
+	}
+}
+
+// Expired checks if some values expired at the given time and are still to be removed
+func (e *StorageEngine) Expired(now time.Time) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, expires := range e.expiring {
+		if !now.Before(expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// sealArchive encrypts the archives of the backends encrypting the values, the mutex must be held
+func (e *StorageEngine) sealArchive(archive StorageArchive) (StorageArchive, error) {
+	if sealer, ok := e.backend.(ArchiveSealer); ok {
+		return sealer.SealArchive(archive)
+	}
+	return archive, nil
+}
+
+// openArchive decrypts a sealed archive, only the backend which sealed it has the key, the mutex must be held
+func (e *StorageEngine) openArchive(archive StorageArchive) (StorageArchive, error) {
+	if archive.Sealed == nil {
+		return archive, nil
+	}
+
+	if sealer, ok := e.backend.(ArchiveSealer); ok {
+		return sealer.OpenArchive(archive)
+	}
+	return archive, ErrStorageArchiveSealed
+}
+
+// Export copies all the namespaces as they are, with the values expired but not removed yet
+func (e *StorageEngine) Export() (StorageArchive, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.snapshot(uuid.Nil, true)
+}
+
+// Import replaces the content of the storage with an exported archive, keeping the versions and the revision, the
+// watches are closed as their history is lost
+func (e *StorageEngine) Import(archive StorageArchive) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	records, err := e.backend.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := e.backend.Delete(record.Key); err != nil {
+			return err
+		}
+	}
+
+	e.grants = make(map[uuid.UUID][]storageGrant)
+	e.history = nil
+	e.compacted = archive.Revision
+	e.usage = make(map[uuid.UUID]StorageUsage)
+	e.expiring = make(map[string]time.Time)
+	e.closeWatchers()
+
+	for _, ae := range archive.Entries {
+		record, err := newStorageRecord(storageKey(ae.Owner, ae.Path), ae.Value, ae.Modified, ae.Expires, ae.Version)
+		if err != nil {
+			return err
+		}
+		if err := e.backend.Put(record); err != nil {
+			return err
+		}
+		e.account(ae.Owner, 1, record.Size)
+		e.track(record)
+	}
+
+	for _, g := range archive.Grants {
+		if err := e.share(g.Owner, g.Path, g.Grantee, g.Access); err != nil {
+			return err
+		}
+	}
+
+	e.revision = archive.Revision
+	return nil
+}
+
+// Revision returns the revision of the last change
+func (e *StorageEngine) Revision() uint64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.revision
+}
+
+// storageKey returns the backend key of a path in a namespace
+func storageKey(owner uuid.UUID, path string) string {
+	return "/" + owner.String() + path
+}
+
+// splitStorageKey returns the namespace and the path of a backend key
+func splitStorageKey(k string) (owner uuid.UUID, path string, err error) {
+	end := strings.Index(k[1:], "/") + 1
+	if end <= 0 {
+		end = len(k)
+	}
+
+	owner, err = uuid.Parse(k[1:end])
+	return owner, k[end:], err
+}
+
+// storagePathWithin checks if the path is the shared path or below it
+func storagePathWithin(path string, shared string) bool {
+	return path == shared || strings.HasPrefix(path, strings.TrimSuffix(shared, "/")+"/")
+}
+
+// validateStorageValue checks the serialized values against their content type and that the values can be encoded,
+// their encoded size counts for the quotas
+func validateStorageValue(value interface{}) error {
+	if v, ok := value.(StorageValue); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := StorageValueSize(value); err != nil {
+		return fmt.Errorf("Cannot encode the value: %v", err)
+	}
+	return nil
+}
+
+// newStorageRecord creates the record of a value
+func newStorageRecord(key string, value interface{}, modified time.Time, expires time.Time, version uint64) (StorageRecord, error) {
+	size, err := StorageValueSize(value)
+	if err != nil {
+		return StorageRecord{}, err
+	}
+
+	var contentType string
+	if v, ok := value.(StorageValue); ok {
+		contentType = v.ContentType
+	}
+
+	return StorageRecord{
+		Key:         key,
+		Value:       value,
+		ContentType: contentType,
+		Size:        size,
+		Modified:    modified,
+		Expires:     expires,
+		Version:     version,
+	}, nil
+}
+
+// cleanStoragePaths normalizes the paths of the message, the prefixes and range bounds are not paths and are left as is
+func cleanStoragePaths(msg *StorageMessage) (err error) {
+	switch msg.Type {
+	case StorageMessageTypeList, StorageMessageTypeWatch, StorageMessageTypeUnwatch, StorageMessageTypeRange,
+		StorageMessageTypeSnapshot, StorageMessageTypeRestore, StorageMessageTypeUsage:
+		return nil
+
+	case StorageMessageTypeBatch:
+		ops := make([]StorageOp, len(msg.Ops))
+		for i, op := range msg.Ops {
+			if op.Path, err = CleanStoragePath(op.Path); err != nil {
+				return
+			}
+			ops[i] = op
+		}
+		msg.Ops = ops
+		return nil
+	}
+
+	path, err := CleanStoragePath(msg.Path)
+	if err == nil {
+		msg.Path = path
+	}
+	return
+}
+
+// storageResult returns a channel with a single result
+func storageResult(value interface{}) <-chan interface{} {
+	ch := make(chan interface{}, 1)
+	ch <- value
+	close(ch)
+	return ch
+}
+
+// storageFailure returns the error of the backend to the caller
+func storageFailure(err error) <-chan interface{} {
+	log.Printf("Storage backend failed: %v", err)
+	return storageResult(BusError{Message: err.Error()})
+}
+
+// closeWatchers closes all the watches, the mutex must be held
+func (e *StorageEngine) closeWatchers() {
+	for id, w := range e.watchers {
+		close(w.ch)
+		delete(e.watchers, id)
+	}
+}
+
+// track keeps the expiry time of the record
+func (e *StorageEngine) track(record StorageRecord) {
+	if record.Expires.IsZero() {
+		delete(e.expiring, record.Key)
+	} else {
+		e.expiring[record.Key] = record.Expires
+	}
+}
+
+// allowed checks if the caller has the access to the path of the namespace
+func (e *StorageEngine) allowed(caller uuid.UUID, owner uuid.UUID, path string, access int) bool {
+	if caller == owner {
+		return true
+	}
+
+	for _, g := range e.grants[owner] {
+		if g.grantee == caller && g.access >= access && storagePathWithin(path, g.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// share adds, updates or (with StorageAccessNone) removes a grant and persists the grants of the namespace
+func (e *StorageEngine) share(owner uuid.UUID, path string, grantee uuid.UUID, access int) error {
+	var kept []storageGrant
+	for _, g := range e.grants[owner] {
+		if g.path != path || g.grantee != grantee {
+			kept = append(kept, g)
+		}
+	}
+
+	if access != StorageAccessNone {
+		kept = append(kept, storageGrant{path: path, grantee: grantee, access: access})
+	}
+	e.grants[owner] = kept
+	return e.saveGrants(owner)
+}
+
+// saveGrants persists the grants of a namespace in the backend
+func (e *StorageEngine) saveGrants(owner uuid.UUID) error {
+	k := storageGrantsPrefix + owner.String()
+	if len(e.grants[owner]) == 0 {
+		delete(e.grants, owner)
+		return e.backend.Delete(k)
+	}
+
+	var gs []StorageArchiveGrant
+	for _, g := range e.grants[owner] {
+		gs = append(gs, StorageArchiveGrant{Owner: owner, Path: g.path, Grantee: g.grantee, Access: g.access})
+	}
+	return e.backend.Put(StorageRecord{Key: k, Value: gs, Modified: e.now})
+}
+
+// get returns the record stored at the key, the expired records are missing even before they are removed
+func (e *StorageEngine) get(key string) (StorageRecord, bool, error) {
+	record, ok, err := e.backend.Get(key)
+	if err != nil || !ok || record.expired(e.now) {
+		return StorageRecord{}, false, err
+	}
+	return record, true, nil
+}
+
+// version returns the version stored at the key, 0 if nothing is stored
+func (e *StorageEngine) version(key string) (uint64, error) {
+	record, _, err := e.get(key)
+	return record.Version, err
+}
+
+// put stores the value and returns its new version
+func (e *StorageEngine) put(owner uuid.UUID, path string, value interface{}, expires time.Time) (uint64, error) {
+	staged, err := e.stagePut(owner, path, value, expires, e.revision+1)
+	if err != nil {
+		return 0, err
+	}
+	return e.commit(staged), nil
+}
+
+// remove deletes the value, the expired values are left to Expire
+func (e *StorageEngine) remove(owner uuid.UUID, path string) error {
+	staged, ok, err := e.stageRemove(owner, path)
+	if err != nil || !ok {
+		return err
+	}
+	e.commit(staged)
+	return nil
+}
+
+// storageStaged is a change written to the backend but not yet accounted nor notified, the previous record is kept to
+// roll it back
+type storageStaged struct {
+	owner    uuid.UUID
+	path     string
+	value    interface{}
+	record   StorageRecord
+	previous StorageRecord
+	stored   bool
+	deleted  bool
+}
+
+// stagePut writes the record of the value with the version to the backend
+func (e *StorageEngine) stagePut(owner uuid.UUID, path string, value interface{}, expires time.Time, version uint64) (storageStaged, error) {
+	k := storageKey(owner, path)
+	previous, stored, err := e.backend.Get(k)
+	if err != nil {
+		return storageStaged{}, err
+	}
+
+	record, err := newStorageRecord(k, value, e.now, expires, version)
+	if err != nil {
+		return storageStaged{}, err
+	}
+	if err := e.backend.Put(record); err != nil {
+		return storageStaged{}, err
+	}
+	return storageStaged{owner: owner, path: path, value: value, record: record, previous: previous, stored: stored}, nil
+}
+
+// stageRemove deletes the record of the path from the backend, ok is false if nothing is stored
+func (e *StorageEngine) stageRemove(owner uuid.UUID, path string) (storageStaged, bool, error) {
+	k := storageKey(owner, path)
+	previous, ok, err := e.get(k)
+	if err != nil || !ok {
+		return storageStaged{}, false, err
+	}
+
+	if err := e.backend.Delete(k); err != nil {
+		return storageStaged{}, false, err
+	}
+	return storageStaged{owner: owner, path: path, previous: previous, stored: true, deleted: true}, true, nil
+}
+
+// commit accounts the staged change and notifies it, it returns the new revision
+func (e *StorageEngine) commit(staged storageStaged) uint64 {
+	e.revision++
+	if staged.deleted {
+		e.account(staged.owner, -1, -staged.previous.Size)
+		delete(e.expiring, staged.previous.Key)
+		e.notify(staged.owner, StorageEvent{Type: StorageEventDelete, Path: staged.path, OldVersion: staged.previous.Version, Revision: e.revision})
+		return e.revision
+	}
+
+	var old uint64
+	if staged.stored {
+		e.account(staged.owner, -1, -staged.previous.Size)
+		if !staged.previous.expired(e.now) {
+			old = staged.previous.Version
+		}
+	}
+
+	e.account(staged.owner, 1, staged.record.Size)
+	e.track(staged.record)
+	e.notify(staged.owner, StorageEvent{Type: StorageEventPut, Path: staged.path, Value: staged.value, OldVersion: old, NewVersion: e.revision, Revision: e.revision})
+	return e.revision
+}
+
+// rollback restores the records the staged changes replaced, the last change first
+func (e *StorageEngine) rollback(staged []storageStaged) {
+	for i := len(staged) - 1; i >= 0; i-- {
+		var err error
+		if staged[i].stored {
+			err = e.backend.Put(staged[i].previous)
+		} else {
+			err = e.backend.Delete(staged[i].record.Key)
+		}
+		if err != nil {
+			log.Printf("Cannot roll back %s: %v", staged[i].path, err)
+		}
+	}
+}
+
+// notify records the event and sends it to the watchers
+func (e *StorageEngine) notify(owner uuid.UUID, event StorageEvent) {
+	e.history = append(e.history, storageChange{owner: owner, event: event})
+	if len(e.history) > storageHistory {
+		dropped := len(e.history) - storageHistory
+		e.compacted = e.history[dropped-1].event.Revision
+		e.history = e.history[dropped:]
+	}
+
+	for id, w := range e.watchers {
+		if !e.matches(w, owner, event.Path) {
+			continue
+		}
+
+		select {
+		case w.ch <- event:
+		default:
+			// The watcher resumes from its last revision
+			log.Printf("Watcher %v is full, closing it", id)
+			close(w.ch)
+			delete(e.watchers, id)
+		}
+	}
+}
+
+// matches checks if the watcher wants the changes of the path
+func (e *StorageEngine) matches(w *storageWatcher, owner uuid.UUID, path string) bool {
+	return w.owner == owner && strings.HasPrefix(path, w.prefix) && e.allowed(w.caller, owner, path, StorageAccessRead)
+}
+
+// watch registers a watcher and sends it the events after the revision still in the history, all of them from
+// revision 0
+func (e *StorageEngine) watch(caller uuid.UUID, owner uuid.UUID, prefix string, from uint64, id uuid.UUID) <-chan interface{} {
+	w := &storageWatcher{caller: caller, owner: owner, prefix: prefix}
+
+	var missed []StorageEvent
+	for _, c := range e.history {
+		if c.event.Revision > from && e.matches(w, c.owner, c.event.Path) {
+			missed = append(missed, c.event)
+		}
+	}
+
+	w.ch = make(chan interface{}, len(missed)+storageWatchBuffer)
+	for _, event := range missed {
+		w.ch <- event
+	}
+
+	if old, ok := e.watchers[id]; ok {
+		close(old.ch)
+	}
+	e.watchers[id] = w
+	return w.ch
+}
+
+// batch applies the operations if all their versions match, it returns the versions or an error result, the changes
+// are rolled back if the backend fails
+func (e *StorageEngine) batch(owner uuid.UUID, ops []StorageOp) (interface{}, error) {
+	for _, op := range ops {
+		if err := validateStorageValue(op.Value); op.Type == StorageOpWrite && err != nil {
+			return BusError{Message: err.Error()}, nil
+		}
+	}
+
+	for _, op := range ops {
+		if !op.Match {
+			continue
+		}
+
+		version, err := e.version(storageKey(owner, op.Path))
+		if err != nil {
+			return nil, err
+		} else if version != op.Version {
+			return BusError{Message: ErrStorageConflict.Error()}, nil
+		}
+	}
+
+	fits, err := e.fits(owner, ops)
+	if err != nil {
+		return nil, err
+	} else if !fits {
+		log.Printf("Quota of %v exceeded by a batch", owner)
+		return BusError{Message: ErrStorageQuotaExceeded.Error()}, nil
+	}
+
+	// The changes are all written to the backend before any is accounted or notified, they are rolled back if the
+	// backend fails midway
+	versions := make([]uint64, len(ops))
+	var staged []storageStaged
+	for i, op := range ops {
+		version := e.revision + uint64(len(staged)) + 1
+		switch op.Type {
+		case StorageOpWrite:
+			var change storageStaged
+			if change, err = e.stagePut(owner, op.Path, op.Value, op.Expires, version); err == nil {
+				staged = append(staged, change)
+				versions[i] = version
+			}
+		case StorageOpDelete:
+			var change storageStaged
+			var ok bool
+			if change, ok, err = e.stageRemove(owner, op.Path); err == nil && ok {
+				staged = append(staged, change)
+			}
+		case StorageOpCheck:
+			versions[i], err = e.version(storageKey(owner, op.Path))
+		}
+
+		if err != nil {
+			e.rollback(staged)
+			return nil, err
+		}
+	}
+
+	for _, change := range staged {
+		e.commit(change)
+	}
+	return versions, nil
+}
+
+// paths returns the sorted paths of the namespace from start (included) to end (excluded, no bound if empty) which
+// are not expired, accepted and readable by the caller, it stops at max paths if max is positive
+func (e *StorageEngine) paths(caller uuid.UUID, owner uuid.UUID, start string, end string, max int, accept func(path string) bool) ([]string, error) {
+	namespace := storageKey(owner, "")
+	if end == "" {
+		end = "\xff"
+	}
+
+	var paths []string
+	err := e.backend.Scan(namespace+start, namespace+end, func(record StorageRecord) bool {
+		path := record.Key[len(namespace):]
+		if !record.expired(e.now) && accept(path) && e.allowed(caller, owner, path, StorageAccessRead) {
+			paths = append(paths, path)
+		}
+		return max <= 0 || len(paths) < max
+	})
+	return paths, err
+}
+
+// storagePage cuts the sorted paths to the limit
+func storagePage(paths []string, limit int) StorageList {
+	if limit <= 0 {
+		limit = DefaultStorageListLimit
+	}
+
+	page := StorageList{Paths: paths}
+	if len(paths) > limit {
+		page.Paths = paths[:limit]
+		page.Next = paths[limit-1]
+	}
+	return page
+}
+
+// list returns a page of the sorted paths of the namespace starting with the prefix and readable by the caller
+func (e *StorageEngine) list(caller uuid.UUID, owner uuid.UUID, prefix string, cursor string, limit int) (StorageList, error) {
+	if limit <= 0 {
+		limit = DefaultStorageListLimit
+	}
+
+	start := prefix
+	if cursor >= start {
+		start = cursor + "\x00"
+	}
+
+	paths, err := e.paths(caller, owner, start, prefix+"\xff", limit+1, func(path string) bool {
+		return strings.HasPrefix(path, prefix)
+	})
+	return storagePage(paths, limit), err
+}
+
+// scan returns a page of the sorted paths of the namespace between start and end and readable by the caller
+func (e *StorageEngine) scan(caller uuid.UUID, owner uuid.UUID, start string, end string, limit int) (StorageList, error) {
+	if limit <= 0 {
+		limit = DefaultStorageListLimit
+	}
+
+	paths, err := e.paths(caller, owner, start, end, limit+1, func(path string) bool {
+		return true
+	})
+
+	// The start of a range is included, the next page starts at the first path left out
+	page := storagePage(paths, limit)
+	if page.Next != "" {
+		page.Next = paths[limit]
+	}
+	return page, err
+}
+
+// tree returns the path and the paths below it
+func (e *StorageEngine) tree(owner uuid.UUID, dir string) ([]string, error) {
+	return e.paths(owner, owner, dir, dir+"\xff", 0, func(path string) bool {
+		return storagePathWithin(path, dir)
+	})
+}
+
+// listDir returns the names of the children of the directory, the subdirectories end with a slash
+func (e *StorageEngine) listDir(caller uuid.UUID, owner uuid.UUID, dir string) ([]string, error) {
+	prefix := strings.TrimSuffix(dir, StoragePathSeparator) + StoragePathSeparator
+	paths, err := e.paths(caller, owner, prefix, prefix+"\xff", 0, func(path string) bool {
+		return strings.HasPrefix(path, prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		name := path[len(prefix):]
+		if i := strings.Index(name, StoragePathSeparator); i >= 0 {
+			name = name[:i+1]
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// snapshot copies a namespace, or all the namespaces if uuid.Nil, the expired values are skipped unless all is set
+func (e *StorageEngine) snapshot(namespace uuid.UUID, all bool) (StorageArchive, error) {
+	archive := StorageArchive{
+		Format:   StorageArchiveFormat,
+		Storage:  e.id,
+		Created:  time.Now(),
+		Revision: e.revision,
+	}
+
+	// The keys of the values are between "/" and "0", the next character
+	start, end := "/", "0"
+	if namespace != uuid.Nil {
+		start, end = storageKey(namespace, ""), storageKey(namespace, "\xff")
+	}
+
+	err := e.backend.Scan(start, end, func(record StorageRecord) bool {
+		owner, path, err := splitStorageKey(record.Key)
+		if err != nil || (record.expired(e.now) && !all) {
+			return true
+		}
+
+		archive.Entries = append(archive.Entries, StorageArchiveEntry{
+			Owner:    owner,
+			Path:     path,
+			Value:    record.Value,
+			Modified: record.Modified,
+			Expires:  record.Expires,
+			Version:  record.Version,
+		})
+		return true
+	})
+	if err != nil {
+		return archive, err
+	}
+
+	for owner, gs := range e.grants {
+		if namespace != uuid.Nil && owner != namespace {
+			continue
+		}
+		for _, g := range gs {
+			archive.Grants = append(archive.Grants, StorageArchiveGrant{Owner: owner, Path: g.path, Grantee: g.grantee, Access: g.access})
+		}
+	}
+
+	return archive, nil
+}
+
+// restore replaces the namespaces with their content in the archive, all the namespaces of the archive if uuid.Nil
+func (e *StorageEngine) restore(archive StorageArchive, namespace uuid.UUID) error {
+	namespaces := archive.Namespaces()
+	if namespace != uuid.Nil {
+		archive = archive.Filter(namespace)
+		namespaces = []uuid.UUID{namespace}
+	} else {
+		// A full restore also clears the namespaces missing from the archive
+		for owner := range e.usage {
+			namespaces = append(namespaces, owner)
+		}
+		for owner := range e.grants {
+			namespaces = append(namespaces, owner)
+		}
+	}
+
+	for _, owner := range namespaces {
+		paths, err := e.tree(owner, StoragePathSeparator)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			if err := e.remove(owner, path); err != nil {
+				return err
+			}
+		}
+
+		if len(e.grants[owner]) > 0 {
+			e.grants[owner] = nil
+			if err := e.saveGrants(owner); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ae := range archive.Entries {
+		if ae.Expires.IsZero() || e.now.Before(ae.Expires) {
+			if _, err := e.put(ae.Owner, ae.Path, ae.Value, ae.Expires); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, g := range archive.Grants {
+		if err := e.share(g.Owner, g.Path, g.Grantee, g.Access); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// account adds to the usage of a namespace
+func (e *StorageEngine) account(owner uuid.UUID, keys int, bytes int) {
+	usage := e.usage[owner]
+	usage.Keys += keys
+	usage.Bytes += bytes
+	if usage.Keys == 0 {
+		delete(e.usage, owner)
+		return
+	}
+	e.usage[owner] = usage
+}
+
+// quota returns the quota of a namespace
+func (e *StorageEngine) quota(owner uuid.UUID) StorageQuota {
+	if e.Quota == nil {
+		return StorageQuota{}
+	}
+	return e.Quota(owner)
+}
+
+// fits checks if the namespace stays within its quota after the operations, the ones reducing the usage always fit
+func (e *StorageEngine) fits(owner uuid.UUID, ops []StorageOp) (bool, error) {
+	quota := e.quota(owner)
+	if quota.MaxKeys <= 0 && quota.MaxBytes <= 0 {
+		return true, nil
+	}
+
+	before := e.usage[owner]
+	after := before
+
+	// sizes are the sizes of the paths changed by the operations, -1 once deleted
+	sizes := make(map[string]int)
+	for _, op := range ops {
+		size, ok := sizes[op.Path]
+		if !ok {
+			record, stored, err := e.backend.Get(storageKey(owner, op.Path))
+			if err != nil {
+				return false, err
+			}
+
+			size = -1
+			if stored {
+				size = record.Size
+			}
+		}
+
+		switch op.Type {
+		case StorageOpWrite:
+			if size < 0 {
+				after.Keys++
+				size = 0
+			}
+			written, err := StorageValueSize(op.Value)
+			if err != nil {
+				return false, err
+			}
+			sizes[op.Path] = written
+			after.Bytes += sizes[op.Path] - size
+		case StorageOpDelete:
+			if size >= 0 {
+				after.Keys--
+				after.Bytes -= size
+			}
+			sizes[op.Path] = -1
+		}
+	}
+
+	return !(quota.MaxKeys > 0 && after.Keys > quota.MaxKeys && after.Keys > before.Keys) &&
+		!(quota.MaxBytes > 0 && after.Bytes > quota.MaxBytes && after.Bytes > before.Bytes), nil
+}
+
+// report returns the usage of the namespace of the caller, or of all the namespaces for the host
+func (e *StorageEngine) report(caller uuid.UUID) []StorageUsage {
+	owners := []uuid.UUID{caller}
+	if caller == HostUUID {
+		owners = owners[:0]
+		for owner := range e.usage {
+			owners = append(owners, owner)
+		}
+		sort.Slice(owners, func(i, j int) bool { return owners[i].String() < owners[j].String() })
+	}
+
+	report := []StorageUsage{}
+	for _, owner := range owners {
+		usage := e.usage[owner]
+		usage.Owner = owner
+		usage.Quota = e.quota(owner)
+		report = append(report, usage)
+	}
+	return report
+}
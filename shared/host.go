@@ -0,0 +1,82 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ErrHostAfterPlugins is returned when the host is created once the plugins started loading
+var ErrHostAfterPlugins = errors.New("The host must be created before the plugins are loaded")
+
+// Host is the host program, its messages are sent as HostUUID so it can reach all the namespaces of the storages
+type Host struct {
+	UseBus
+}
+
+var pluginOpened bool
+var pluginOpenedMutex sync.Mutex
+
+// NewHost returns the host, it must be called by the program before it loads the first plugin so the code of the
+// plugins can never reach it. The host learns about the plugins as they are loaded.
+func NewHost() (*Host, error) {
+	pluginOpenedMutex.Lock()
+	defer pluginOpenedMutex.Unlock()
+
+	if pluginOpened {
+		return nil, ErrHostAfterPlugins
+	}
+
+	h := &Host{}
+	h.setIdentity(HostUUID)
+
+	pluginsMutex.Lock()
+	listeners = append(listeners, &h.UseBus)
+	pluginsMutex.Unlock()
+	return h, nil
+}
+
+// Storage returns a storage for the host program, it can snapshot and restore all the namespaces
+func (h *Host) Storage(id uuid.UUID) *UseStorage {
+	s := &UseStorage{UUID: id}
+	s.setIdentity(HostUUID)
+	for _, plugin := range loadedPlugins() {
+		s.PluginLoaded(plugin)
+	}
+	return s
+}
+
+// openingPlugin is called before the code of a plugin runs, the host cannot be created afterwards
+func openingPlugin() {
+	pluginOpenedMutex.Lock()
+	pluginOpened = true
+	pluginOpenedMutex.Unlock()
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// KeyringUUID is the endpoint of the keyring plugin
+var KeyringUUID = uuid.MustParse("6E1D3B9A-2F4C-4A8E-B7D5-91C0E3F2A846")
+
+const (
+	// KeyringSettingMasterKeyFile is the key for the file of the master key sealing the keys
+	KeyringSettingMasterKeyFile = "master_key_file"
+	// KeyringSettingPassphrase is the key for the passphrase (a string or a Secret) the master key is derived from when
+	// there is no key file
+	KeyringSettingPassphrase = "passphrase"
+	// KeyringSettingPath is the key for the file the sealed keys are kept in, in memory if unset
+	KeyringSettingPath = "path"
+	// KeyringSettingAuditPath is the key for the file the audit trail is kept in, only the last entries are kept in memory if unset
+	KeyringSettingAuditPath = "audit_path"
+	// KeyringSettingRotation is the key for the time.Duration after which the keys are rotated, never if unset
+	KeyringSettingRotation = "rotation"
+)
+
+const (
+	// KeyTypeEncryption is a 256 bits AES key
+	KeyTypeEncryption = "encryption"
+	// KeyTypeSigning is an ECDSA P-256 private key in ASN.1 DER form, see x509.ParseECPrivateKey, its public key
+	// is in PKIX DER form
+	KeyTypeSigning = "signing"
+)
+
+const (
+	// KeyActionCreate is the audit action of a new key
+	KeyActionCreate = "create"
+	// KeyActionRotate is the audit action of a new version of a key
+	KeyActionRotate = "rotate"
+	// KeyActionGet is the audit action of a key served to a plugin
+	KeyActionGet = "get"
+	// KeyActionPublic is the audit action of a public key served to a plugin
+	KeyActionPublic = "public"
+	// KeyActionShare is the audit action of a change of the plugins allowed to use a key
+	KeyActionShare = "share"
+)
+
+var (
+	// ErrKeyNotFound is returned when the key or its version does not exist
+	ErrKeyNotFound = errors.New("The key does not exist")
+	// ErrKeyExists is returned when creating a key with the name of another one
+	ErrKeyExists = errors.New("The key already exists")
+	// ErrKeyAccessDenied is returned when the caller is not allowed to use or manage the key
+	ErrKeyAccessDenied = errors.New("Access to this key is denied")
+)
+
+// keyringErrors maps the messages of the RPC errors back to the errors
+var keyringErrors = map[string]error{
+	ErrKeyNotFound.Error():     ErrKeyNotFound,
+	ErrKeyExists.Error():       ErrKeyExists,
+	ErrKeyAccessDenied.Error(): ErrKeyAccessDenied,
+}
+
+// KeyRef names a version of a key, the key is in the namespace of the caller if the owner is uuid.Nil and the
+// version 0 is the current one
+type KeyRef struct {
+	Owner   uuid.UUID
+	Name    string
+	Version int
+}
+
+// KeyCreate asks for a new key in the namespace of the caller
+type KeyCreate struct {
+	Name string
+	Type string
+}
+
+// KeyShare allows or forbids another plugin to use a key of the caller
+type KeyShare struct {
+	Name    string
+	Grantee uuid.UUID
+	Allow   bool
+}
+
+// KeyInfo describes a key and its current version without the material
+type KeyInfo struct {
+	Owner    uuid.UUID
+	Name     string
+	Type     string
+	Version  int
+	Created  time.Time
+	Grantees []uuid.UUID
+}
+
+// Key is a version of a key with its material
+type Key struct {
+	Owner    uuid.UUID
+	Name     string
+	Type     string
+	Version  int
+	Created  time.Time
+	Material []byte
+}
+
+// KeyAuditEntry records an operation on a key
+type KeyAuditEntry struct {
+	Time    time.Time
+	Caller  uuid.UUID
+	Owner   uuid.UUID
+	Name    string
+	Version int
+	Action  string
+	Allowed bool
+}
+
+// UseKeyring is an embeddable helper to use the keys of the keyring plugin
+type UseKeyring struct {
+	UseBus
+}
+
+// call invokes a method of the keyring and maps its errors
+func (k *UseKeyring) call(method string, args interface{}, reply interface{}) error {
+	err := k.Call(KeyringUUID, "Keyring."+method, args, reply)
+	if err != nil {
+		if known, ok := keyringErrors[err.Error()]; ok {
+			return known
+		}
+	}
+	return err
+}
+
+// CreateKey creates a key of the type in the namespace of the plugin
+func (k *UseKeyring) CreateKey(name string, keyType string) (info KeyInfo, err error) {
+	err = k.call("Create", KeyCreate{Name: name, Type: keyType}, &info)
+	return
+}
+
+// RotateKey adds a new current version to a key of the plugin, the previous versions are kept to decrypt or verify
+func (k *UseKeyring) RotateKey(name string) (info KeyInfo, err error) {
+	err = k.call("Rotate", KeyRef{Name: name}, &info)
+	return
+}
+
+// GetKey returns a version of a key owned by or shared with the plugin
+func (k *UseKeyring) GetKey(ref KeyRef) (key Key, err error) {
+	err = k.call("Get", ref, &key)
+	return
+}
+
+// PublicKey returns the public key of a version of a signing key owned by or shared with the plugin
+func (k *UseKeyring) PublicKey(ref KeyRef) (public []byte, err error) {
+	err = k.call("PublicKey", ref, &public)
+	return
+}
+
+// ShareKey allows or forbids another plugin to use a key of the plugin
+func (k *UseKeyring) ShareKey(name string, grantee uuid.UUID, allow bool) (info KeyInfo, err error) {
+	err = k.call("Share", KeyShare{Name: name, Grantee: grantee, Allow: allow}, &info)
+	return
+}
+
+// ListKeys returns the keys of the owner the plugin can use, all of them if uuid.Nil
+func (k *UseKeyring) ListKeys(owner uuid.UUID) (keys []KeyInfo, err error) {
+	err = k.call("List", owner, &keys)
+	return
+}
+
+// KeyAudit returns the last operations on the keys of the plugin, on all the keys for the host
+func (k *UseKeyring) KeyAudit(limit int) (entries []KeyAuditEntry, err error) {
+	err = k.call("Audit", limit, &entries)
+	return
+}
+
+// PBKDF2 derives a key of keyLen bytes from the password as specified by RFC 8018
+func PBKDF2(password []byte, salt []byte, iterations int, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	size := prf.Size()
+	blocks := (keyLen + size - 1) / size
+
+	key := make([]byte, 0, blocks*size)
+	buf := make([]byte, 4)
+	u := make([]byte, size)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, uint32(block))
+		prf.Write(buf)
+		u = prf.Sum(u[:0])
+
+		t := make([]byte, size)
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func init() {
+	// The keyring can be called from another process, the values travel in interfaces
+	gob.Register(KeyRef{})
+	gob.Register(KeyCreate{})
+	gob.Register(KeyShare{})
+	gob.Register(KeyInfo{})
+	gob.Register(Key{})
+	gob.Register([]KeyInfo{})
+	gob.Register([]KeyAuditEntry{})
+	gob.Register(uuid.UUID{})
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// fileCompactMin is the number of records a file backend writes before it considers compacting its file
+const fileCompactMin = 1000
+
+// fileRecord is a change appended to the file of a FileBackend
+type fileRecord struct {
+	Deleted bool
+	Record  StorageRecord
+}
+
+// FileBackend keeps the records in memory and persists them in an append only file of WriteRecord records, the
+// file is rewritten with the live records when it is opened and when most of its records are stale
+type FileBackend struct {
+	path    string
+	file    *os.File
+	memory  *MemoryBackend
+	live    int
+	written int
+	mutex   sync.Mutex
+}
+
+// Make sure FileBackend implements required interfaces
+var _ StorageBackend = (*FileBackend)(nil)
+
+// OpenFileBackend opens (or creates) the file and reloads its records
+func OpenFileBackend(path string) (*FileBackend, error) {
+	b := &FileBackend{path: path, memory: NewMemoryBackend()}
+
+	if err := b.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := b.compact(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// replay reloads the records of the file, a truncated last record is ignored
+func (b *FileBackend) replay() error {
+	f, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var record fileRecord
+		if err := ReadRecord(r, &record); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Storage file %s is truncated: %v", b.path, err)
+			break
+		}
+
+		if record.Deleted {
+			b.memory.Delete(record.Record.Key)
+		} else {
+			b.memory.Put(record.Record)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the file with the live records only
+func (b *FileBackend) compact() error {
+	records, _ := b.memory.Snapshot()
+
+	tmp := b.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, record := range records {
+		if err := WriteRecord(w, fileRecord{Record: record}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+
+	if b.file != nil {
+		b.file.Close()
+	}
+
+	b.live, b.written = len(records), len(records)
+	b.file, err = os.OpenFile(b.path, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+// appendRecord persists a change
+func (b *FileBackend) appendRecord(record fileRecord) error {
+	if b.file == nil {
+		return errors.New("Storage file is closed")
+	}
+
+	if err := WriteRecord(b.file, record); err != nil {
+		return err
+	}
+
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+
+	b.written++
+	return nil
+}
+
+// compactStale compacts the file when most of its records are stale
+func (b *FileBackend) compactStale() {
+	if b.written > fileCompactMin && b.written > 2*b.live {
+		if err := b.compact(); err != nil {
+			log.Printf("Cannot compact the storage file %s: %v", b.path, err)
+		}
+	}
+}
+
+// Get returns the record stored at the key
+func (b *FileBackend) Get(key string) (StorageRecord, bool, error) {
+	return b.memory.Get(key)
+}
+
+// Put stores the record at its key
+func (b *FileBackend) Put(record StorageRecord) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	_, exists, _ := b.memory.Get(record.Key)
+	if !exists {
+		b.live++
+	}
+
+	if err := b.appendRecord(fileRecord{Record: record}); err != nil {
+		if !exists {
+			b.live--
+		}
+		return err
+	}
+
+	b.memory.Put(record)
+	b.compactStale()
+	return nil
+}
+
+// Delete removes the record stored at the key
+func (b *FileBackend) Delete(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, exists, _ := b.memory.Get(key); !exists {
+		return nil
+	}
+
+	b.live--
+	if err := b.appendRecord(fileRecord{Deleted: true, Record: StorageRecord{Key: key}}); err != nil {
+		b.live++
+		return err
+	}
+
+	b.memory.Delete(key)
+	b.compactStale()
+	return nil
+}
+
+// Scan calls fn with the records from start to end in the order of the keys until it returns false
+func (b *FileBackend) Scan(start string, end string, fn func(record StorageRecord) bool) error {
+	return b.memory.Scan(start, end, fn)
+}
+
+// Snapshot returns a copy of all the records in the order of the keys
+func (b *FileBackend) Snapshot() ([]StorageRecord, error) {
+	return b.memory.Snapshot()
+}
+
+// Close closes the file
+func (b *FileBackend) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.file == nil {
+		return nil
+	}
+
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"errors"
+	"fmt"
+	plgin "plugin"
+	"strconv"
+	"strings"
+)
+
+// SharedAPIVersion is the version of this package, a plugin requiring the same major version and at most the same
+// minor version can be loaded
+const SharedAPIVersion = "1.1.0"
+
+// ManifestSymbol is the name of the PluginManifest variable a plugin exports
+const ManifestSymbol = "Manifest"
+
+// PluginDependency is a plugin which must be loaded before, at a minimum version if set
+type PluginDependency struct {
+	Name    string
+	Version string
+}
+
+// PluginManifest describes a plugin, it is exported by the plugin as Manifest and checked before the plugin is created
+type PluginManifest struct {
+	// Name is the name of the plugin in its settings
+	Name    string
+	Version string
+	// APIVersion is the SharedAPIVersion the plugin was built against, the plugins set it to shared.SharedAPIVersion
+	APIVersion   string
+	Author       string
+	Capabilities []string
+	Dependencies []PluginDependency
+}
+
+// manifests are the manifests of the loaded plugins by name
+var manifests = make(map[string]PluginManifest)
+
+// GetManifest returns the manifest of a loaded plugin
+func GetManifest(name string) (PluginManifest, bool) {
+	pluginsMutex.RLock()
+	defer pluginsMutex.RUnlock()
+
+	manifest, ok := manifests[name]
+	return manifest, ok
+}
+
+// parseVersion parses a major.minor.patch version, the missing parts are zeros
+func parseVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) > 3 {
+		return parsed, fmt.Errorf("Invalid version %q", version)
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("Invalid version %q", version)
+		}
+		parsed[i] = n
+	}
+	return parsed, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is older, the same or newer than b
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Check verifies the plugin can run with this package and the plugins loaded so far
+func (m PluginManifest) Check() error {
+	if m.Name == "" {
+		return errors.New("The manifest has no name")
+	}
+
+	if _, err := parseVersion(m.Version); err != nil {
+		return fmt.Errorf("%s: %v", m.Name, err)
+	}
+
+	required, err := parseVersion(m.APIVersion)
+	if err != nil {
+		return fmt.Errorf("%s: %v", m.Name, err)
+	}
+	provided, _ := parseVersion(SharedAPIVersion)
+	if required[0] != provided[0] || required[1] > provided[1] {
+		return fmt.Errorf("%s %s needs the shared API %s but the host provides %s", m.Name, m.Version, m.APIVersion,
+			SharedAPIVersion)
+	}
+
+	for _, dependency := range m.Dependencies {
+		loaded, ok := GetManifest(dependency.Name)
+		if !ok && GetPlugin(dependency.Name) == nil {
+			return fmt.Errorf("%s needs %s which is not loaded", m.Name, dependency.Name)
+		}
+
+		if dependency.Version == "" {
+			continue
+		}
+		minimum, err := parseVersion(dependency.Version)
+		if err != nil {
+			return fmt.Errorf("%s: %v", m.Name, err)
+		}
+		version, err := parseVersion(loaded.Version)
+		if !ok || err != nil || compareVersions(version, minimum) < 0 {
+			return fmt.Errorf("%s needs %s %s or newer but %s %s is loaded", m.Name, dependency.Name, dependency.Version,
+				dependency.Name, loaded.Version)
+		}
+	}
+	return nil
+}
+
+// lookupManifest returns the manifest exported by the plugin, nil if it has none
+func lookupManifest(dylib *plgin.Plugin) (*PluginManifest, error) {
+	symbol, err := dylib.Lookup(ManifestSymbol)
+	if err != nil {
+		// The plugins without manifest are loaded without checks
+		return nil, nil
+	}
+
+	switch manifest := symbol.(type) {
+	case *PluginManifest:
+		return manifest, nil
+	case func() PluginManifest:
+		m := manifest()
+		return &m, nil
+	}
+	return nil, errors.New("Cannot cast the manifest")
+}
+
+// openPlugin opens a plugin file once its build matches the host, the errors of the Go runtime about mismatching
+// builds are explained
+func openPlugin(path string) (*plgin.Plugin, error) {
+	if err := checkBuild(path); err != nil {
+		return nil, err
+	}
+
+	openingPlugin()
+	dylib, err := plgin.Open(path)
+	if err != nil && strings.Contains(err.Error(), "different version of package") {
+		return nil, fmt.Errorf("Cannot load %s, it was built from other sources than the host, rebuild both from the "+
+			"same tree with the same Go version (%v)", path, err)
+	}
+	return dylib, err
+}
+
+// ReadManifest returns the manifest of a plugin file without creating the plugin, nil if it has none
+func ReadManifest(path string) (*PluginManifest, error) {
+	dylib, err := openPlugin(path)
+	if err != nil {
+		return nil, err
+	}
+	return lookupManifest(dylib)
+}
@@ -29,10 +29,16 @@ package shared
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	plgin "plugin"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
 )
 
 // Plugin is the general interface to implement
@@ -47,6 +53,11 @@ type PluginListener interface {
 	PluginLoaded(plugin Plugin)
 }
 
+// identifiable is implemented by the helpers that need to know the id of the plugin embedding them
+type identifiable interface {
+	setIdentity(id uuid.UUID)
+}
+
 // SimplePlugin implements basic functionality of a plugin
 type SimplePlugin struct {
 	Settings Settings
@@ -73,13 +84,33 @@ func (p *SimplePlugin) Stop() {
 var plugins = make(map[string]Plugin)
 var listeners []PluginListener
 
+// loadMutex serializes the loads of the plugins
+var loadMutex sync.Mutex
+
+// pluginsMutex guards plugins, manifests, listeners and settingsListeners, they are read while other plugins load
+var pluginsMutex sync.RWMutex
+
 // LoadPlugin is the helper to load a plugin
 func LoadPlugin(path string) (plugin Plugin, err error) {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
 	var dylib *plgin.Plugin
-	if dylib, err = plgin.Open(path); err != nil {
+	if dylib, err = openPlugin(path); err != nil {
 		return
 	}
 
+	// The manifest is checked before the plugin is created
+	var manifest *PluginManifest
+	if manifest, err = lookupManifest(dylib); err != nil {
+		return
+	}
+	if manifest != nil {
+		if err = manifest.Check(); err != nil {
+			return nil, fmt.Errorf("Cannot load %s: %v", path, err)
+		}
+	}
+
 	var factorySymbol plgin.Symbol
 	if factorySymbol, err = dylib.Lookup("NewPlugin"); err != nil {
 		return
@@ -98,56 +129,266 @@ func LoadPlugin(path string) (plugin Plugin, err error) {
 		return
 	}
 
+	settings := plugin.GetSettings()
+	if settings.ID() == uuid.Nil || settings.Name() == "" {
+		return nil, errors.New("The plugin settings need an id and a name")
+	}
+	if manifest != nil && manifest.Name != settings.Name() {
+		return nil, fmt.Errorf("The manifest of %s is named %s", settings.Name(), manifest.Name)
+	}
+
+	// The configuration is merged and validated before the listeners see the plugin, all the problems are reported
+	// at once
+	errs := &SettingsError{Name: settings.Name()}
+	errs.add(ConfigureSettings(settings))
+	if schema, ok := plugin.(SettingsSchema); ok {
+		errs.add(ValidateSettings(settings, schema.Schema()))
+	}
+	if err = errs.err(); err != nil {
+		return nil, err
+	}
+
+	if configured, ok := plugin.(SettingsConfigured); ok {
+		if err = configured.SettingsConfigured(); err != nil {
+			return nil, fmt.Errorf("Cannot configure %s: %v", settings.Name(), err)
+		}
+		if settings.ID() == uuid.Nil {
+			return nil, errors.New("The plugin settings need an id and a name")
+		}
+	}
+
 	// TODO: verify unique plugin uuid and other error checks
 
-	for _, listener := range listeners {
+	registerPlugin(plugin, manifest)
+	return
+}
+
+// registerPlugin identifies a configured plugin and makes it known to the listeners, loadMutex must be held
+func registerPlugin(plugin Plugin, manifest *PluginManifest) {
+	for _, m := range mixins(plugin, isIdentifiable) {
+		m.(identifiable).setIdentity(plugin.GetSettings().ID())
+	}
+
+	// The listeners are called without pluginsMutex, they may look up the plugins
+	pluginsMutex.RLock()
+	current := append([]PluginListener(nil), listeners...)
+	pluginsMutex.RUnlock()
+	loaded := loadedPlugins()
+
+	for _, listener := range current {
 		// Send to all the listeners already loaded
 		listener.PluginLoaded(plugin)
 	}
 
-	if listener, ok := plugin.(PluginListener); ok {
-		for _, plugin := range plugins {
+	var added []PluginListener
+	for _, m := range mixins(plugin, isPluginListener) {
+		listener := m.(PluginListener)
+		for _, plugin := range loaded {
 			// If the loaded plugin is a listener then send all the loaded plugins to it
 			listener.PluginLoaded(plugin)
 		}
 
-		listeners = append(listeners, listener)
+		added = append(added, listener)
+	}
+
+	pluginsMutex.Lock()
+	listeners = append(listeners, added...)
+	for _, m := range mixins(plugin, isSettingsListener) {
+		settingsListeners = append(settingsListeners, m.(SettingsListener))
 	}
 
 	plugins[plugin.GetSettings().Name()] = plugin
+	if manifest != nil {
+		manifests[manifest.Name] = *manifest
+	}
+	pluginsMutex.Unlock()
 
-	return
+	indexPlugin(plugin, manifest)
+}
+
+// loadedPlugins returns the loaded plugins
+func loadedPlugins() []Plugin {
+	pluginsMutex.RLock()
+	defer pluginsMutex.RUnlock()
+
+	loaded := make([]Plugin, 0, len(plugins))
+	for _, plugin := range plugins {
+		loaded = append(loaded, plugin)
+	}
+	return loaded
+}
+
+func isIdentifiable(value interface{}) bool {
+	_, ok := value.(identifiable)
+	return ok
+}
+
+func isPluginListener(value interface{}) bool {
+	_, ok := value.(PluginListener)
+	return ok
+}
+
+func isSettingsListener(value interface{}) bool {
+	_, ok := value.(SettingsListener)
+	return ok
+}
+
+// mixins returns the value if it implements the interface, else the helpers embedded in it implementing it, so a
+// plugin embedding several helpers (like UseStorage and UseSecrets) has all of them set up
+func mixins(value interface{}, implements func(value interface{}) bool) []interface{} {
+	if implements(value) {
+		return []interface{}{value}
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	var found []interface{}
+	for i := 0; i < v.Elem().NumField(); i++ {
+		field := v.Elem().Field(i)
+		if !v.Elem().Type().Field(i).Anonymous || !field.CanInterface() {
+			continue
+		}
+
+		if field.Kind() == reflect.Ptr {
+			found = append(found, mixins(field.Interface(), implements)...)
+		} else {
+			found = append(found, mixins(field.Addr().Interface(), implements)...)
+		}
+	}
+	return found
 }
 
-// LoadAllPlugins loads all the plugins in a directory
+// LoadAllPlugins loads all the plugins in a directory, after the plugins they depend on. A plugin failing to load is
+// logged and skipped along with the plugins depending on it.
 func LoadAllPlugins(libDir string) chan<- struct{} {
 	ch := make(chan struct{})
+
+	var paths []string
 	filepath.Walk(libDir, func(path string, info os.FileInfo, err error) error {
-		if info.Mode()&os.ModeDir == 0 {
-			if ext := filepath.Ext(path); ext == ".so" {
-				plugin, err := LoadPlugin(path)
-				if err != nil {
-					log.Print(err)
+		if err == nil && info.Mode()&os.ModeDir == 0 && filepath.Ext(path) == ".so" {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+
+	paths, found, err := dependencyOrder(paths)
+	if err != nil {
+		log.Print(err)
+		return ch
+	}
+
+	failed := make(map[string]bool)
+	for _, path := range paths {
+		manifest := found[path]
+		if manifest != nil {
+			if dependency := failedDependency(*manifest, failed); dependency != "" {
+				log.Printf("Cannot load %s, it depends on %s which failed to load", manifest.Name, dependency)
+				failed[manifest.Name] = true
+				continue
+			}
+		}
+
+		plugin, err := LoadPlugin(path)
+		if err != nil {
+			log.Print(err)
+			if manifest != nil {
+				failed[manifest.Name] = true
+			}
+			continue
+		}
+
+		plugin.Start(ch)
+	}
+	return ch
+}
+
+// failedDependency returns the name of a dependency of the manifest which failed to load, empty if there is none
+func failedDependency(manifest PluginManifest, failed map[string]bool) string {
+	for _, dependency := range manifest.Dependencies {
+		if failed[dependency.Name] {
+			return dependency.Name
+		}
+	}
+	return ""
+}
+
+// dependencyOrder sorts the plugin files so the dependencies declared in their manifests come first, the plugins
+// without manifest keep their order. It returns the manifests by path, the files which cannot be opened are logged
+// and left out.
+func dependencyOrder(paths []string) ([]string, map[string]*PluginManifest, error) {
+	byName := make(map[string]string)
+	names := make(map[string]string)
+	deps := make(map[string][]PluginDependency)
+	found := make(map[string]*PluginManifest)
+	var opened []string
+	for _, path := range paths {
+		manifest, err := ReadManifest(path)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		opened = append(opened, path)
+		if manifest != nil {
+			byName[manifest.Name] = path
+			names[path] = manifest.Name
+			deps[path] = manifest.Dependencies
+			found[path] = manifest
+		}
+	}
+
+	var ordered []string
+	visiting := make(map[string]bool)
+	visited := make(map[string]bool)
+
+	var visit func(path string, chain []string) error
+	visit = func(path string, chain []string) error {
+		if visited[path] {
+			return nil
+		}
+		if visiting[path] {
+			return fmt.Errorf("Circular plugin dependencies: %s", strings.Join(append(chain, names[path]), " -> "))
+		}
+
+		visiting[path] = true
+		for _, dependency := range deps[path] {
+			// The missing dependencies are reported when the plugin is loaded
+			if dep, ok := byName[dependency.Name]; ok {
+				if err := visit(dep, append(chain, names[path])); err != nil {
 					return err
 				}
-
-				plugin.Start(ch)
 			}
 		}
+		visiting[path] = false
+
+		visited[path] = true
+		ordered = append(ordered, path)
 		return nil
-	})
-	return ch
+	}
+
+	for _, path := range opened {
+		if err := visit(path, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ordered, found, nil
 }
 
 // StopAllPlugins stops all plugins by closing the done channel
 func StopAllPlugins(done chan<- struct{}) {
 	close(done)
-	for _, plugin := range plugins {
+	for _, plugin := range loadedPlugins() {
 		plugin.Stop()
 	}
 }
 
 // GetPlugin returns a loaded plugin
 func GetPlugin(name string) Plugin {
+	pluginsMutex.RLock()
+	defer pluginsMutex.RUnlock()
+
 	return plugins[name]
 }
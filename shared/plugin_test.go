@@ -0,0 +1,136 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDependencyOrderSkipsBadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bad := filepath.Join(dir, "bad.so")
+	if err := ioutil.WriteFile(bad, []byte("not a plugin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, found, err := dependencyOrder([]string{bad})
+	if err != nil || len(paths) != 0 || len(found) != 0 {
+		t.Fatalf("Expected the bad file to be left out, got %v %v %v", paths, found, err)
+	}
+}
+
+func TestFailedDependency(t *testing.T) {
+	manifest := PluginManifest{Name: "Service", Dependencies: []PluginDependency{{Name: "Bus"}, {Name: "Storage"}}}
+
+	if dependency := failedDependency(manifest, map[string]bool{"Other": true}); dependency != "" {
+		t.Fatalf("Expected no failed dependency, got %s", dependency)
+	}
+	if dependency := failedDependency(manifest, map[string]bool{"Storage": true}); dependency != "Storage" {
+		t.Fatalf("Expected Storage to have failed, got %q", dependency)
+	}
+}
+
+// loadCounter counts the plugins loaded and the settings changed
+type loadCounter struct {
+	SimplePlugin
+	loaded  int32
+	changed int32
+}
+
+func (c *loadCounter) PluginLoaded(plugin Plugin) {
+	atomic.AddInt32(&c.loaded, 1)
+}
+
+func (c *loadCounter) PluginSettingsChanged(plugin Plugin) {
+	atomic.AddInt32(&c.changed, 1)
+}
+
+func TestLookupWhileLoading(t *testing.T) {
+	defer func(p map[string]Plugin, m map[string]PluginManifest, l []PluginListener, s []SettingsListener) {
+		plugins, manifests, listeners, settingsListeners = p, m, l, s
+	}(plugins, manifests, listeners, settingsListeners)
+	defer func(l []Plugin, c map[string][]Plugin) {
+		loaded, capabilities = l, c
+	}(loaded, capabilities)
+	plugins, manifests, listeners, settingsListeners = make(map[string]Plugin), make(map[string]PluginManifest), nil, nil
+	loaded, capabilities = nil, make(map[string][]Plugin)
+
+	counter := &loadCounter{SimplePlugin: SimplePlugin{Settings: SetupSettings(uuid.New(), "Counter", "")}}
+	loadMutex.Lock()
+	registerPlugin(counter, nil)
+	loadMutex.Unlock()
+
+	host := &Host{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("Plugin %d", i/2)
+			UpdateSettings(name, map[string]interface{}{"count": i})
+			GetPlugin(name)
+			GetManifest(name)
+			PluginCapabilities(name)
+			host.Storage(uuid.New())
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("Plugin %d", i)
+		settings := SetupSettings(uuid.New(), name, "")
+		settings["count"] = -1
+
+		loadMutex.Lock()
+		registerPlugin(&SimplePlugin{Settings: settings}, &PluginManifest{Name: name, Version: "1.0.0"})
+		loadMutex.Unlock()
+	}
+	<-done
+
+	if loaded := atomic.LoadInt32(&counter.loaded); loaded != 100 {
+		t.Fatalf("The listener saw %d plugins loaded, expected 100", loaded)
+	}
+
+	changed := atomic.LoadInt32(&counter.changed)
+	if err := UpdateSettings("Plugin 99", map[string]interface{}{"count": 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&counter.changed) != changed+1 {
+		t.Fatal("The settings listener was not notified")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// StorageSettingQuota is the key for the StorageQuota of every plugin in the storage settings
+	StorageSettingQuota = "quota"
+	// StorageSettingQuotas is the key for the map[uuid.UUID]StorageQuota of the plugins with their own quota
+	StorageSettingQuotas = "quotas"
+)
+
+// ErrStorageQuotaExceeded is returned when a change would store more keys or bytes than the quota of the namespace
+var ErrStorageQuotaExceeded = errors.New("The storage quota is exceeded")
+
+// StorageQuota limits a namespace, a zero value means no limit
+type StorageQuota struct {
+	MaxKeys  int
+	MaxBytes int
+}
+
+// StorageUsage is the consumption of a namespace, the bytes are the encoded sizes of the values
+type StorageUsage struct {
+	Owner uuid.UUID
+	Keys  int
+	Bytes int
+	Quota StorageQuota
+}
+
+// StorageQuotaSchema declares the quota settings of the storage plugins
+var StorageQuotaSchema = []SettingSpec{
+	{Key: StorageSettingQuota, Type: StorageQuota{}, Description: "quota of every plugin"},
+	{Key: StorageSettingQuotas, Type: map[uuid.UUID]StorageQuota{}, Description: "quotas of the plugins with their own"},
+}
+
+// StorageQuotaFor returns the quota of a plugin from the storage settings
+func StorageQuotaFor(settings Settings, owner uuid.UUID) StorageQuota {
+	var quotas map[uuid.UUID]StorageQuota
+	if settings.GetValue(StorageSettingQuotas, &quotas) {
+		if quota, ok := quotas[owner]; ok {
+			return quota
+		}
+	}
+
+	var quota StorageQuota
+	settings.GetValue(StorageSettingQuota, &quota)
+	return quota
+}
+
+// Usage returns the consumption of the namespace, or of all the namespaces for the host
+func (s *UseStorage) Usage() ([]StorageUsage, error) {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeUsage})
+	if err != nil {
+		return nil, err
+	}
+
+	usage, ok := res.([]StorageUsage)
+	if !ok {
+		return nil, fmt.Errorf("Invalid storage response %T", res)
+	}
+	return usage, nil
+}
+
+func init() {
+	storageErrors[ErrStorageQuotaExceeded.Error()] = ErrStorageQuotaExceeded
+	gob.Register([]StorageUsage{})
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestQuotaRejectsChanges(t *testing.T) {
+	storage, engine := newTestStorage(uuid.New())
+	engine.Quota = func(owner uuid.UUID) StorageQuota {
+		return StorageQuota{MaxKeys: 2, MaxBytes: 1 << 10}
+	}
+
+	if err := storage.Write("/a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Write("/b", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Write("/c", "c"); err != ErrStorageQuotaExceeded {
+		t.Fatalf("Expected ErrStorageQuotaExceeded for a third key, got %v", err)
+	}
+
+	// Replacing a value or freeing a key stays within the quota
+	if err := storage.Write("/a", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Begin().Delete("/b").Write("/c", "c").Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Write("/a", strings.Repeat("x", 2<<10)); err != ErrStorageQuotaExceeded {
+		t.Fatalf("Expected ErrStorageQuotaExceeded for a large value, got %v", err)
+	}
+	if _, err := storage.Begin().Write("/a", "small").Write("/c", strings.Repeat("x", 2<<10)).Commit(); err != ErrStorageQuotaExceeded {
+		t.Fatalf("Expected ErrStorageQuotaExceeded for a large batch, got %v", err)
+	}
+	if value := <-storage.Read("/a"); value != "changed" {
+		t.Fatalf("Expected the rejected batch to change nothing, got %v", value)
+	}
+}
+
+func TestUsageOfPluginAndHost(t *testing.T) {
+	first, second := uuid.New(), uuid.New()
+	storage, engine := newTestStorage(first)
+	engine.Quota = func(owner uuid.UUID) StorageQuota {
+		if owner == first {
+			return StorageQuota{MaxKeys: 10}
+		}
+		return StorageQuota{}
+	}
+
+	other := sameTestStorage(storage, second)
+	for _, path := range []string{"/a", "/b"} {
+		if err := storage.Write(path, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.Write("/a", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plugin only sees its own namespace
+	usage, err := storage.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].Owner != first || usage[0].Keys != 2 || usage[0].Bytes == 0 || usage[0].Quota.MaxKeys != 10 {
+		t.Fatalf("Unexpected usage of the plugin %+v", usage)
+	}
+
+	usage, err = sameTestStorage(storage, uuid.Nil).Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[uuid.UUID]int)
+	for _, u := range usage {
+		keys[u.Owner] = u.Keys
+	}
+	if len(usage) != 2 || keys[first] != 2 || keys[second] != 1 {
+		t.Fatalf("Unexpected usage of the host %+v", usage)
+	}
+
+	if err := storage.Delete("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := storage.Usage(); err != nil || usage[0].Keys != 1 {
+		t.Fatalf("Expected 1 key after the delete, got %+v %v", usage, err)
+	}
+}
+
+func TestStorageQuotaFor(t *testing.T) {
+	plugin := uuid.New()
+	settings := Settings{
+		StorageSettingQuota:  StorageQuota{MaxKeys: 5},
+		StorageSettingQuotas: map[uuid.UUID]StorageQuota{plugin: {MaxBytes: 100}},
+	}
+
+	if quota := StorageQuotaFor(settings, plugin); quota != (StorageQuota{MaxBytes: 100}) {
+		t.Fatalf("Expected the quota of the plugin, got %+v", quota)
+	}
+	if quota := StorageQuotaFor(settings, uuid.New()); quota != (StorageQuota{MaxKeys: 5}) {
+		t.Fatalf("Expected the quota of every plugin, got %+v", quota)
+	}
+	if quota := StorageQuotaFor(Settings{}, plugin); quota != (StorageQuota{}) {
+		t.Fatalf("Expected no quota, got %+v", quota)
+	}
+}
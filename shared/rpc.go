@@ -0,0 +1,281 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// RPCRequest calls a named method of an endpoint
+type RPCRequest struct {
+	Method string
+	Args   interface{}
+	// Caller is set from the envelope by the receiving endpoint
+	Caller uuid.UUID
+}
+
+// RPCResponse is the answer to an RPCRequest
+type RPCResponse struct {
+	Reply interface{}
+	Error string
+}
+
+// RPCService is the interface that, when implemented by an Endpoint, serves the RPC requests sent through the bus
+type RPCService interface {
+	ServeRPC(request RPCRequest) RPCResponse
+}
+
+// rpcMethod is a registered method
+type rpcMethod struct {
+	receiver  reflect.Value
+	method    reflect.Method
+	argsType  reflect.Type
+	replyType reflect.Type
+	// caller is set for the methods receiving the identity of the caller
+	caller bool
+}
+
+// RPCServer allows an endpoint to serve the methods of a service struct, in the style of net/rpc
+type RPCServer struct {
+	methods map[string]*rpcMethod
+	mutex   sync.RWMutex
+}
+
+// Make sure RPCServer implements required interfaces
+var _ RPCService = (*RPCServer)(nil)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfUUID = reflect.TypeOf(uuid.UUID{})
+
+// Register publishes the methods of the receiver of the form "func (t *T) Name(args A, reply *R) error" as "T.Name",
+// the methods of the form "func (t *T) Name(caller uuid.UUID, args A, reply *R) error" also receive the caller
+func (s *RPCServer) Register(receiver interface{}) error {
+	return s.RegisterName(reflect.Indirect(reflect.ValueOf(receiver)).Type().Name(), receiver)
+}
+
+// RegisterName is like Register but uses the provided name for the type
+func (s *RPCServer) RegisterName(name string, receiver interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value := reflect.ValueOf(receiver)
+	found := make(map[string]*rpcMethod)
+	for i := 0; i < value.Type().NumMethod(); i++ {
+		method := value.Type().Method(i)
+		mtype := method.Type
+
+		if method.PkgPath != "" || mtype.NumOut() != 1 || mtype.Out(0) != typeOfError {
+			continue
+		}
+
+		caller := mtype.NumIn() == 4 && mtype.In(1) == typeOfUUID
+		if mtype.NumIn() != 3 && !caller {
+			continue
+		}
+
+		last := mtype.NumIn() - 1
+		if mtype.In(last).Kind() != reflect.Ptr {
+			continue
+		}
+
+		m := &rpcMethod{
+			receiver:  value,
+			method:    method,
+			argsType:  mtype.In(last - 1),
+			replyType: mtype.In(last).Elem(),
+			caller:    caller,
+		}
+
+		// The values travel in interfaces so remote buses need to know the types, they are registered once here
+		// rather than on every call
+		if err := registerType(m.argsType); err != nil {
+			return err
+		}
+		if err := registerType(m.replyType); err != nil {
+			return err
+		}
+
+		found[name+"."+method.Name] = m
+	}
+
+	if len(found) == 0 {
+		return fmt.Errorf("Type %s has no method suitable for RPC", name)
+	}
+
+	if s.methods == nil {
+		s.methods = make(map[string]*rpcMethod)
+	}
+	for key, m := range found {
+		s.methods[key] = m
+	}
+	return nil
+}
+
+// ServeRPC calls the requested method, a panicking method is answered with an error
+func (s *RPCServer) ServeRPC(request RPCRequest) (response RPCResponse) {
+	s.mutex.RLock()
+	m, ok := s.methods[request.Method]
+	s.mutex.RUnlock()
+
+	if !ok {
+		return RPCResponse{Error: fmt.Sprintf("Unknown method %s", request.Method)}
+	}
+
+	args := reflect.ValueOf(request.Args)
+	if !args.IsValid() {
+		args = reflect.Zero(m.argsType)
+	} else if !args.Type().AssignableTo(m.argsType) {
+		return RPCResponse{Error: fmt.Sprintf("Invalid arguments for %s: expected %v, got %v", request.Method, m.argsType, args.Type())}
+	}
+
+	reply := reflect.New(m.replyType)
+	in := []reflect.Value{m.receiver, args, reply}
+	if m.caller {
+		in = []reflect.Value{m.receiver, reflect.ValueOf(request.Caller), args, reply}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("RPC method %s panicked: %v", request.Method, r)
+			response = RPCResponse{Error: fmt.Sprintf("RPC method %s panicked: %v", request.Method, r)}
+		}
+	}()
+	out := m.method.Func.Call(in)
+
+	if err, _ := out[0].Interface().(error); err != nil {
+		return RPCResponse{Error: err.Error()}
+	}
+
+	return RPCResponse{Reply: reply.Elem().Interface()}
+}
+
+// ErrRPCUnreachable is returned when the RPC request could not be delivered
+var ErrRPCUnreachable = errors.New("Cannot reach the RPC endpoint")
+
+// Call invokes a method of an endpoint and stores the result in reply, which must be a pointer. The types of args and
+// reply are registered with gob by the service, a caller in another process registers them in its init.
+func (b *UseBus) Call(uuid uuid.UUID, method string, args interface{}, reply interface{}) error {
+	return b.CallContext(context.Background(), uuid, method, args, reply)
+}
+
+// CallContext is Call returning the error of the context once it is done, the reply is then left untouched
+func (b *UseBus) CallContext(ctx context.Context, uuid uuid.UUID, method string, args interface{}, reply interface{}) error {
+	replyValue := reflect.ValueOf(reply)
+	if replyValue.Kind() != reflect.Ptr || replyValue.IsNil() {
+		return errors.New("The reply must be a non nil pointer")
+	}
+	if _, err := b.sender(); err != nil {
+		return err
+	}
+
+	ch := b.SendMessageContext(ctx, uuid, RPCRequest{Method: method, Args: args})
+	if ch == nil {
+		return ErrRPCUnreachable
+	}
+
+	var res interface{}
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return ErrRPCUnreachable
+		}
+		res = r
+	case <-ctx.Done():
+		// The buses not implementing ContextBus keep sending the results
+		go func() {
+			for range ch {
+			}
+		}()
+		return ctx.Err()
+	}
+
+	response, ok := res.(RPCResponse)
+	if !ok {
+		return fmt.Errorf("Invalid RPC response %T", res)
+	}
+
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+
+	result := reflect.ValueOf(response.Reply)
+	if !result.IsValid() {
+		replyValue.Elem().Set(reflect.Zero(replyValue.Elem().Type()))
+		return nil
+	}
+
+	if !result.Type().AssignableTo(replyValue.Elem().Type()) {
+		return fmt.Errorf("Invalid reply for %s: expected %v, got %v", method, replyValue.Elem().Type(), result.Type())
+	}
+
+	replyValue.Elem().Set(result)
+	return nil
+}
+
+// registerType makes gob aware of a concrete type carried in an interface, a name already taken by another type is
+// returned as an error instead of the panic of gob
+func registerType(t reflect.Type) (err error) {
+	if t.Kind() == reflect.Interface {
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Cannot register %v for RPC: %v", t, r)
+		}
+	}()
+	gob.Register(reflect.Zero(t).Interface())
+	return nil
+}
+
+// serveRPC answers an RPC request if the endpoint is an RPC service
+func serveRPC(endpoint Endpoint, request RPCRequest) (<-chan interface{}, error) {
+	service, ok := endpoint.(RPCService)
+	if !ok {
+		log.Printf("Endpoint cannot serve %s", request.Method)
+		return nil, errors.New("Endpoint is not an RPC service")
+	}
+
+	ch := make(chan interface{}, 1)
+	ch <- service.ServeRPC(request)
+	close(ch)
+	return ch, nil
+}
+
+func init() {
+	gob.Register(RPCRequest{})
+	gob.Register(RPCResponse{})
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"context"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type conflictArgs struct {
+	Value int
+}
+
+type conflictService struct{}
+
+func (conflictService) Echo(args conflictArgs, reply *int) error {
+	*reply = args.Value
+	return nil
+}
+
+func TestRegisterNameConflict(t *testing.T) {
+	// Another type already took the name gob gives to the arguments
+	gob.RegisterName("github.com/m4rs14n/go-app/shared.conflictArgs", struct{ Other string }{})
+
+	s := &RPCServer{}
+	if err := s.RegisterName("Conflict", conflictService{}); err == nil {
+		t.Fatal("Conflicting type registered")
+	}
+	if response := s.ServeRPC(RPCRequest{Method: "Conflict.Echo", Args: conflictArgs{Value: 1}}); response.Error == "" {
+		t.Fatal("Method of a failed registration served")
+	}
+}
+
+func TestCallContextTimeout(t *testing.T) {
+	bus := &silentBus{endpoints: []uuid.UUID{uuid.New()}}
+	b := &UseBus{}
+	b.setIdentity(uuid.New())
+	b.PluginLoaded(&busPlugin{SimplePlugin{Settings: SetupSettings(uuid.New(), "Silent", "")}, bus})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	reply := 1
+	if err := b.CallContext(ctx, bus.endpoints[0], "Silent.Echo", 0, &reply); err != context.DeadlineExceeded {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if reply != 1 {
+		t.Fatalf("The reply changed after the timeout to %d", reply)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// SettingSpec declares a setting of a plugin
+type SettingSpec struct {
+	Key         string
+	Description string
+	// Type is a value of the type of the setting, like 0 or "", the type of Default if nil
+	Type interface{}
+	// Default is set when the setting is missing
+	Default  interface{}
+	Required bool
+	// Min and Max bound the numbers and the durations, no bound if nil
+	Min interface{}
+	Max interface{}
+	// Values are the allowed values, any value if empty
+	Values []interface{}
+}
+
+// SettingsSchema is the interface that, when implemented by a Plugin, declares its settings so they are validated
+// when it is loaded
+type SettingsSchema interface {
+	Schema() []SettingSpec
+}
+
+// SettingsError reports all the problems of the settings of a plugin
+type SettingsError struct {
+	Name     string
+	Problems []string
+}
+
+func (e *SettingsError) Error() string {
+	return fmt.Sprintf("Invalid settings of %s: %s", e.Name, strings.Join(e.Problems, ", "))
+}
+
+// add appends the problems of an error
+func (e *SettingsError) add(err error) {
+	if se, ok := err.(*SettingsError); ok {
+		e.Problems = append(e.Problems, se.Problems...)
+	} else if err != nil {
+		e.Problems = append(e.Problems, err.Error())
+	}
+}
+
+// err returns the error if there are problems
+func (e *SettingsError) err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// settingNumber returns the numbers and the durations as float64
+func settingNumber(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// ValidateSettings sets the defaults of the missing settings, converts the settings to their types and checks them
+// against the schema, it reports all the problems at once
+func ValidateSettings(settings Settings, schema []SettingSpec) error {
+	errs := &SettingsError{Name: settings.Name()}
+
+	// The defaults and the converted values are written while the plugins may read their settings
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	for _, spec := range schema {
+		value, ok := settings[spec.Key]
+		if !ok || value == nil {
+			if spec.Default != nil {
+				settings[spec.Key] = spec.Default
+			} else if spec.Required {
+				errs.Problems = append(errs.Problems, fmt.Sprintf("%s is required (%s)", spec.Key, spec.Description))
+			}
+			continue
+		}
+
+		t := reflect.TypeOf(spec.Type)
+		if t == nil {
+			t = reflect.TypeOf(spec.Default)
+		}
+
+		if t != nil {
+			converted, err := convertSetting(value, t)
+			if err != nil {
+				errs.Problems = append(errs.Problems, fmt.Sprintf("%s: %v", spec.Key, err))
+				continue
+			}
+			value = converted
+			settings[spec.Key] = value
+		}
+
+		if n, ok := settingNumber(value); ok {
+			if min, ok := settingNumber(spec.Min); ok && n < min {
+				errs.Problems = append(errs.Problems, fmt.Sprintf("%s: %v is below %v", spec.Key, value, spec.Min))
+			}
+			if max, ok := settingNumber(spec.Max); ok && n > max {
+				errs.Problems = append(errs.Problems, fmt.Sprintf("%s: %v is above %v", spec.Key, value, spec.Max))
+			}
+		}
+
+		if len(spec.Values) > 0 {
+			allowed := false
+			for _, v := range spec.Values {
+				allowed = allowed || reflect.DeepEqual(v, value)
+			}
+			if !allowed {
+				errs.Problems = append(errs.Problems, fmt.Sprintf("%s: %v is not one of %v", spec.Key, value, spec.Values))
+			}
+		}
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SecretsPrefix is the directory of the secrets in the namespace of a plugin in the encrypted storage
+const SecretsPrefix = "/secrets/"
+
+// redacted replaces the secrets in the logs and the dumps
+const redacted = "[REDACTED]"
+
+// ErrSecretNotFound is returned when no secret is stored under the name
+var ErrSecretNotFound = errors.New("The secret does not exist")
+
+// Secret is a sensitive value, it is redacted whenever it is formatted so it cannot end up in the logs
+type Secret string
+
+// Make sure Secret implements required interfaces
+var _ fmt.Formatter = Secret("")
+
+// Reveal returns the value of the secret
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// String redacts the secret
+func (s Secret) String() string {
+	return redacted
+}
+
+// GoString redacts the secret
+func (s Secret) GoString() string {
+	return redacted
+}
+
+// Format redacts the secret for all the verbs
+func (s Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+// MarshalJSON redacts the secret in the JSON dumps
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redacted + `"`), nil
+}
+
+// Secrets is the interface of the helpers keeping the secrets of a plugin
+type Secrets interface {
+	GetSecret(name string) (Secret, error)
+	PutSecret(name string, secret Secret) error
+	DeleteSecret(name string) error
+	SecretNames() ([]string, error)
+}
+
+// UseSecrets is an embeddable helper to keep the credentials of a plugin in its namespace of the encrypted storage
+type UseSecrets struct {
+	UseBus
+}
+
+// Make sure UseSecrets implements required interfces
+var _ Secrets = (*UseSecrets)(nil)
+
+// secretPath returns the storage path of a secret
+func secretPath(name string) (string, error) {
+	if name == "" || strings.Contains(name, StoragePathSeparator) {
+		return "", fmt.Errorf("Invalid secret name %s", name)
+	}
+	return SecretsPrefix + name, nil
+}
+
+// request sends a message to the encrypted storage and waits for its result
+func (s *UseSecrets) request(msg StorageMessage) (interface{}, error) {
+	ch := s.SendMessage(EncryptedStorageUUID, msg)
+	if ch == nil {
+		return nil, ErrStorageUnreachable
+	}
+
+	res, ok := <-ch
+	if !ok {
+		return nil, ErrStorageUnreachable
+	}
+
+	if err := StorageError(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetSecret returns the secret stored under the name
+func (s *UseSecrets) GetSecret(name string) (Secret, error) {
+	path, err := secretPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeRead, Path: path})
+	if err != nil {
+		return "", err
+	} else if res == nil {
+		return "", ErrSecretNotFound
+	}
+
+	secret, ok := res.(Secret)
+	if !ok {
+		return "", fmt.Errorf("Invalid secret %s of type %T", name, res)
+	}
+	return secret, nil
+}
+
+// PutSecret stores the secret under the name
+func (s *UseSecrets) PutSecret(name string, secret Secret) error {
+	path, err := secretPath(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.request(StorageMessage{Type: StorageMessageTypeWrite, Path: path, Value: secret})
+	return err
+}
+
+// DeleteSecret removes the secret stored under the name
+func (s *UseSecrets) DeleteSecret(name string) error {
+	path, err := secretPath(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.request(StorageMessage{Type: StorageMessageTypeDelete, Path: path})
+	return err
+}
+
+// SecretNames returns the sorted names of the secrets
+func (s *UseSecrets) SecretNames() ([]string, error) {
+	names := []string{}
+	cursor := ""
+	for {
+		res, err := s.request(StorageMessage{Type: StorageMessageTypeList, Path: SecretsPrefix, Cursor: cursor})
+		if err != nil {
+			return nil, err
+		}
+
+		list, ok := res.(StorageList)
+		if !ok {
+			return nil, fmt.Errorf("Invalid storage response %T", res)
+		}
+
+		for _, path := range list.Paths {
+			names = append(names, strings.TrimPrefix(path, SecretsPrefix))
+		}
+
+		if list.Next == "" {
+			return names, nil
+		}
+		cursor = list.Next
+	}
+}
+
+func init() {
+	gob.Register(Secret(""))
+}
@@ -28,6 +28,14 @@
 package shared
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/google/uuid"
 )
 
@@ -43,6 +51,12 @@ const (
 	SettingDescription = "description"
 )
 
+// settingsMutex guards the settings of the plugins, they may be updated at runtime while the plugins read them
+var settingsMutex sync.RWMutex
+
+// sensitiveSettings are the parts of the keys whose values are redacted from the dumps even if they are not Secret
+var sensitiveSettings = []string{"passphrase", "password", "secret", "token", "credential"}
+
 // SetupSettings is a helper function to create plugin settings
 func SetupSettings(id uuid.UUID, name string, description string) Settings {
 	return Settings{
@@ -52,17 +66,189 @@ func SetupSettings(id uuid.UUID, name string, description string) Settings {
 	}
 }
 
-// ID returns the id field
+// ErrSettingMissing is returned when looking up a setting which is not set
+var ErrSettingMissing = errors.New("The setting is missing")
+
+// ID returns the id field, uuid.Nil if missing or malformed
 func (s Settings) ID() uuid.UUID {
-	return s[SettingID].(uuid.UUID)
+	var id uuid.UUID
+	s.GetValue(SettingID, &id)
+	return id
 }
 
-// Name returns the name field
+// Name returns the name field, empty if missing or malformed
 func (s Settings) Name() string {
-	return s[SettingName].(string)
+	return s.GetString(SettingName, "")
 }
 
-// Description returns the description field
+// Description returns the description field, empty if missing or malformed
 func (s Settings) Description() string {
-	return s[SettingDescription].(string)
+	return s.GetString(SettingDescription, "")
+}
+
+// Lookup converts the setting to the type pointed by ptr, it returns ErrSettingMissing if the setting is not set
+func (s Settings) Lookup(key string, ptr interface{}) error {
+	settingsMutex.RLock()
+	value, ok := s[key]
+	settingsMutex.RUnlock()
+	if !ok || value == nil {
+		return ErrSettingMissing
+	}
+
+	target := reflect.ValueOf(ptr).Elem()
+	converted, err := convertSetting(value, target.Type())
+	if err != nil {
+		return fmt.Errorf("Invalid setting %s: %v", key, err)
+	}
+
+	target.Set(reflect.ValueOf(converted))
+	return nil
+}
+
+// LookupString returns the setting as a string
+func (s Settings) LookupString(key string) (value string, err error) {
+	err = s.Lookup(key, &value)
+	return
+}
+
+// LookupInt returns the setting as an int
+func (s Settings) LookupInt(key string) (value int, err error) {
+	err = s.Lookup(key, &value)
+	return
+}
+
+// LookupBool returns the setting as a bool
+func (s Settings) LookupBool(key string) (value bool, err error) {
+	err = s.Lookup(key, &value)
+	return
+}
+
+// LookupDuration returns the setting as a time.Duration
+func (s Settings) LookupDuration(key string) (value time.Duration, err error) {
+	err = s.Lookup(key, &value)
+	return
+}
+
+// GetValue converts the setting to the type pointed by ptr, it returns false if the setting is missing or cannot
+// be converted
+func (s Settings) GetValue(key string, ptr interface{}) bool {
+	return s.Lookup(key, ptr) == nil
+}
+
+// GetString returns the setting as a string, or the default
+func (s Settings) GetString(key string, def string) string {
+	var value string
+	if s.GetValue(key, &value) {
+		return value
+	}
+	return def
+}
+
+// GetInt returns the setting as an int, or the default
+func (s Settings) GetInt(key string, def int) int {
+	var value int
+	if s.GetValue(key, &value) {
+		return value
+	}
+	return def
+}
+
+// GetBool returns the setting as a bool, or the default
+func (s Settings) GetBool(key string, def bool) bool {
+	var value bool
+	if s.GetValue(key, &value) {
+		return value
+	}
+	return def
+}
+
+// GetDuration returns the setting as a time.Duration, or the default
+func (s Settings) GetDuration(key string, def time.Duration) time.Duration {
+	var value time.Duration
+	if s.GetValue(key, &value) {
+		return value
+	}
+	return def
+}
+
+// Copy returns a copy of the settings, the values are not copied
+func (s Settings) Copy() Settings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+
+	c := make(Settings, len(s))
+	for k, v := range s {
+		c[k] = v
+	}
+	return c
+}
+
+// replace sets the settings to a copy of the values
+func (s Settings) replace(values Settings) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+
+	for k := range s {
+		if _, ok := values[k]; !ok {
+			delete(s, k)
+		}
+	}
+	for k, v := range values {
+		s[k] = v
+	}
+}
+
+// Changed returns the sorted keys whose values differ from the previous settings, among the given keys or all of them
+func (s Settings) Changed(previous Settings, keys ...string) []string {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+
+	if len(keys) == 0 {
+		for k := range s {
+			keys = append(keys, k)
+		}
+		for k := range previous {
+			if _, ok := s[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	var changed []string
+	for _, k := range keys {
+		if !reflect.DeepEqual(s[k], previous[k]) {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// String formats the settings sorted by key, the secrets and the values of the sensitive keys are redacted
+func (s Settings) String() string {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s:%v", k, s[k])
+		for _, sensitive := range sensitiveSettings {
+			if strings.Contains(strings.ToLower(k), sensitive) {
+				parts[i] = k + ":" + redacted
+				break
+			}
+		}
+	}
+	return "map[" + strings.Join(parts, " ") + "]"
+}
+
+// GoString redacts the settings like String
+func (s Settings) GoString() string {
+	return s.String()
 }
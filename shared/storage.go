@@ -29,6 +29,13 @@ package shared
 
 import (
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -36,17 +43,295 @@ import (
 var UnencryptedStorageUUID = uuid.MustParse("A700A163-BDFE-4AE4-A357-E5E28389C3E7")
 var EncryptedStorageUUID = uuid.MustParse("C9BFE170-745F-4C7B-954F-95BEA16AA3EC")
 
+// ReplicatedStorageUUID is the alias of the storage replica running in the process
+var ReplicatedStorageUUID = uuid.MustParse("3F0C2A5E-8B7D-4E1A-9C6F-2D4B8E1A7C53")
+
+const (
+	// StorageSettingMembers is the key for the node ids of the replicas of a replicated storage, a majority of them
+	// must be up to change the storage, a replica without members runs alone
+	StorageSettingMembers = "members"
+	// StorageSettingNode is the key for the node id of a replica, it is kept in its state file after the first start
+	StorageSettingNode = "node"
+)
+
 // Storage is the interface used to store
 type Storage interface {
-	// Log is the logging method
+	// Read sends the value stored at the path on the channel, nil if nothing is stored
 	Read(path string) <-chan interface{}
-	Write(path string, value interface{})
+	// Write stores the value, it fails with ErrStorageQuotaExceeded if the namespace is full
+	Write(path string, value interface{}, options ...WriteOption) error
+	// Delete removes the value stored at the path
+	Delete(path string) error
+	// Exists checks if a value, even nil, is stored at the path
+	Exists(path string) (bool, error)
+	// List returns up to limit paths starting with the prefix and coming after the cursor
+	List(prefix string, cursor string, limit int) (StorageList, error)
+	// Stat returns the metadata of the value stored at the path
+	Stat(path string) (StorageStat, error)
+	// Share grants another plugin access to a path (and the paths below it) of the namespace
+	Share(path string, grantee uuid.UUID, access int) error
+	// Shared returns the storage namespace of another plugin, as far as it was shared
+	Shared(owner uuid.UUID) Storage
+	// CompareAndSwap writes the value only if the stored version matches, 0 meaning nothing is stored, and returns the new version
+	CompareAndSwap(path string, version uint64, value interface{}, options ...WriteOption) (uint64, error)
+	// Batch applies all the operations atomically, or none of them, and returns the new version of each path
+	Batch(ops []StorageOp) ([]uint64, error)
+	// Begin starts a transaction
+	Begin() *StorageTransaction
+	// Watch streams the changes of the paths starting with the prefix made after the revision until done is closed,
+	// a StorageEventCompacted event tells the changes since the revision are lost
+	Watch(prefix string, revision uint64, done <-chan struct{}) <-chan StorageEvent
+	// ListDir returns the sorted names of the children of a directory, the names of the subdirectories end with a slash
+	ListDir(dir string) ([]string, error)
+	// DeleteTree removes the value at the path and all the values below it
+	DeleteTree(dir string) error
+	// Range returns up to limit sorted paths from start (included) to end (excluded), an empty end means no upper bound,
+	// the next page is the range from Next
+	Range(start string, end string, limit int) (StorageList, error)
+	// Snapshot returns a consistent copy of the namespace, or of all the namespaces for the host
+	Snapshot() (StorageArchive, error)
+	// Restore replaces the content of the namespaces found in the archive, uuid.Nil restores all of them (host only)
+	Restore(archive StorageArchive, namespace uuid.UUID) error
+	// WriteJSON stores the value as a JSON document
+	WriteJSON(path string, value interface{}, options ...WriteOption) error
+	// WriteGob stores the value gob encoded
+	WriteGob(path string, value interface{}, options ...WriteOption) error
+	// WriteBytes stores raw bytes
+	WriteBytes(path string, data []byte, options ...WriteOption) error
+	// ReadInto reads the value stored at the path into target, which must be a pointer
+	ReadInto(path string, target interface{}) error
+	// Usage returns the consumption of the namespace, or of all the namespaces for the host
+	Usage() ([]StorageUsage, error)
+}
+
+// StoragePathSeparator separates the levels of a storage path
+const StoragePathSeparator = "/"
+
+// CleanStoragePath validates a storage path and returns its normal form, e.g. "/a//b/" becomes "/a/b"
+func CleanStoragePath(p string) (string, error) {
+	if !strings.HasPrefix(p, StoragePathSeparator) || strings.ContainsRune(p, 0) {
+		return "", ErrStorageInvalidPath
+	}
+
+	for _, level := range strings.Split(p, StoragePathSeparator) {
+		if level == "." || level == ".." {
+			return "", ErrStorageInvalidPath
+		}
+	}
+
+	return path.Clean(p), nil
+}
+
+// WriteOptions are the options of a write
+type WriteOptions struct {
+	// Expires is when the value expires, never if zero
+	Expires time.Time
+}
+
+// WriteOption sets an option of a write
+type WriteOption func(options *WriteOptions)
+
+// WithTTL makes the value expire after the duration
+func WithTTL(ttl time.Duration) WriteOption {
+	return func(options *WriteOptions) {
+		options.Expires = time.Now().Add(ttl)
+	}
+}
+
+// WithExpiry makes the value expire at the given time
+func WithExpiry(expires time.Time) WriteOption {
+	return func(options *WriteOptions) {
+		options.Expires = expires
+	}
 }
 
-// UseStorage allows a plugin to have access to storage
+func writeOptions(options []WriteOption) WriteOptions {
+	var opts WriteOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	return opts
+}
+
+const (
+	// StorageEventPut is sent when a value is written
+	StorageEventPut = iota
+	// StorageEventDelete is sent when a value is deleted
+	StorageEventDelete
+	// StorageEventExpire is sent when a value expires
+	StorageEventExpire
+	// StorageEventCompacted is sent when the watch resumed after events that are lost, the watched values may have
+	// changed in any way up to Revision
+	StorageEventCompacted
+)
+
+// StorageEvent is a change of a stored value, Revision orders all the changes of a storage
+type StorageEvent struct {
+	Type       int
+	Path       string
+	Value      interface{}
+	OldVersion uint64
+	NewVersion uint64
+	Revision   uint64
+}
+
+// DefaultStorageWatchRetry is the delay before watching again after the storage went away
+const DefaultStorageWatchRetry = time.Second
+
+const (
+	// StorageOpWrite writes the value
+	StorageOpWrite = iota
+	// StorageOpDelete deletes the path
+	StorageOpDelete
+	// StorageOpCheck only checks the version
+	StorageOpCheck
+)
+
+// StorageOp is an operation of a batch, if Match is set the stored version must be Version for the batch to apply
+type StorageOp struct {
+	Type    int
+	Path    string
+	Value   interface{}
+	Version uint64
+	Match   bool
+	Expires time.Time
+}
+
+// StorageTransaction collects operations and applies them atomically on Commit
+type StorageTransaction struct {
+	storage Storage
+	ops     []StorageOp
+	done    bool
+}
+
+// Write adds a write to the transaction
+func (t *StorageTransaction) Write(path string, value interface{}, options ...WriteOption) *StorageTransaction {
+	opts := writeOptions(options)
+	t.ops = append(t.ops, StorageOp{Type: StorageOpWrite, Path: path, Value: value, Expires: opts.Expires})
+	return t
+}
+
+// CompareAndSwap adds a write applied only if the stored version matches
+func (t *StorageTransaction) CompareAndSwap(path string, version uint64, value interface{}, options ...WriteOption) *StorageTransaction {
+	opts := writeOptions(options)
+	t.ops = append(t.ops, StorageOp{Type: StorageOpWrite, Path: path, Value: value, Version: version, Match: true, Expires: opts.Expires})
+	return t
+}
+
+// Delete adds a delete to the transaction
+func (t *StorageTransaction) Delete(path string) *StorageTransaction {
+	t.ops = append(t.ops, StorageOp{Type: StorageOpDelete, Path: path})
+	return t
+}
+
+// Check makes the transaction depend on the version of a path
+func (t *StorageTransaction) Check(path string, version uint64) *StorageTransaction {
+	t.ops = append(t.ops, StorageOp{Type: StorageOpCheck, Path: path, Version: version, Match: true})
+	return t
+}
+
+// Commit applies the operations atomically
+func (t *StorageTransaction) Commit() ([]uint64, error) {
+	if t.done {
+		return nil, ErrStorageTransactionDone
+	}
+	t.done = true
+	return t.storage.Batch(t.ops)
+}
+
+// Abort drops the operations
+func (t *StorageTransaction) Abort() {
+	t.done = true
+	t.ops = nil
+}
+
+const (
+	// StorageAccessNone revokes a previously shared access
+	StorageAccessNone = iota
+	// StorageAccessRead allows reading, checking, listing and stating
+	StorageAccessRead
+	// StorageAccessReadWrite also allows writing and deleting
+	StorageAccessReadWrite
+)
+
+// StorageList is a page of paths, Next is the cursor of the next page or empty on the last page
+type StorageList struct {
+	Paths []string
+	Next  string
+}
+
+// StorageItem is a stored value along with whether anything is stored, a value may be nil
+type StorageItem struct {
+	Path   string
+	Value  interface{}
+	Exists bool
+}
+
+// StorageStat is the metadata of a stored value
+type StorageStat struct {
+	Path        string
+	Exists      bool
+	Size        int
+	Modified    time.Time
+	Expires     time.Time
+	Version     uint64
+	ContentType string
+}
+
+// DefaultStorageListLimit is the page size used when List is called without a limit
+const DefaultStorageListLimit = 100
+
+var (
+	// ErrStorageNotFound is returned when nothing is stored at a path
+	ErrStorageNotFound = errors.New("Nothing is stored at this path")
+	// ErrStorageUnreachable is returned when the storage endpoint cannot be reached
+	ErrStorageUnreachable = errors.New("Cannot reach the storage")
+	// ErrStorageAccessDenied is returned when a path of another namespace was not shared with the caller
+	ErrStorageAccessDenied = errors.New("Access to this path is denied")
+	// ErrStorageConflict is returned when a stored version does not match the expected one
+	ErrStorageConflict = errors.New("The stored version does not match")
+	// ErrStorageInvalidPath is returned for the paths that are not absolute or contain "." or ".." levels
+	ErrStorageInvalidPath = errors.New("Invalid storage path")
+	// ErrStorageTransactionDone is returned when committing a transaction already committed or aborted
+	ErrStorageTransactionDone = errors.New("The transaction is already done")
+	// ErrStorageCompacted is returned when watching from a revision whose events are no longer kept
+	ErrStorageCompacted = errors.New("The events after this revision were compacted")
+)
+
+// storageErrors maps the errors received from the storage back to the error variables
+var storageErrors = map[string]error{
+	ErrStorageNotFound.Error():      ErrStorageNotFound,
+	ErrStorageUnreachable.Error():   ErrStorageUnreachable,
+	ErrStorageAccessDenied.Error():  ErrStorageAccessDenied,
+	ErrStorageConflict.Error():      ErrStorageConflict,
+	ErrStorageInvalidPath.Error():   ErrStorageInvalidPath,
+	ErrStorageCompacted.Error():     ErrStorageCompacted,
+	ErrStorageArchiveSealed.Error(): ErrStorageArchiveSealed,
+}
+
+// StorageError converts an error result received from a storage endpoint, it returns nil for other results
+func StorageError(res interface{}) error {
+	busErr, ok := res.(BusError)
+	if !ok {
+		return nil
+	}
+
+	if err, ok := storageErrors[busErr.Message]; ok {
+		return err
+	}
+	return busErr
+}
+
+// UseStorage allows a plugin to have access to storage, the paths are relative to the namespace of the plugin
 type UseStorage struct {
 	UUID uuid.UUID
 	UseBus
+
+	owner  uuid.UUID
+	parent *UseStorage
+
+	cache      *storageCache
+	cacheMutex sync.Mutex
 }
 
 // Make sure UseStorage implements required interfces
@@ -55,24 +340,347 @@ var _ Storage = (*UseStorage)(nil)
 const (
 	StorageMessageTypeRead = iota
 	StorageMessageTypeWrite
+	StorageMessageTypeDelete
+	StorageMessageTypeExists
+	StorageMessageTypeList
+	StorageMessageTypeStat
+	StorageMessageTypeShare
+	StorageMessageTypeBatch
+	StorageMessageTypeWatch
+	StorageMessageTypeUnwatch
+	StorageMessageTypeListDir
+	StorageMessageTypeDeleteTree
+	StorageMessageTypeRange
+	StorageMessageTypeSnapshot
+	StorageMessageTypeRestore
+	StorageMessageTypeUsage
+	StorageMessageTypeGet
 )
 
+// StorageMessage is a storage request, Owner is the namespace accessed, uuid.Nil for the namespace of the sender
 type StorageMessage struct {
-	Type  int
-	Path  string
-	Value interface{}
+	Type      int
+	Owner     uuid.UUID
+	Path      string
+	Value     interface{}
+	Cursor    string
+	Limit     int
+	Grantee   uuid.UUID
+	Access    int
+	Ops       []StorageOp
+	Revision  uint64
+	WatchID   uuid.UUID
+	Expires   time.Time
+	End       string
+	Namespace uuid.UUID
 }
 
 // Read is the read method
 func (s *UseStorage) Read(path string) <-chan interface{} {
-	return s.SendMessage(s.UUID, StorageMessage{Type: StorageMessageTypeRead, Path: path})
+	msg := StorageMessage{Type: StorageMessageTypeRead, Path: path}
+	if c := s.storageCache(); c != nil {
+		return s.cachedRead(c, msg)
+	}
+	return s.send(msg)
 }
 
 // Write is the write method
-func (s *UseStorage) Write(path string, value interface{}) {
-	s.SendMessage(s.UUID, StorageMessage{Type: StorageMessageTypeWrite, Path: path, Value: value})
+func (s *UseStorage) Write(path string, value interface{}, options ...WriteOption) error {
+	opts := writeOptions(options)
+	_, err := s.request(StorageMessage{Type: StorageMessageTypeWrite, Path: path, Value: value, Expires: opts.Expires})
+	return err
+}
+
+// Delete removes the value stored at the path
+func (s *UseStorage) Delete(path string) error {
+	_, err := s.request(StorageMessage{Type: StorageMessageTypeDelete, Path: path})
+	return err
+}
+
+// Share grants another plugin access to a path (and the paths below it) of the namespace
+func (s *UseStorage) Share(path string, grantee uuid.UUID, access int) error {
+	_, err := s.request(StorageMessage{Type: StorageMessageTypeShare, Path: path, Grantee: grantee, Access: access})
+	return err
+}
+
+// Shared returns the storage namespace of another plugin, as far as it was shared
+func (s *UseStorage) Shared(owner uuid.UUID) Storage {
+	return &UseStorage{UUID: s.UUID, owner: owner, parent: s.root()}
+}
+
+// CompareAndSwap writes the value only if the stored version matches, 0 meaning nothing is stored, and returns the new version
+func (s *UseStorage) CompareAndSwap(path string, version uint64, value interface{}, options ...WriteOption) (uint64, error) {
+	versions, err := s.Begin().CompareAndSwap(path, version, value, options...).Commit()
+	if err != nil {
+		return 0, err
+	}
+	return versions[0], nil
+}
+
+// Batch applies all the operations atomically, or none of them, and returns the new version of each path
+func (s *UseStorage) Batch(ops []StorageOp) ([]uint64, error) {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeBatch, Ops: ops})
+	if err != nil {
+		return nil, err
+	}
+
+	versions, ok := res.([]uint64)
+	if !ok || len(versions) != len(ops) {
+		return nil, fmt.Errorf("Invalid storage response %T", res)
+	}
+	return versions, nil
+}
+
+// Begin starts a transaction
+func (s *UseStorage) Begin() *StorageTransaction {
+	return &StorageTransaction{storage: s}
+}
+
+// Watch streams the changes of the paths starting with the prefix made after the revision until done is closed,
+// it watches again from the last revision received if the storage goes away, or sends StorageEventCompacted and
+// resumes with the kept events if the storage no longer has the events after it
+func (s *UseStorage) Watch(prefix string, revision uint64, done <-chan struct{}) <-chan StorageEvent {
+	return s.watch(prefix, revision, done, func(live bool) {})
+}
+
+// watch is Watch calling live with true when the storage answers the watch and with false when the watch is lost
+func (s *UseStorage) watch(prefix string, revision uint64, done <-chan struct{}, live func(live bool)) <-chan StorageEvent {
+	events := make(chan StorageEvent)
+
+	go func() {
+		defer close(events)
+
+		for {
+			id := uuid.New()
+			if ch := s.send(StorageMessage{Type: StorageMessageTypeWatch, Path: prefix, Revision: revision, WatchID: id}); ch != nil {
+				live(true)
+				forwarding := s.forwardEvents(ch, events, &revision, done)
+				live(false)
+				if !forwarding {
+					s.send(StorageMessage{Type: StorageMessageTypeUnwatch, WatchID: id})
+					go func() {
+						for range ch {
+							// Drain until the storage closes the watch
+						}
+					}()
+					return
+				}
+			}
+
+			select {
+			case <-done:
+				return
+			case <-time.After(DefaultStorageWatchRetry):
+			}
+		}
+	}()
+
+	return events
+}
+
+// forwardEvents forwards the events of a watch, it returns false when done or the watch was refused
+func (s *UseStorage) forwardEvents(ch <-chan interface{}, events chan<- StorageEvent, revision *uint64, done <-chan struct{}) bool {
+	for {
+		select {
+		case <-done:
+			return false
+		case res, ok := <-ch:
+			if !ok {
+				return true
+			}
+
+			if err := StorageError(res); err == ErrStorageCompacted {
+				// Tell the watcher to read the values again and resume with the events still kept
+				select {
+				case events <- StorageEvent{Type: StorageEventCompacted, Revision: *revision}:
+					*revision = 0
+					return true
+				case <-done:
+					return false
+				}
+			} else if err != nil {
+				log.Printf("Cannot watch the storage: %v", err)
+				return false
+			}
+
+			event, ok := res.(StorageEvent)
+			if !ok {
+				continue
+			}
+
+			select {
+			case events <- event:
+				*revision = event.Revision
+			case <-done:
+				return false
+			}
+		}
+	}
+}
+
+// ListDir returns the sorted names of the children of a directory, the names of the subdirectories end with a slash
+func (s *UseStorage) ListDir(dir string) ([]string, error) {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeListDir, Path: dir})
+	if err != nil {
+		return nil, err
+	}
+
+	names, ok := res.([]string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid storage response %T", res)
+	}
+	return names, nil
+}
+
+// DeleteTree removes the value at the path and all the values below it
+func (s *UseStorage) DeleteTree(dir string) error {
+	_, err := s.request(StorageMessage{Type: StorageMessageTypeDeleteTree, Path: dir})
+	return err
+}
+
+// Range returns up to limit sorted paths from start (included) to end (excluded), an empty end means no upper bound,
+// the next page is the range from Next
+func (s *UseStorage) Range(start string, end string, limit int) (StorageList, error) {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeRange, Path: start, End: end, Limit: limit})
+	if err != nil {
+		return StorageList{}, err
+	}
+
+	list, ok := res.(StorageList)
+	if !ok {
+		return StorageList{}, fmt.Errorf("Invalid storage response %T", res)
+	}
+	return list, nil
+}
+
+// Snapshot returns a consistent copy of the namespace, or of all the namespaces for the host
+func (s *UseStorage) Snapshot() (StorageArchive, error) {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeSnapshot})
+	if err != nil {
+		return StorageArchive{}, err
+	}
+
+	archive, ok := res.(StorageArchive)
+	if !ok {
+		return StorageArchive{}, fmt.Errorf("Invalid storage response %T", res)
+	}
+	return archive, nil
+}
+
+// Restore replaces the content of the namespaces found in the archive, uuid.Nil restores all of them (host only)
+func (s *UseStorage) Restore(archive StorageArchive, namespace uuid.UUID) error {
+	_, err := s.request(StorageMessage{Type: StorageMessageTypeRestore, Value: archive, Namespace: namespace})
+	return err
+}
+
+// root returns the storage holding the bus
+func (s *UseStorage) root() *UseStorage {
+	if s.parent != nil {
+		return s.parent
+	}
+	return s
+}
+
+// send sends a storage message to the namespace of the storage
+func (s *UseStorage) send(msg StorageMessage) <-chan interface{} {
+	msg.Owner = s.owner
+	s.invalidateCache(msg)
+	return s.root().SendMessage(s.UUID, msg)
+}
+
+// Exists checks if a value, even nil, is stored at the path
+func (s *UseStorage) Exists(path string) (bool, error) {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeExists, Path: path})
+	if err != nil {
+		return false, err
+	}
+
+	exists, ok := res.(bool)
+	if !ok {
+		return false, fmt.Errorf("Invalid storage response %T", res)
+	}
+	return exists, nil
+}
+
+// List returns up to limit paths starting with the prefix and coming after the cursor
+func (s *UseStorage) List(prefix string, cursor string, limit int) (StorageList, error) {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeList, Path: prefix, Cursor: cursor, Limit: limit})
+	if err != nil {
+		return StorageList{}, err
+	}
+
+	list, ok := res.(StorageList)
+	if !ok {
+		return StorageList{}, fmt.Errorf("Invalid storage response %T", res)
+	}
+	return list, nil
+}
+
+// Stat returns the metadata of the value stored at the path
+func (s *UseStorage) Stat(path string) (StorageStat, error) {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeStat, Path: path})
+	if err != nil {
+		return StorageStat{}, err
+	}
+
+	stat, ok := res.(StorageStat)
+	if !ok {
+		return StorageStat{}, fmt.Errorf("Invalid storage response %T", res)
+	}
+	if !stat.Exists {
+		return stat, ErrStorageNotFound
+	}
+	return stat, nil
+}
+
+// request sends a storage message and waits for the first result
+func (s *UseStorage) request(msg StorageMessage) (interface{}, error) {
+	if _, err := s.root().sender(); err != nil {
+		return nil, err
+	}
+
+	ch := s.send(msg)
+	if ch == nil {
+		return nil, ErrStorageUnreachable
+	}
+
+	res, ok := <-ch
+	if !ok {
+		return nil, ErrStorageUnreachable
+	}
+
+	if err := StorageError(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// StorageValueSize returns the encoded size of a value, the values gob cannot encode cannot be stored
+func StorageValueSize(value interface{}) (int, error) {
+	counter := &byteCounter{}
+	if err := gob.NewEncoder(counter).Encode(&value); err != nil {
+		return 0, err
+	}
+	return counter.count, nil
+}
+
+type byteCounter struct {
+	count int
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.count += len(p)
+	return len(p), nil
 }
 
 func init() {
 	gob.Register(StorageMessage{})
+	gob.Register(StorageList{})
+	gob.Register(StorageStat{})
+	gob.Register(StorageItem{})
+	gob.Register([]uint64{})
+	gob.Register(StorageEvent{})
+	gob.Register([]string{})
+	gob.Register(StorageArchive{})
+	gob.Register([]StorageArchiveGrant{})
 }
@@ -0,0 +1,544 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// engineEndpoint serves a storage engine like the storage plugins do
+type engineEndpoint struct {
+	*StorageEngine
+}
+
+func (e engineEndpoint) HandleBroadcast(message interface{}) {}
+
+func (e engineEndpoint) HandleMessage(message interface{}) (<-chan interface{}, error) {
+	return e.HandleMessageFrom(uuid.Nil, message)
+}
+
+// testBus delivers the messages to the endpoints of the process like the local bus
+type testBus struct {
+	SimplePlugin
+	endpoints map[uuid.UUID]Endpoint
+}
+
+func (b *testBus) Priority() int                                   { return 0 }
+func (b *testBus) HandleBroadcast(message interface{})             {}
+func (b *testBus) HandlePublish(topic string, message interface{}) {}
+
+func (b *testBus) HandleMessage(id uuid.UUID, message interface{}) (<-chan interface{}, error) {
+	endpoint, ok := b.endpoints[id]
+	if !ok {
+		return nil, ErrStorageUnreachable
+	}
+	return DispatchMessage(endpoint, message)
+}
+
+func (b *testBus) Endpoints() []uuid.UUID {
+	ids := []uuid.UUID{}
+	for id := range b.endpoints {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// newTestStorage returns the storage helper of a plugin using a storage engine in memory
+func newTestStorage(plugin uuid.UUID) (*UseStorage, *StorageEngine) {
+	id := uuid.New()
+	engine := NewStorageEngine(id)
+	bus := &testBus{
+		SimplePlugin: SimplePlugin{Settings: SetupSettings(uuid.New(), "TestBus", "")},
+		endpoints:    map[uuid.UUID]Endpoint{id: engineEndpoint{engine}},
+	}
+
+	storage := &UseStorage{UUID: id}
+	storage.setIdentity(plugin)
+	storage.PluginLoaded(bus)
+	return storage, engine
+}
+
+func TestCompareAndSwapRace(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	if err := storage.Write("/counter", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				stat, err := storage.Stat("/counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				value, _ := (<-storage.Read("/counter")).(int)
+
+				// A write between the stat and the read changed the version, the swap fails
+				if _, err := storage.CompareAndSwap("/counter", stat.Version, value+1); err == ErrStorageConflict {
+					continue
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value := <-storage.Read("/counter"); value != workers*increments {
+		t.Fatalf("Expected %d, got %v", workers*increments, value)
+	}
+}
+
+func TestTransactionRace(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	accounts := []string{"/a", "/b", "/c"}
+	for _, path := range accounts {
+		if err := storage.Write(path, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Transfers between the accounts keep the total whatever the interleaving
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				from, to := accounts[(w+i)%3], accounts[(w+i+1)%3]
+				fromStat, err1 := storage.Stat(from)
+				toStat, err2 := storage.Stat(to)
+				if err1 != nil || err2 != nil {
+					t.Error(err1, err2)
+					return
+				}
+				fromValue, _ := (<-storage.Read(from)).(int)
+				toValue, _ := (<-storage.Read(to)).(int)
+
+				_, err := storage.Begin().
+					CompareAndSwap(from, fromStat.Version, fromValue-1).
+					CompareAndSwap(to, toStat.Version, toValue+1).
+					Commit()
+				if err != nil && err != ErrStorageConflict {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, path := range accounts {
+		value, _ := (<-storage.Read(path)).(int)
+		total += value
+	}
+	if total != 300 {
+		t.Fatalf("Expected a total of 300, got %d", total)
+	}
+}
+
+func TestWatchCompacted(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	if err := storage.Write("/first", 1); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := storage.Stat("/first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Push the first revision out of the history
+	for i := 0; i < storageHistory+10; i++ {
+		if err := storage.Write("/other", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	event := <-storage.Watch("/", stat.Version, done)
+	if event.Type != StorageEventCompacted || event.Revision != stat.Version {
+		t.Fatalf("Expected a compacted event at %d, got %+v", stat.Version, event)
+	}
+}
+
+// sameTestStorage returns the storage helper of another plugin on the same storage, of the host for uuid.Nil
+func sameTestStorage(s *UseStorage, plugin uuid.UUID) *UseStorage {
+	other := &UseStorage{UUID: s.UUID}
+	if plugin == uuid.Nil {
+		plugin = HostUUID
+	}
+	other.setIdentity(plugin)
+	for _, bus := range s.buses {
+		other.PluginLoaded(bus.(Plugin))
+	}
+	return other
+}
+
+func TestSnapshotAllNamespacesForHostOnly(t *testing.T) {
+	first := uuid.New()
+	storage, _ := newTestStorage(first)
+	if err := storage.Write("/value", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	second := sameTestStorage(storage, uuid.New())
+	if err := second.Write("/value", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := second.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespaces := archive.Namespaces(); len(namespaces) != 1 {
+		t.Fatalf("A plugin snapshot %d namespaces", len(namespaces))
+	}
+
+	archive, err = sameTestStorage(storage, uuid.Nil).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespaces := archive.Namespaces(); len(namespaces) != 2 {
+		t.Fatalf("The host snapshot %d namespaces", len(namespaces))
+	}
+}
+
+// unregistered is not known to gob so it cannot be stored
+type unregistered struct {
+	A int
+}
+
+func TestWriteRejectsValueWithoutSize(t *testing.T) {
+	storage, engine := newTestStorage(uuid.New())
+	engine.Quota = func(owner uuid.UUID) StorageQuota {
+		return StorageQuota{MaxBytes: 1 << 10}
+	}
+
+	if err := storage.Write("/value", unregistered{A: 1}); err == nil {
+		t.Fatal("A value which cannot be encoded was written")
+	}
+
+	_, err := storage.Begin().Write("/batch", 1).Write("/other", []interface{}{unregistered{A: 1}}).Commit()
+	if err == nil {
+		t.Fatal("A batch with a value which cannot be encoded was written")
+	}
+
+	for _, path := range []string{"/value", "/batch", "/other"} {
+		if exists, err := storage.Exists(path); err != nil || exists {
+			t.Fatalf("Expected %s to be missing, got %v %v", path, exists, err)
+		}
+	}
+}
+
+func TestDeleteExistsStat(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	if err := storage.Write("/nil", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Write("/value", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/nil", "/value"} {
+		if exists, err := storage.Exists(path); err != nil || !exists {
+			t.Fatalf("Expected %s to exist, got %v %v", path, exists, err)
+		}
+	}
+	if exists, err := storage.Exists("/missing"); err != nil || exists {
+		t.Fatalf("Expected /missing to be missing, got %v %v", exists, err)
+	}
+
+	stat, err := storage.Stat("/value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Path != "/value" || !stat.Exists || stat.Size == 0 || stat.Version == 0 || stat.Modified.IsZero() {
+		t.Fatalf("Unexpected stat %+v", stat)
+	}
+
+	if err := storage.Write("/value", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := storage.Stat("/value"); err != nil || again.Version <= stat.Version {
+		t.Fatalf("Expected a version after %d, got %+v %v", stat.Version, again, err)
+	}
+
+	if err := storage.Delete("/value"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := storage.Exists("/value"); err != nil || exists {
+		t.Fatalf("Expected /value to be deleted, got %v %v", exists, err)
+	}
+	if _, err := storage.Stat("/value"); err != ErrStorageNotFound {
+		t.Fatalf("Expected ErrStorageNotFound, got %v", err)
+	}
+	if value := <-storage.Read("/value"); value != nil {
+		t.Fatalf("Read %v from a deleted path", value)
+	}
+
+	// Another plugin has a namespace of its own
+	if exists, err := sameTestStorage(storage, uuid.New()).Exists("/nil"); err != nil || exists {
+		t.Fatalf("Expected /nil to be missing for another plugin, got %v %v", exists, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	for _, path := range []string{"/a/1", "/a/2", "/a/3", "/b/1"} {
+		if err := storage.Write(path, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := storage.List("/a/", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Paths) != 2 || list.Paths[0] != "/a/1" || list.Paths[1] != "/a/2" || list.Next == "" {
+		t.Fatalf("Unexpected first page %+v", list)
+	}
+
+	list, err = storage.List("/a/", list.Next, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Paths) != 1 || list.Paths[0] != "/a/3" || list.Next != "" {
+		t.Fatalf("Unexpected last page %+v", list)
+	}
+
+	if list, err = storage.List("/", "", 0); err != nil || len(list.Paths) != 4 {
+		t.Fatalf("Expected all the paths, got %+v %v", list, err)
+	}
+}
+
+// failingBackend fails to store the records of a path
+type failingBackend struct {
+	*MemoryBackend
+	path string
+}
+
+func (b *failingBackend) Put(record StorageRecord) error {
+	if strings.HasSuffix(record.Key, b.path) {
+		return errors.New("Disk full")
+	}
+	return b.MemoryBackend.Put(record)
+}
+
+func TestBatchRollsBackOnBackendFailure(t *testing.T) {
+	plugin := uuid.New()
+	storage, engine := newTestStorage(plugin)
+	if err := engine.SetBackend(&failingBackend{MemoryBackend: NewMemoryBackend(), path: "/broken"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Write("/a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Write("/b", "b"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := storage.Stat("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.Begin().Write("/a", "changed").Delete("/b").Write("/new", "new").Write("/broken", 1).Commit()
+	if err == nil {
+		t.Fatal("The batch succeeded with a failing backend")
+	}
+
+	if value := <-storage.Read("/a"); value != "a" {
+		t.Fatalf("Expected /a to be rolled back, got %v", value)
+	}
+	if value := <-storage.Read("/b"); value != "b" {
+		t.Fatalf("Expected /b to be rolled back, got %v", value)
+	}
+	if exists, err := storage.Exists("/new"); err != nil || exists {
+		t.Fatalf("Expected /new to be rolled back, got %v %v", exists, err)
+	}
+
+	// Nothing was accounted for the failed batch
+	if err := storage.Write("/c", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := storage.Stat("/c"); err != nil || stat.Version != before.Version+1 {
+		t.Fatalf("Expected version %d, got %+v %v", before.Version+1, stat, err)
+	}
+	if usage := engine.usage[plugin]; usage.Keys != 3 {
+		t.Fatalf("Expected 3 keys, got %+v", usage)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	plugin := uuid.New()
+	storage, engine := newTestStorage(plugin)
+	expires := time.Now().Add(time.Hour)
+	if err := storage.Write("/short", "short", WithExpiry(expires)); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Write("/long", "long"); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := storage.Stat("/long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if short, err := storage.Stat("/short"); err != nil || !short.Expires.Equal(expires) {
+		t.Fatalf("Expected /short to expire at %v, got %+v %v", expires, short, err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	events := storage.Watch("/", stat.Version, done)
+
+	// The value is missing once expired even before it is removed
+	later := expires.Add(time.Second)
+	if engine.Expired(expires.Add(-time.Second)) || !engine.Expired(later) {
+		t.Fatal("Expected /short to expire at its expiry")
+	}
+	ch, err := engine.Apply(plugin, StorageMessage{Type: StorageMessageTypeExists, Path: "/short"}, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists := <-ch; exists != false {
+		t.Fatalf("Expected /short to be missing after its expiry, got %v", exists)
+	}
+
+	engine.Expire(later)
+	if engine.Expired(later) {
+		t.Fatal("Expected no value left to expire")
+	}
+
+	select {
+	case event := <-events:
+		if event.Type != StorageEventExpire || event.Path != "/short" {
+			t.Fatalf("Expected /short to expire, got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No expiry event")
+	}
+
+	if usage := engine.usage[plugin]; usage.Keys != 1 {
+		t.Fatalf("Expected 1 key left, got %+v", usage)
+	}
+	if value := <-storage.Read("/long"); value != "long" {
+		t.Fatalf("Expected /long to stay, got %v", value)
+	}
+}
+
+func TestWriteWithTTL(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	if err := storage.Write("/value", 1, WithTTL(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := storage.Exists("/value"); err != nil || !exists {
+		t.Fatalf("Expected /value to exist, got %v %v", exists, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if exists, err := storage.Exists("/value"); err != nil || exists {
+		t.Fatalf("Expected /value to have expired, got %v %v", exists, err)
+	}
+	if _, err := storage.Stat("/value"); err != ErrStorageNotFound {
+		t.Fatalf("Expected ErrStorageNotFound, got %v", err)
+	}
+}
+
+func TestListDir(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	for _, path := range []string{"/dir/b", "/dir/a", "/dir/sub/x", "/dir/sub/y", "/dir2/c", "/other"} {
+		if err := storage.Write(path, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dir := range []string{"/dir", "/dir/"} {
+		names, err := storage.ListDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(names, ",") != "a,b,sub/" {
+			t.Fatalf("Unexpected children of %s: %v", dir, names)
+		}
+	}
+
+	if names, err := storage.ListDir("/"); err != nil || strings.Join(names, ",") != "dir/,dir2/,other" {
+		t.Fatalf("Unexpected children of the root: %v %v", names, err)
+	}
+	if names, err := storage.ListDir("/missing"); err != nil || len(names) != 0 {
+		t.Fatalf("Unexpected children of a missing directory: %v %v", names, err)
+	}
+}
+
+func TestRangePages(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/e", "/f"} {
+		if err := storage.Write(path, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The pages of the range from /b to /f (excluded) follow each other without gap nor repeat
+	var pages [][]string
+	start := "/b"
+	for start != "" {
+		list, err := storage.Range(start, "/f", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pages) > 3 {
+			t.Fatalf("Too many pages %v", pages)
+		}
+		pages = append(pages, list.Paths)
+		start = list.Next
+	}
+
+	if len(pages) != 2 || strings.Join(pages[0], ",") != "/b,/c" || strings.Join(pages[1], ",") != "/d,/e" {
+		t.Fatalf("Unexpected pages %v", pages)
+	}
+
+	if list, err := storage.Range("/c", "", 0); err != nil || strings.Join(list.Paths, ",") != "/c,/d,/e,/f" || list.Next != "" {
+		t.Fatalf("Unexpected range without end %+v %v", list, err)
+	}
+}
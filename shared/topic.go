@@ -0,0 +1,90 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// TopicSeparator separates the levels of a topic
+	TopicSeparator = "/"
+	// TopicWildcardOne matches exactly one level of a topic
+	TopicWildcardOne = "+"
+	// TopicWildcardAll matches all the remaining levels of a topic
+	TopicWildcardAll = "#"
+)
+
+// Subscriber is the interface that, when implemented, recieves the messages published on the subscribed topics
+type Subscriber interface {
+	// Subscriptions returns the topic patterns the subscriber is interested in
+	Subscriptions() []string
+	// HandlePublish handles the messages published on a subscribed topic
+	HandlePublish(topic string, message interface{})
+}
+
+// SubscriberBus is the interface that, when implemented by a BusService, lets the plugins publish to each subscriber
+// through a single bus, the bus with the highest priority among the ones routing it
+type SubscriberBus interface {
+	// Subscribers returns the subscribers of the topic reachable through the bus
+	Subscribers(topic string) []uuid.UUID
+	// HandlePublishTo sends the message published on the topic to some of its subscribers
+	HandlePublishTo(subscribers []uuid.UUID, topic string, message interface{})
+}
+
+// MatchTopic checks if a topic matches a pattern, e.g. "storage/+/changed" or "storage/#"
+func MatchTopic(pattern string, topic string) bool {
+	patternLevels := strings.Split(pattern, TopicSeparator)
+	topicLevels := strings.Split(topic, TopicSeparator)
+
+	for i, level := range patternLevels {
+		if level == TopicWildcardAll {
+			return i == len(patternLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != TopicWildcardOne && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(topicLevels)
+}
+
+// MatchAnyTopic checks if a topic matches at least one of the patterns
+func MatchAnyTopic(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
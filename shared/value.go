@@ -0,0 +1,231 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+const (
+	// ContentTypeBytes is the content type of raw bytes
+	ContentTypeBytes = "application/octet-stream"
+	// ContentTypeJSON is the content type of JSON documents
+	ContentTypeJSON = "application/json"
+	// ContentTypeGob is the content type of gob encoded values
+	ContentTypeGob = "application/x-gob"
+)
+
+// StorageValue is a serialized value stored with its content type and the name of its Go type
+type StorageValue struct {
+	ContentType string
+	Data        []byte
+	Type        string
+}
+
+// ContentTypeError is returned when a value cannot be read as the requested type
+type ContentTypeError struct {
+	Path        string
+	ContentType string
+	Target      string
+	Err         error
+}
+
+func (e *ContentTypeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Cannot read %s stored as %s into %s: %v", e.Path, e.ContentType, e.Target, e.Err)
+	}
+	return fmt.Sprintf("Cannot read %s stored as %s into %s", e.Path, e.ContentType, e.Target)
+}
+
+// storageTypeName names the type of a value, a pointer is named after the type it points to
+func storageTypeName(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// EncodeStorageValue serializes a value with the content type
+func EncodeStorageValue(contentType string, value interface{}) (StorageValue, error) {
+	typeName := storageTypeName(reflect.TypeOf(value))
+
+	switch contentType {
+	case ContentTypeBytes:
+		data, ok := value.([]byte)
+		if !ok {
+			return StorageValue{}, fmt.Errorf("Cannot store %T as %s", value, contentType)
+		}
+		return StorageValue{ContentType: contentType, Data: data, Type: typeName}, nil
+
+	case ContentTypeJSON:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return StorageValue{}, err
+		}
+		return StorageValue{ContentType: contentType, Data: data, Type: typeName}, nil
+
+	case ContentTypeGob:
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+			return StorageValue{}, err
+		}
+		return StorageValue{ContentType: contentType, Data: buf.Bytes(), Type: typeName}, nil
+	}
+
+	return StorageValue{}, fmt.Errorf("Unknown content type %s", contentType)
+}
+
+// Validate checks that the data is well formed for its content type
+func (v StorageValue) Validate() error {
+	switch v.ContentType {
+	case ContentTypeBytes, ContentTypeGob:
+		return nil
+	case ContentTypeJSON:
+		if !json.Valid(v.Data) {
+			return fmt.Errorf("Invalid %s value", v.ContentType)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown content type %s", v.ContentType)
+}
+
+// Decode deserializes the value into target, which must be a pointer to the type the value was stored as or to an
+// interface, the JSON fields unknown to the target are rejected
+func (v StorageValue) Decode(target interface{}) error {
+	if t := reflect.TypeOf(target); v.Type != "" && t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() != reflect.Interface {
+		if name := storageTypeName(t); name != v.Type {
+			return fmt.Errorf("The value was stored as %s", v.Type)
+		}
+	}
+
+	switch v.ContentType {
+	case ContentTypeBytes:
+		data, ok := target.(*[]byte)
+		if !ok {
+			return fmt.Errorf("Expected *[]byte, got %T", target)
+		}
+		*data = append([]byte(nil), v.Data...)
+		return nil
+
+	case ContentTypeJSON:
+		decoder := json.NewDecoder(bytes.NewReader(v.Data))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(target)
+
+	case ContentTypeGob:
+		return gob.NewDecoder(bytes.NewReader(v.Data)).Decode(target)
+	}
+
+	return fmt.Errorf("Unknown content type %s", v.ContentType)
+}
+
+// decodeStoredValue reads a stored value into target, serialized values are decoded and plain values are assigned
+func decodeStoredValue(path string, stored interface{}, target interface{}) error {
+	targetValue := reflect.ValueOf(target)
+	if targetValue.Kind() != reflect.Ptr || targetValue.IsNil() {
+		return fmt.Errorf("Cannot read %s into %T, a non nil pointer is required", path, target)
+	}
+
+	if value, ok := stored.(StorageValue); ok {
+		if err := value.Decode(target); err != nil {
+			return &ContentTypeError{Path: path, ContentType: value.ContentType, Target: fmt.Sprintf("%T", target), Err: err}
+		}
+		return nil
+	}
+
+	// Values written with Write are stored as is
+	elem := targetValue.Elem()
+	if stored == nil {
+		elem.Set(reflect.Zero(elem.Type()))
+		return nil
+	}
+
+	storedValue := reflect.ValueOf(stored)
+	if !storedValue.Type().AssignableTo(elem.Type()) {
+		return &ContentTypeError{Path: path, ContentType: fmt.Sprintf("a %T value", stored), Target: fmt.Sprintf("%T", target)}
+	}
+	elem.Set(storedValue)
+	return nil
+}
+
+// WriteJSON stores the value as a JSON document
+func (s *UseStorage) WriteJSON(path string, value interface{}, options ...WriteOption) error {
+	return s.writeEncoded(ContentTypeJSON, path, value, options)
+}
+
+// WriteGob stores the value gob encoded
+func (s *UseStorage) WriteGob(path string, value interface{}, options ...WriteOption) error {
+	return s.writeEncoded(ContentTypeGob, path, value, options)
+}
+
+// WriteBytes stores raw bytes
+func (s *UseStorage) WriteBytes(path string, data []byte, options ...WriteOption) error {
+	return s.writeEncoded(ContentTypeBytes, path, data, options)
+}
+
+func (s *UseStorage) writeEncoded(contentType string, path string, value interface{}, options []WriteOption) error {
+	encoded, err := EncodeStorageValue(contentType, value)
+	if err != nil {
+		return err
+	}
+
+	// Written through a batch to report the errors of the storage
+	_, err = s.Begin().Write(path, encoded, options...).Commit()
+	return err
+}
+
+// ReadInto reads the value stored at the path into target, which must be a pointer
+func (s *UseStorage) ReadInto(path string, target interface{}) error {
+	res, err := s.request(StorageMessage{Type: StorageMessageTypeGet, Path: path})
+	if err != nil {
+		return err
+	}
+
+	item, ok := res.(StorageItem)
+	if !ok {
+		return fmt.Errorf("Invalid storage response %T", res)
+	} else if !item.Exists {
+		return ErrStorageNotFound
+	}
+
+	return decodeStoredValue(path, item.Value, target)
+}
+
+func init() {
+	gob.Register(StorageValue{})
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2019, Hojat Parta
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  * Redistributions of source code must retain the above copyright notice,
+//    this list of conditions and the following disclaimer.
+//  * Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//  * Neither the name of  nor the names of its contributors may be used to
+//    endorse or promote products derived from this software without specific
+//    prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package shared
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type testConfig struct {
+	Name  string
+	Count int
+}
+
+type otherConfig struct {
+	Name string
+}
+
+func TestReadIntoChecksType(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+	if err := storage.WriteJSON("/config", testConfig{Name: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var config testConfig
+	if err := storage.ReadInto("/config", &config); err != nil || config.Count != 1 {
+		t.Fatalf("Read %+v %v", config, err)
+	}
+
+	var other otherConfig
+	if err := storage.ReadInto("/config", &other); err == nil {
+		t.Fatal("Read a value into another type")
+	} else if _, ok := err.(*ContentTypeError); !ok {
+		t.Fatalf("Expected a ContentTypeError, got %v", err)
+	}
+}
+
+func TestReadIntoRejectsUnknownFields(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+
+	// A document written by someone else has no type
+	document := StorageValue{ContentType: ContentTypeJSON, Data: []byte(`{"Name":"a","Count":1}`)}
+	if err := storage.Write("/config", document); err != nil {
+		t.Fatal(err)
+	}
+
+	var other otherConfig
+	if err := storage.ReadInto("/config", &other); err == nil {
+		t.Fatal("Read a document with a field unknown to the target")
+	}
+}
+
+func TestReadIntoMissing(t *testing.T) {
+	storage, _ := newTestStorage(uuid.New())
+
+	var value string
+	if err := storage.ReadInto("/missing", &value); err != ErrStorageNotFound {
+		t.Fatalf("Expected ErrStorageNotFound, got %v", err)
+	}
+
+	if err := storage.Write("/nil", nil); err != nil {
+		t.Fatal(err)
+	}
+	value = "set"
+	if err := storage.ReadInto("/nil", &value); err != nil || value != "" {
+		t.Fatalf("Read %q %v from a nil value", value, err)
+	}
+}
@@ -29,28 +29,93 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
 
+	"github.com/google/uuid"
 	"github.com/m4rs14n/go-app/shared"
 )
 
+var storageName = flag.String("storage", "UnencryptedStorage", "name of the storage plugin to back up or restore")
+var backupFile = flag.String("backup", "", "back up the storage to this archive before exiting")
+var restoreFile = flag.String("restore", "", "restore the storage from this archive after loading the plugins")
+var restoreNamespace = flag.String("namespace", "", "only restore the namespace of this plugin uuid")
+var configFile = flag.String("config", "", "JSON file with the settings of the plugins by name")
+
+// hostStorage returns a storage of the host on the storage plugin with the name
+func hostStorage(host *shared.Host, name string) (*shared.UseStorage, error) {
+	plugin := shared.GetPlugin(name)
+	if plugin == nil {
+		return nil, fmt.Errorf("Unknown storage %s", name)
+	}
+	return host.Storage(plugin.GetSettings().ID()), nil
+}
+
 func main() {
+	flag.Parse()
+
 	// Uncomment if you want to receive only warnings and above
 	// shared.SetGlobalLogLevel(shared.LogLevelWarning)
 
+	if *configFile != "" {
+		if err := shared.LoadConfig(*configFile); err != nil {
+			panic(err)
+		}
+	}
+
+	// The host is created before the plugins are loaded so none of them can claim it
+	host, err := shared.NewHost()
+	if err != nil {
+		panic(err)
+	}
+
 	done := shared.LoadAllPlugins("./")
 
+	for _, storage := range shared.FindPlugins(shared.CapabilityStorage) {
+		fmt.Printf("Storage: %s %v\n", storage.GetSettings().Name(), shared.PluginCapabilities(storage.GetSettings().Name()))
+	}
+
+	var buses []shared.BusService
+	if err := shared.FindPluginsOf(&buses); err == nil {
+		fmt.Printf("Buses: %d\n", len(buses))
+	}
+
+	if *restoreFile != "" {
+		namespace := uuid.Nil
+		if *restoreNamespace != "" {
+			namespace = uuid.MustParse(*restoreNamespace)
+		}
+
+		if storage, err := hostStorage(host, *storageName); err != nil {
+			fmt.Printf("Restore: %v\n", err)
+		} else if err := shared.RestoreStorage(storage, *restoreFile, namespace); err != nil {
+			fmt.Printf("Restore: %v\n", err)
+		}
+	}
+
 	service := shared.GetPlugin("MyService")
 	plugin := shared.GetPlugin("MyPlugin")
 
-	if storage, ok := service.(shared.Storage); ok {
-		// uuid of my_service plugin
+	if storage, ok := service.(shared.Storage); ok && plugin != nil {
+		// Stored in the namespace of my_service and shared read only with my_plugin
 		storage.Write("/path", "Hello World")
+		if err := storage.Share("/path", plugin.GetSettings().ID(), shared.StorageAccessRead); err != nil {
+			fmt.Printf("Share: %v\n", err)
+		}
+	}
+
+	if secrets, ok := service.(shared.Secrets); ok {
+		// Kept in the encrypted storage and redacted when printed
+		if err := secrets.PutSecret("token", "s3cr3t"); err != nil {
+			fmt.Printf("PutSecret: %v\n", err)
+		}
+		secret, err := secrets.GetSecret("token")
+		fmt.Printf("Secret: %v %v\n", secret, err)
 	}
 
 	if storage, ok := plugin.(shared.Storage); ok {
-		for response := range storage.Read("/path") {
+		for response := range storage.Shared(service.GetSettings().ID()).Read("/path") {
 			fmt.Printf("Read: %v\n", response)
 		}
 	}
@@ -59,5 +124,13 @@ func main() {
 	reader := bufio.NewReader(os.Stdin)
 	reader.ReadString('\n')
 
+	if *backupFile != "" {
+		if storage, err := hostStorage(host, *storageName); err != nil {
+			fmt.Printf("Backup: %v\n", err)
+		} else if err := shared.BackupStorage(storage, *backupFile); err != nil {
+			fmt.Printf("Backup: %v\n", err)
+		}
+	}
+
 	shared.StopAllPlugins(done)
 }